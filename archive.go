@@ -0,0 +1,531 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	_ "modernc.org/sqlite"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Archive is a SQLite database of every message received, with its results
+// from each destination, so there's a record of them all that outlives any
+// of the platforms they were posted to. Images can be kept too, in a
+// content-addressed store: a directory of files named for their SHA-256.
+type Archive struct {
+	db       *sql.DB
+	imageDir string
+}
+
+const archiveSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id           INTEGER PRIMARY KEY,
+	message_sid  TEXT UNIQUE,
+	phone        TEXT NOT NULL DEFAULT '',
+	sender       TEXT NOT NULL,
+	text         TEXT NOT NULL,
+	received_at  TEXT NOT NULL,
+	processed_at TEXT
+);
+CREATE INDEX IF NOT EXISTS messages_received_at ON messages (received_at);
+
+CREATE TABLE IF NOT EXISTS results (
+	message_id  INTEGER NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+	destination TEXT NOT NULL,
+	url         TEXT NOT NULL DEFAULT '',
+	error       TEXT NOT NULL DEFAULT '',
+	media       TEXT NOT NULL DEFAULT '[]',
+	updated_at  TEXT NOT NULL,
+	PRIMARY KEY (message_id, destination)
+);
+
+CREATE TABLE IF NOT EXISTS images (
+	message_id   INTEGER NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+	position     INTEGER NOT NULL,
+	twilio_url   TEXT NOT NULL DEFAULT '',
+	sha256       TEXT NOT NULL DEFAULT '',
+	filename     TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (message_id, position)
+);
+` + archiveSearchSchema
+
+// archiveSearchSchema is the full-text index of the messages' text & sender,
+// which triggers keep up to date
+const archiveSearchSchema = `
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5 (
+	text, sender,
+	content = 'messages', content_rowid = 'id',
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+	INSERT INTO messages_fts (rowid, text, sender) VALUES (new.id, new.text, new.sender);
+END;
+CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+	INSERT INTO messages_fts (messages_fts, rowid, text, sender) VALUES ('delete', old.id, old.text, old.sender);
+END;
+CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF text, sender ON messages BEGIN
+	INSERT INTO messages_fts (messages_fts, rowid, text, sender) VALUES ('delete', old.id, old.text, old.sender);
+	INSERT INTO messages_fts (rowid, text, sender) VALUES (new.id, new.text, new.sender);
+END;
+`
+
+// archiveTimeFormat is how times are stored: in UTC, in a format that sorts
+// as text & that SQLite's date functions understand
+const archiveTimeFormat = "2006-01-02 15:04:05.000"
+
+func archiveTime(t time.Time) string {
+	return t.UTC().Format(archiveTimeFormat)
+}
+
+// OpenArchive opens (creating, if need be) the archive database. Images are
+// kept in imageDir, unless it's "".
+func OpenArchive(filename string, imageDir string) (*Archive, error) {
+	if dir := filepath.Dir(filename); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	db, err := sql.Open("sqlite", "file:"+filename+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// an archive from before there was a search index needs one built
+	var indexed int
+	err = db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'messages_fts'`).Scan(&indexed)
+	if err == nil {
+		_, err = db.Exec(archiveSchema)
+	}
+	if err == nil && indexed == 0 {
+		_, err = db.Exec(`INSERT INTO messages_fts (messages_fts) VALUES ('rebuild')`)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating archive %s: %w", filename, err)
+	}
+	return &Archive{db: db, imageDir: imageDir}, nil
+}
+
+// Close closes the database
+func (a *Archive) Close() error {
+	return a.db.Close()
+}
+
+// Record saves the message & its results, updating any earlier record of it
+// (e.g. before it was replayed), and returns its ID in the archive.
+func (a *Archive) Record(message *Message) (int64, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := a.recordMessage(tx, message)
+	if err != nil {
+		return 0, err
+	}
+
+	now := archiveTime(time.Now())
+	for destination, result := range message.Results {
+		media, _ := json.Marshal(result.Media)
+		if result.Media == nil {
+			media = []byte("[]")
+		}
+		var errText string
+		if result.Err != nil {
+			errText = result.Err.Error()
+		}
+		_, err = tx.Exec(`INSERT INTO results (message_id, destination, url, error, media, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (message_id, destination) DO UPDATE SET
+				url = excluded.url, error = excluded.error, media = excluded.media, updated_at = excluded.updated_at`,
+			id, destination, result.URL, errText, string(media), now)
+		if err != nil {
+			return 0, fmt.Errorf("error archiving %s result: %w", destination, err)
+		}
+	}
+
+	if err = a.recordImages(tx, id, message); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// recordMessage inserts the message, or updates it if it has a MessageSid
+// that's already archived
+func (a *Archive) recordMessage(tx *sql.Tx, message *Message) (int64, error) {
+	var sid interface{} // NULL unless there's a MessageSid, so it's unique
+	if message.MessageSid != "" {
+		sid = message.MessageSid
+	}
+	var id int64
+	err := tx.QueryRow(`INSERT INTO messages (message_sid, phone, sender, text, received_at, processed_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (message_sid) DO UPDATE SET processed_at = excluded.processed_at
+		RETURNING id`,
+		sid, message.Phone, message.From, message.Text, archiveTime(message.ReceivedTime()), archiveTime(time.Now())).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("error archiving message: %w", err)
+	}
+	return id, nil
+}
+
+// archiveImageLimits is the pictures kept in the image store, which the web
+// page & feeds show, so, as on a static site, they're web pictures, converted
+// & turned upright if need be
+var archiveImageLimits = ImageLimits{Types: webImageTypes}
+
+// recordImages saves the message's images, keeping a copy of each picture in
+// the image store, if there is one. Images already archived are left alone.
+func (a *Archive) recordImages(tx *sql.Tx, id int64, message *Message) error {
+	count := len(message.ImageFilenames)
+	if len(message.TwilioImageURLs) > count {
+		count = len(message.TwilioImageURLs)
+	}
+	for i := 0; i < count; i++ {
+		var twilioURL, sum, stored string
+		if i < len(message.TwilioImageURLs) {
+			twilioURL = message.TwilioImageURLs[i]
+		}
+		if i < len(message.ImageFilenames) && a.imageDir != "" {
+			var err error
+			file := MediaFile{Filename: message.ImageFilenames[i], Type: message.MediaType(i)}
+			if sum, stored, err = a.storeImage(file); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`INSERT INTO images (message_id, position, twilio_url, sha256, filename)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (message_id, position) DO UPDATE SET
+				sha256 = CASE WHEN excluded.sha256 = '' THEN sha256 ELSE excluded.sha256 END,
+				filename = CASE WHEN excluded.filename = '' THEN filename ELSE excluded.filename END`,
+			id, i+1, twilioURL, sum, stored)
+		if err != nil {
+			return fmt.Errorf("error archiving image %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// storeImage copies the picture into the image store as, e.g.,
+// ab/abcdef….jpg (named for its SHA-256), returning the hash & the path
+// within the store. The same picture sent twice is only stored once. Files
+// that aren't web pictures are converted, or else not stored.
+func (a *Archive) storeImage(media MediaFile) (string, string, error) {
+	prepared, err := prepareImage(media, archiveImageLimits)
+	if err != nil {
+		log.Printf("not keeping %q in the archive: %s\n", media.Filename, err)
+		return "", "", nil
+	}
+	if prepared.Filename != media.Filename {
+		defer os.Remove(prepared.Filename)
+	}
+	filename := prepared.Filename
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	file.Close()
+	if err != nil {
+		return "", "", err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	stored := filepath.Join(sum[:2], sum+strings.ToLower(filepath.Ext(filename)))
+	path := filepath.Join(a.imageDir, stored)
+	if _, err = os.Stat(path); err == nil {
+		return sum, stored, nil
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", "", err
+	}
+	if err = copyFile(filename, path); err != nil {
+		return "", "", fmt.Errorf("error storing image %q: %w", filename, err)
+	}
+	return sum, stored, nil
+}
+
+// openArchive opens the configured archive, or returns nil if it's turned off
+func openArchive(c Config) (*Archive, error) {
+	if c.archiveFile() == "" {
+		return nil, nil
+	}
+	return OpenArchive(c.archiveFile(), c.archiveImageDir())
+}
+
+// archiveMessage records the message in the archive, if there is one; an
+// error is only logged, since the message has been posted regardless
+func archiveMessage(archive *Archive, message *Message) {
+	if archive == nil {
+		return
+	}
+	if _, err := archive.Record(message); err != nil {
+		log.Printf("error archiving message from %s: %s", message.From, err)
+	}
+}
+
+// ArchivedMessage is a message as it's recorded in the archive.
+type ArchivedMessage struct {
+	ID         int64
+	MessageSid string
+	Phone      string
+	Sender     string
+	Text       string
+	Received   time.Time
+	Processed  time.Time
+	Results    []ArchivedResult
+	Images     []ArchivedImage
+}
+
+// ArchivedResult is the outcome of posting an archived message to one
+// destination.
+type ArchivedResult struct {
+	Destination string
+	URL         string
+	Error       string
+	Media       []string
+}
+
+// ArchivedImage is one of an archived message's images. Filename is its path
+// within the image store, or "" if it wasn't kept.
+type ArchivedImage struct {
+	Position  int
+	TwilioURL string
+	SHA256    string
+	Filename  string
+}
+
+// MessageQuery picks out archived messages: all of them, or those from one
+// sender, containing some text, or received within a range of dates.
+type MessageQuery struct {
+	Sender string
+	Text   string
+	Since  time.Time // inclusive; zero for no limit
+	Until  time.Time // exclusive; zero for no limit
+	Limit  int       // 0 for no limit
+	Offset int
+}
+
+// where returns the SQL conditions for the query's Sender, Text, Since &
+// Until, & their arguments
+func (query MessageQuery) where() (string, []interface{}) {
+	var since, until string
+	if !query.Since.IsZero() {
+		since = archiveTime(query.Since)
+	}
+	if !query.Until.IsZero() {
+		until = archiveTime(query.Until)
+	}
+	return `(? = '' OR sender = ?) AND (? = '' OR text LIKE ? ESCAPE '\')
+			AND (? = '' OR received_at >= ?) AND (? = '' OR received_at < ?)`,
+		[]interface{}{query.Sender, query.Sender, query.Text, "%" + escapeLike(query.Text) + "%", since, since, until, until}
+}
+
+// escapeLike escapes the wildcards in s, for a LIKE pattern with ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func parseArchiveTime(s string) time.Time {
+	t, _ := time.ParseInLocation(archiveTimeFormat, s, time.UTC)
+	return t
+}
+
+// Messages returns the messages matching the query, newest first, with
+// their results & images
+func (a *Archive) Messages(query MessageQuery) ([]ArchivedMessage, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = -1 // SQLite for no limit
+	}
+	where, args := query.where()
+	rows, err := a.db.Query(`SELECT id, coalesce(message_sid, ''), phone, sender, text, received_at, coalesce(processed_at, '')
+		FROM messages
+		WHERE `+where+`
+		ORDER BY received_at DESC, id DESC
+		LIMIT ? OFFSET ?`,
+		append(args, limit, query.Offset)...)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	return messages, a.loadDetails(messages)
+}
+
+// eachMessageBatch is how many messages EachMessage reads at a time
+const eachMessageBatch = 100
+
+// EachMessage calls fn with each message matching the query's Sender, Text,
+// Since & Until (its Limit & Offset are ignored), oldest first, with their
+// results & images. They're read a batch at a time, so the whole archive never
+// has to fit in memory. An error from fn stops it, & is returned.
+func (a *Archive) EachMessage(query MessageQuery, fn func(message ArchivedMessage) error) error {
+	where, args := query.where()
+	var lastID int64
+	for {
+		rows, err := a.db.Query(`SELECT id, coalesce(message_sid, ''), phone, sender, text, received_at, coalesce(processed_at, '')
+			FROM messages
+			WHERE id > ? AND `+where+`
+			ORDER BY id
+			LIMIT ?`,
+			append(append([]interface{}{lastID}, args...), eachMessageBatch)...)
+		if err != nil {
+			return err
+		}
+		messages, err := scanMessages(rows)
+		if err == nil {
+			err = a.loadDetails(messages)
+		}
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			if err = fn(message); err != nil {
+				return err
+			}
+		}
+		if len(messages) < eachMessageBatch {
+			return nil
+		}
+		lastID = messages[len(messages)-1].ID
+	}
+}
+
+// scanMessages reads the rows of a query for messages' columns, in the order
+// Messages selects them, & closes them
+func scanMessages(rows *sql.Rows) ([]ArchivedMessage, error) {
+	defer rows.Close()
+	var messages []ArchivedMessage
+	for rows.Next() {
+		var message ArchivedMessage
+		var received, processed string
+		err := rows.Scan(&message.ID, &message.MessageSid, &message.Phone, &message.Sender, &message.Text, &received, &processed)
+		if err != nil {
+			return nil, err
+		}
+		message.Received, message.Processed = parseArchiveTime(received), parseArchiveTime(processed)
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// loadDetails fills in each message's results & images
+func (a *Archive) loadDetails(messages []ArchivedMessage) error {
+	for i := range messages {
+		message := &messages[i]
+		rows, err := a.db.Query(`SELECT destination, url, error, media FROM results WHERE message_id = ? ORDER BY destination`, message.ID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var result ArchivedResult
+			var media string
+			if err = rows.Scan(&result.Destination, &result.URL, &result.Error, &media); err != nil {
+				rows.Close()
+				return err
+			}
+			_ = json.Unmarshal([]byte(media), &result.Media)
+			message.Results = append(message.Results, result)
+		}
+		rows.Close()
+		sortResults(message.Results)
+
+		rows, err = a.db.Query(`SELECT position, twilio_url, sha256, filename FROM images WHERE message_id = ? ORDER BY position`, message.ID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var image ArchivedImage
+			if err = rows.Scan(&image.Position, &image.TwilioURL, &image.SHA256, &image.Filename); err != nil {
+				rows.Close()
+				return err
+			}
+			message.Images = append(message.Images, image)
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+// sortResults puts the results in the destinations' priority order, as in
+// replies to the sender
+func sortResults(results []ArchivedResult) {
+	order := make(map[string]int)
+	for i, name := range publisherNames() {
+		if _, ok := order[name]; !ok {
+			order[name] = i
+		}
+	}
+	rank := func(name string) int {
+		if i, ok := order[name]; ok {
+			return i
+		}
+		return len(order)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return rank(results[i].Destination) < rank(results[j].Destination) })
+}
+
+// HasResult reports whether any archived message was posted to the
+// destination at the URL
+func (a *Archive) HasResult(destination string, url string) (bool, error) {
+	var count int
+	err := a.db.QueryRow(`SELECT count(*) FROM results WHERE destination = ? AND url = ?`, destination, url).Scan(&count)
+	return count > 0, err
+}
+
+// Destinations returns the name of every destination with a result in the
+// archive, in the destinations' priority order
+func (a *Archive) Destinations() ([]string, error) {
+	rows, err := a.db.Query(`SELECT DISTINCT destination FROM results ORDER BY destination`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []ArchivedResult
+	for rows.Next() {
+		var result ArchivedResult
+		if err = rows.Scan(&result.Destination); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	sortResults(results)
+	destinations := make([]string, len(results))
+	for i, result := range results {
+		destinations[i] = result.Destination
+	}
+	return destinations, nil
+}
+
+// Senders returns the names of everyone with a message in the archive
+func (a *Archive) Senders() ([]string, error) {
+	rows, err := a.db.Query(`SELECT DISTINCT sender FROM messages ORDER BY sender`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var senders []string
+	for rows.Next() {
+		var sender string
+		if err = rows.Scan(&sender); err != nil {
+			return nil, err
+		}
+		senders = append(senders, sender)
+	}
+	return senders, rows.Err()
+}
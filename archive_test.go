@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestArchive(t *testing.T, imageDir string) *Archive {
+	archive, err := OpenArchive(filepath.Join(t.TempDir(), "archive.db"), imageDir)
+	if err != nil {
+		t.Fatalf("error opening archive: %s", err)
+	}
+	t.Cleanup(func() { archive.Close() })
+	return archive
+}
+
+func TestArchiveRecord(t *testing.T) {
+	imageDir := t.TempDir()
+	archive := openTestArchive(t, imageDir)
+
+	images := writeTestImages(t, 10, 10) // the same picture twice
+	message := Message{
+		MessageSid:      "SM0123",
+		Phone:           "+15125551212",
+		From:            "Gon",
+		Text:            "just a couple bros",
+		Received:        time.Date(2023, 11, 27, 14, 32, 5, 0, time.FixedZone("CST", -6*60*60)),
+		TwilioImageURLs: []string{"https://api.twilio.com/1", "https://api.twilio.com/2"},
+		ImageFilenames:  images,
+		Results: map[string]PublishResult{
+			"microblog": {URL: "https://foo.micro.blog/1", Media: []string{"https://foo.micro.blog/1.jpg"}},
+			"twitter":   {Err: errors.New("boom")},
+		},
+	}
+	id, err := archive.Record(&message)
+	if err != nil {
+		t.Fatalf("expected no error, got %q", err)
+	}
+
+	var phone, sender, text, received string
+	err = archive.db.QueryRow("SELECT phone, sender, text, received_at FROM messages WHERE id = ?", id).Scan(&phone, &sender, &text, &received)
+	if err != nil || phone != "+15125551212" || sender != "Gon" || text != "just a couple bros" || received != "2023-11-27 20:32:05.000" {
+		t.Errorf("unexpected message %q %q %q %q (%v)", phone, sender, text, received, err)
+	}
+
+	var twitterError, media string
+	_ = archive.db.QueryRow("SELECT error FROM results WHERE message_id = ? AND destination = 'twitter'", id).Scan(&twitterError)
+	_ = archive.db.QueryRow("SELECT media FROM results WHERE message_id = ? AND destination = 'microblog'", id).Scan(&media)
+	if twitterError != "boom" || media != `["https://foo.micro.blog/1.jpg"]` {
+		t.Errorf("unexpected results %q & %q", twitterError, media)
+	}
+
+	// both images are recorded, but stored once
+	var count int
+	var stored string
+	_ = archive.db.QueryRow("SELECT count(DISTINCT filename), max(filename) FROM images WHERE message_id = ?", id).Scan(&count, &stored)
+	if count != 1 {
+		t.Errorf("expected the same picture stored once, got %d", count)
+	}
+	if _, err = os.Stat(filepath.Join(imageDir, stored)); err != nil {
+		t.Errorf("expected image stored as %q: %s", stored, err)
+	}
+
+	// once replayed, the same message is updated, not added again
+	message.Results = map[string]PublishResult{"twitter": {URL: "https://twitter.com/1"}}
+	message.ImageFilenames = nil
+	again, err := archive.Record(&message)
+	if err != nil || again != id {
+		t.Fatalf("expected message %d updated, got %d (%v)", id, again, err)
+	}
+	var url string
+	_ = archive.db.QueryRow("SELECT url, error FROM results WHERE message_id = ? AND destination = 'twitter'", id).Scan(&url, &twitterError)
+	if url != "https://twitter.com/1" || twitterError != "" {
+		t.Errorf("expected the twitter result updated, got %q %q", url, twitterError)
+	}
+	_ = archive.db.QueryRow("SELECT count(*) FROM images WHERE message_id = ? AND filename != ''", id).Scan(&count)
+	if count != 2 {
+		t.Errorf("expected the stored images kept, got %d", count)
+	}
+}
+
+func TestArchiveStoresWebImages(t *testing.T) {
+	imageDir := t.TempDir()
+	archive := openTestArchive(t, imageDir)
+	bmp := copyFixtureImage(t, "picture.bmp")
+	message := Message{
+		MessageSid:     "SM0123",
+		From:           "Gon",
+		Text:           "hi",
+		ImageFilenames: []string{bmp, writeTestMedia(t, "vcard")[0]},
+		MediaTypes:     []string{"image/bmp", "text/vcard"},
+	}
+	id, err := archive.Record(&message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the BMP's kept as a JPEG, & the contact card not at all
+	var first, second string
+	_ = archive.db.QueryRow("SELECT filename FROM images WHERE message_id = ? AND position = 1", id).Scan(&first)
+	_ = archive.db.QueryRow("SELECT filename FROM images WHERE message_id = ? AND position = 2", id).Scan(&second)
+	if filepath.Ext(first) != ".jpg" || second != "" {
+		t.Fatalf("expected only a converted picture stored, got %q & %q", first, second)
+	}
+	if _, format := decodeTestImage(t, filepath.Join(imageDir, first)); format != "jpeg" {
+		t.Errorf("expected a JPEG stored, got %s", format)
+	}
+	if files, _ := filepath.Glob(filepath.Join(filepath.Dir(bmp), "*")); len(files) != 1 {
+		t.Errorf("expected the converted copy removed, got %v", files)
+	}
+}
+
+func TestArchiveWithoutMessageSid(t *testing.T) {
+	archive := openTestArchive(t, "")
+	message := Message{From: "Gon", Text: "hi", TwilioImageURLs: []string{"https://api.twilio.com/1"}}
+
+	first, _ := archive.Record(&message)
+	second, _ := archive.Record(&message)
+	if first == second {
+		t.Errorf("expected messages without a MessageSid archived separately")
+	}
+
+	// with no image store, only the Twilio URL is kept
+	var twilioURL, stored string
+	_ = archive.db.QueryRow("SELECT twilio_url, filename FROM images WHERE message_id = ?", first).Scan(&twilioURL, &stored)
+	if twilioURL != "https://api.twilio.com/1" || stored != "" {
+		t.Errorf("unexpected image %q %q", twilioURL, stored)
+	}
+}
+
+func TestArchiveFileConfig(t *testing.T) {
+	var tests = []struct {
+		configured    string
+		expectedFile  string
+		expectedImage string
+	}{
+		{configured: "", expectedFile: "archive.db", expectedImage: "archive-images"},
+		{configured: "-", expectedFile: "", expectedImage: ""},
+		{configured: "/var/lib/txt2mary/archive", expectedFile: "/var/lib/txt2mary/archive", expectedImage: "/var/lib/txt2mary/archive"},
+	}
+	for _, test := range tests {
+		c := Config{ArchiveFile: test.configured, ArchiveImageDir: test.configured}
+		if actual := c.archiveFile(); actual != test.expectedFile {
+			t.Errorf("archiveFile() for %q != %q (%q)", test.configured, test.expectedFile, actual)
+		}
+		if actual := c.archiveImageDir(); actual != test.expectedImage {
+			t.Errorf("archiveImageDir() for %q != %q (%q)", test.configured, test.expectedImage, actual)
+		}
+	}
+}
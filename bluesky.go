@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	blueskyService     = "https://bsky.social"
+	blueskyMaxImages   = 4
+	blueskyMaxBlobSize = 1000000 // bytes per image
+	blueskyMaxText     = 300     // characters (strictly, graphemes) per post
+	blueskySessionAge  = time.Hour
+)
+
+// blueskyImageLimits is the pictures Bluesky takes: its blobs are limited to
+// a megabyte, & it shows them at up to 2000 pixels
+var blueskyImageLimits = ImageLimits{
+	Types:    newMediaTypeSet("image/jpeg", "image/png", "image/webp"),
+	MaxBytes: blueskyMaxBlobSize,
+	MaxSide:  2000,
+}
+
+func init() {
+	RegisterPublisher("bluesky", 40, func(config Config) Publisher {
+		if config.Bluesky == (BlueskyConfig{}) {
+			return nil
+		}
+		return &BlueskyPublisher{config: config.Bluesky, template: config.postTemplate("bluesky", plainPostTemplate)}
+	})
+}
+
+// BlueskyPublisher posts messages to a Bluesky account via its PDS (personal
+// data server), using the AT Protocol's XRPC API.
+type BlueskyPublisher struct {
+	config   BlueskyConfig
+	template *PostTemplate
+
+	mu          sync.Mutex
+	session     blueskySession
+	sessionTime time.Time
+}
+
+type blueskySession struct {
+	AccessJwt string `json:"accessJwt"`
+	Did       string `json:"did"`
+	Handle    string `json:"handle"`
+}
+
+func (p *BlueskyPublisher) Name() string {
+	return "bluesky"
+}
+
+// Enabled only posts test messages to a test account (& real messages to the
+// real account), like Twitter
+func (p *BlueskyPublisher) Enabled(message *Message) bool {
+	return IsTestMessage(message) == p.config.TestAccount
+}
+
+func (p *BlueskyPublisher) service() string {
+	if p.config.Service == "" {
+		return blueskyService
+	}
+	return strings.TrimSuffix(p.config.Service, "/")
+}
+
+// xrpc calls an XRPC procedure, retrying per the retryPolicy (only if it
+// can't have been sent, if it creates a post), and decodes the JSON response
+// into out
+func (p *BlueskyPublisher) xrpc(ctx context.Context, method string, creates bool, token string, contentType string, body []byte, out interface{}) error {
+	endpoint := p.service() + "/xrpc/" + method
+	do := retryPolicy.Do
+	if creates {
+		do = retryPolicy.DoOnce
+	}
+	return do(ctx, "calling Bluesky's "+method, func() error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return Permanent(err)
+		}
+		request.Header.Set("Content-Type", contentType)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err = checkStatus("Bluesky", resp); err != nil {
+			return err
+		}
+		return Permanent(json.NewDecoder(resp.Body).Decode(out))
+	})
+}
+
+// login returns a session, creating a new one with the app password if there
+// isn't a recent one to reuse
+func (p *BlueskyPublisher) login(ctx context.Context) (blueskySession, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.session.AccessJwt != "" && time.Since(p.sessionTime) < blueskySessionAge {
+		return p.session, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"identifier": p.config.Handle, "password": p.config.AppPassword})
+	var session blueskySession
+	if err := p.xrpc(ctx, "com.atproto.server.createSession", false, "", "application/json", body, &session); err != nil {
+		return session, err
+	}
+	p.session, p.sessionTime = session, time.Now()
+	return session, nil
+}
+
+// UploadMedia uploads up to four of the Message's images as blobs, converted
+// or shrunk for Bluesky if need be, skipping files of other types, and returns
+// the blob references as JSON.
+func (p *BlueskyPublisher) UploadMedia(ctx context.Context, message *Message) ([]string, error) {
+	files, remove := message.prepareMedia("Bluesky", blueskyImageLimits)
+	defer remove()
+	if len(files) == 0 {
+		return nil, nil
+	}
+	session, err := p.login(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var blobs []string
+	for _, file := range files {
+		filename := file.Filename
+		if len(blobs) == blueskyMaxImages {
+			log.Printf("Bluesky allows only %d images per post; skipping the rest\n", blueskyMaxImages)
+			break
+		}
+		contents, err := os.ReadFile(filename)
+		if err != nil {
+			return blobs, err
+		}
+
+		var uploaded struct {
+			Blob json.RawMessage `json:"blob"`
+		}
+		err = p.xrpc(ctx, "com.atproto.repo.uploadBlob", false, session.AccessJwt, file.Type, contents, &uploaded)
+		if err != nil {
+			log.Printf("error uploading %q to Bluesky: %s", filename, err)
+			return blobs, err
+		}
+		log.Printf("uploaded image %q to Bluesky\n", filename)
+		blobs = append(blobs, string(uploaded.Blob))
+	}
+	return blobs, nil
+}
+
+var linkPattern = regexp.MustCompile(`https?://[^\s]+`)
+
+type blueskyFacet struct {
+	Index struct {
+		ByteStart int `json:"byteStart"`
+		ByteEnd   int `json:"byteEnd"`
+	} `json:"index"`
+	Features []map[string]string `json:"features"`
+}
+
+// linkFacets marks up the links in the text, so Bluesky shows them as links.
+// Facet positions are in bytes of the UTF-8 text, not characters.
+func linkFacets(text string) []blueskyFacet {
+	var facets []blueskyFacet
+	for _, match := range linkPattern.FindAllStringIndex(text, -1) {
+		start, end := match[0], match[1]
+		// leave off punctuation that's more likely the sentence's than the link's
+		end = start + len(strings.TrimRight(text[start:end], ".,;:!?\"')"))
+
+		var facet blueskyFacet
+		facet.Index.ByteStart, facet.Index.ByteEnd = start, end
+		facet.Features = []map[string]string{{"$type": "app.bsky.richtext.facet#link", "uri": text[start:end]}}
+		facets = append(facets, facet)
+	}
+	return facets
+}
+
+// blueskyText formats the post, shortening the message to fit if need be
+func blueskyText(postTemplate *PostTemplate, message *Message) (string, error) {
+	text, err := postTemplate.Format(message)
+	if err != nil {
+		return "", err
+	}
+	over := utf8.RuneCountInString(text) - blueskyMaxText
+	if over <= 0 {
+		return text, nil
+	}
+
+	runes := []rune(message.Text)
+	keep := len(runes) - over - 1
+	if keep < 0 {
+		keep = 0
+	}
+	shortened := *message
+	shortened.Text = string(runes[:keep]) + "…"
+	if text, err = postTemplate.Format(&shortened); err != nil {
+		return "", err
+	}
+	// a template that repeats the text could still be too long
+	if runes = []rune(text); len(runes) > blueskyMaxText {
+		text = string(runes[:blueskyMaxText-1]) + "…"
+	}
+	return text, nil
+}
+
+// Publish creates an app.bsky.feed.post record with the Message's text & the
+// already-uploaded images, returning the post's URL on bsky.app.
+func (p *BlueskyPublisher) Publish(ctx context.Context, message *Message, blobs []string) (string, error) {
+	session, err := p.login(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	text, err := blueskyText(p.template.or(plainPostTemplate), message)
+	if err != nil {
+		return "", Permanent(err)
+	}
+	record := map[string]interface{}{
+		"$type":     "app.bsky.feed.post",
+		"text":      text,
+		"createdAt": time.Now().UTC().Format(time.RFC3339),
+	}
+	if facets := linkFacets(text); len(facets) > 0 {
+		record["facets"] = facets
+	}
+	if len(blobs) > 0 {
+		var images []map[string]interface{}
+		for i, blob := range blobs {
+			images = append(images, map[string]interface{}{
+				"alt":   fmt.Sprintf("picture %d of %d texted by %s", i+1, len(blobs), message.From),
+				"image": json.RawMessage(blob),
+			})
+		}
+		record["embed"] = map[string]interface{}{"$type": "app.bsky.embed.images", "images": images}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"repo":       session.Did,
+		"collection": "app.bsky.feed.post",
+		"record":     record,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var created struct {
+		URI string `json:"uri"`
+	}
+	err = p.xrpc(ctx, "com.atproto.repo.createRecord", true, session.AccessJwt, "application/json", body, &created)
+	if err != nil {
+		log.Printf("error posting to Bluesky: %s", err)
+		return "", err
+	}
+	log.Printf("posted message to Bluesky\n")
+	return blueskyPostURL(session.Handle, created.URI), nil
+}
+
+// blueskyPostURL turns a post's at:// URI, e.g.
+// at://did:plc:abc/app.bsky.feed.post/3k44, into its bsky.app URL
+func blueskyPostURL(handle string, uri string) string {
+	rkey := uri[strings.LastIndex(uri, "/")+1:]
+	return fmt.Sprintf("https://bsky.app/profile/%s/post/%s", handle, rkey)
+}
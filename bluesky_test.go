@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePDS stands in for a Bluesky PDS, recording what was uploaded & posted
+type fakePDS struct {
+	*httptest.Server
+	mu       sync.Mutex
+	sessions int
+	blobs    [][]byte
+	records  []map[string]interface{}
+}
+
+func newFakePDS(t *testing.T) *fakePDS {
+	fake := &fakePDS{}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		switch r.URL.Path {
+		case "/xrpc/com.atproto.server.createSession":
+			var login struct{ Identifier, Password string }
+			_ = json.NewDecoder(r.Body).Decode(&login)
+			if login.Identifier != "mary.bsky.social" || login.Password != "app-pass" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fake.sessions++
+			_, _ = w.Write([]byte(`{"accessJwt": "jwt123", "did": "did:plc:mary", "handle": "mary.bsky.social"}`))
+		case "/xrpc/com.atproto.repo.uploadBlob":
+			if r.Header.Get("Authorization") != "Bearer jwt123" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var body bytes.Buffer
+			_, _ = body.ReadFrom(r.Body)
+			fake.blobs = append(fake.blobs, body.Bytes())
+			_, _ = fmt.Fprintf(w, `{"blob": {"$type": "blob", "ref": {"$link": "bafk%d"}, "mimeType": %q, "size": %d}}`,
+				len(fake.blobs), r.Header.Get("Content-Type"), body.Len())
+		case "/xrpc/com.atproto.repo.createRecord":
+			if r.Header.Get("Authorization") != "Bearer jwt123" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var create map[string]interface{}
+			_ = json.NewDecoder(r.Body).Decode(&create)
+			fake.records = append(fake.records, create)
+			_, _ = w.Write([]byte(`{"uri": "at://did:plc:mary/app.bsky.feed.post/3k44abc", "cid": "bafyrei"}`))
+		default:
+			t.Errorf("unexpected Bluesky request to %s", r.URL.Path)
+		}
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func writeTestImages(t *testing.T, sizes ...int) []string {
+	dir := t.TempDir()
+	var filenames []string
+	for i, size := range sizes {
+		filename := filepath.Join(dir, fmt.Sprintf("ME%d_temp.jpg", i))
+		contents := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, bytes.Repeat([]byte{0}, size)...)
+		_ = os.WriteFile(filename, contents, 0600)
+		filenames = append(filenames, filename)
+	}
+	return filenames
+}
+
+func TestBlueskyPublisher(t *testing.T) {
+	fake := newFakePDS(t)
+	publisher := &BlueskyPublisher{config: BlueskyConfig{Service: fake.URL + "/", Handle: "mary.bsky.social", AppPassword: "app-pass"}}
+
+	// six images, one too big: the big one is skipped & only four are kept
+	images := writeTestImages(t, 10, blueskyMaxBlobSize, 10, 10, 10, 10)
+	message := Message{From: "Gon", Text: "see https://example.com/cats! ✨", ImageFilenames: images}
+
+	result := publish(context.Background(), publisher, &message, defaultPublishTimeout)
+	if result.Err != nil {
+		t.Fatalf("expected no error, got %q", result.Err)
+	}
+	if result.URL != "https://bsky.app/profile/mary.bsky.social/post/3k44abc" {
+		t.Errorf("unexpected post URL %q", result.URL)
+	}
+	if fake.sessions != 1 {
+		t.Errorf("expected the session to be reused, got %d sessions", fake.sessions)
+	}
+	if len(fake.blobs) != blueskyMaxImages {
+		t.Errorf("expected %d images uploaded, got %d", blueskyMaxImages, len(fake.blobs))
+	}
+
+	if len(fake.records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(fake.records))
+	}
+	create := fake.records[0]
+	if create["repo"] != "did:plc:mary" || create["collection"] != "app.bsky.feed.post" {
+		t.Errorf("unexpected createRecord request %v", create)
+	}
+	record := create["record"].(map[string]interface{})
+	text := record["text"].(string)
+	if text != "\"see https://example.com/cats! ✨\"\n\n– Gon" {
+		t.Errorf("unexpected text %q", text)
+	}
+	embed := record["embed"].(map[string]interface{})
+	if embed["$type"] != "app.bsky.embed.images" || len(embed["images"].([]interface{})) != blueskyMaxImages {
+		t.Errorf("expected images embedded, got %v", embed)
+	}
+	image := embed["images"].([]interface{})[0].(map[string]interface{})
+	if image["alt"] != "picture 1 of 4 texted by Gon" || image["image"].(map[string]interface{})["mimeType"] != "image/jpeg" {
+		t.Errorf("unexpected embedded image %v", image)
+	}
+	if len(record["facets"].([]interface{})) != 1 {
+		t.Errorf("expected a link facet, got %v", record["facets"])
+	}
+}
+
+func TestBlueskyBadLogin(t *testing.T) {
+	fake := newFakePDS(t)
+	publisher := &BlueskyPublisher{config: BlueskyConfig{Service: fake.URL, Handle: "mary.bsky.social", AppPassword: "wrong"}}
+
+	result := publish(context.Background(), publisher, &Message{From: "Gon", Text: "hi"}, defaultPublishTimeout)
+	if result.Err == nil || !strings.Contains(result.Err.Error(), "status code 401") {
+		t.Errorf("expected a 401 error, got %v", result.Err)
+	}
+	if len(fake.records) != 0 {
+		t.Errorf("expected nothing posted")
+	}
+}
+
+func TestLinkFacets(t *testing.T) {
+	var tests = []struct {
+		text     string
+		expected []string // the text each facet covers
+	}{
+		{text: "no links here", expected: nil},
+		{text: "see https://example.com/cats.", expected: []string{"https://example.com/cats"}},
+		{text: "✨ http://a.example & https://b.example/x?y=1 ✨", expected: []string{"http://a.example", "https://b.example/x?y=1"}},
+	}
+
+	for _, test := range tests {
+		facets := linkFacets(test.text)
+		if len(facets) != len(test.expected) {
+			t.Errorf("linkFacets(%q): expected %d facets, got %d", test.text, len(test.expected), len(facets))
+			continue
+		}
+		for i, facet := range facets {
+			covered := test.text[facet.Index.ByteStart:facet.Index.ByteEnd]
+			if covered != test.expected[i] || facet.Features[0]["uri"] != test.expected[i] {
+				t.Errorf("linkFacets(%q): expected facet for %q, got %q", test.text, test.expected[i], covered)
+			}
+		}
+	}
+}
+
+func TestBlueskyText(t *testing.T) {
+	short, _ := blueskyText(plainPostTemplate, &Message{From: "Gon", Text: "hi"})
+	if short != "\"hi\"\n\n– Gon" {
+		t.Errorf("unexpected text %q", short)
+	}
+
+	long, _ := blueskyText(plainPostTemplate, &Message{From: "Gon", Text: strings.Repeat("é", 400)})
+	if count := len([]rune(long)); count != blueskyMaxText {
+		t.Errorf("expected long text shortened to %d characters, got %d", blueskyMaxText, count)
+	}
+	if !strings.HasSuffix(long, "é…\"\n\n– Gon") {
+		t.Errorf("expected shortened text to end with an ellipsis, got %q", long[len(long)-20:])
+	}
+}
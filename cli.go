@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const usage = `usage: txt2mary [--config file] <command> [arguments]
+
+commands:
+  serve           run the webhook server (the default)
+  post            post a message from the command line
+  replay          post a saved, failed message again
+  search          search the archive of messages
+  export          export the archive as JSON Lines, CSV, or a zip bundle
+  import          archive the messages in a Micro.blog export
+  config check    check the config file & everything it points to
+  users list      list the users allowed to text
+  version         print the version
+`
+
+// run parses the command line and runs the command, returning the exit code
+func run(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("txt2mary", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.StringVar(&ConfigFilename, "config", ConfigFilename, "the config file to use")
+	flags.Usage = func() {
+		fmt.Fprint(stdout, usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	command, args := "serve", flags.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		setup()
+		serve()
+		return 0
+	case "post":
+		setup()
+		return postCommand(args, stdout)
+	case "replay":
+		setup()
+		return replay(args, stdout)
+	case "search":
+		setup()
+		return searchCommand(args, stdout)
+	case "export":
+		setup()
+		return exportCommand(args, stdout, os.Stderr)
+	case "import":
+		setup()
+		return importCommand(args, stdout)
+	case "config":
+		if len(args) != 1 || args[0] != "check" {
+			fmt.Fprintf(stdout, "usage: txt2mary config check\n")
+			return 2
+		}
+		return checkConfigCommand(ConfigFilename, stdout)
+	case "users":
+		if len(args) != 1 || args[0] != "list" {
+			fmt.Fprintf(stdout, "usage: txt2mary users list\n")
+			return 2
+		}
+		return listUsersCommand(ConfigFilename, stdout)
+	case "version":
+		fmt.Fprintf(stdout, "txt2mary %s\n", Version)
+		return 0
+	default:
+		fmt.Fprintf(stdout, "unknown command %q\n\n", command)
+		flags.Usage()
+		return 2
+	}
+}
+
+// stringList is a flag that can be given more than once
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// postCommand implements `txt2mary post`, which posts a message just as if
+// it had been texted in.
+func postCommand(args []string, stdout io.Writer) int {
+	var images stringList
+	flags := flag.NewFlagSet("post", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	from := flags.String("from", "", "who the message is from: a phone number or name in the users file")
+	text := flags.String("text", "", "the message text (begin with \"TEST: \" for a test message)")
+	flags.Var(&images, "image", "an image file to include (can be given more than once)")
+	only := flags.String("only", "", "comma-separated destinations to post to (default: all)")
+	dryRun := flags.Bool("dry-run", false, "show what would be posted, without posting anything")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *from == "" || flags.NArg() != 0 {
+		fmt.Fprintf(stdout, "usage: txt2mary post --from <phone or name> --text <message> [--image file]... [--only destinations] [--dry-run]\n")
+		flags.PrintDefaults()
+		return 2
+	}
+
+	users, err := ReadUsersFile(config.UsersFilename)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return 1
+	}
+	phone, name := sender(users, *from)
+	if name == "" {
+		fmt.Fprintf(stdout, "%q isn't a phone number or name in %s\n", *from, config.UsersFilename)
+		return 1
+	}
+
+	chosen := publishers
+	if *only != "" {
+		if chosen, err = namedPublishers(publishers, *only); err != nil {
+			fmt.Fprintf(stdout, "%s\n", err)
+			return 1
+		}
+	}
+
+	message := Message{Phone: phone, From: name, Text: *text, Received: time.Now(), NumImages: len(images), ImageFilenames: images}
+	if *dryRun {
+		fmt.Fprintf(stdout, "would post message from %s, with %d images: %q\n", message.From, message.NumImages, message.Text)
+		for _, publisher := range chosen {
+			if publisher.Enabled(&message) {
+				fmt.Fprintf(stdout, "  to: %s\n", publisher.Name())
+			}
+		}
+		return 0
+	}
+
+	// posting removes the pictures' metadata, so it's done to copies of them
+	tempDir, err := os.MkdirTemp("", "txt2mary-post-")
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return 1
+	}
+	defer os.RemoveAll(tempDir)
+	message.ImageFilenames = nil
+	for i, image := range images {
+		copied := filepath.Join(tempDir, fmt.Sprintf("%d-%s", i+1, filepath.Base(image)))
+		if err = copyFile(image, copied); err != nil {
+			fmt.Fprintf(stdout, "%s\n", err)
+			return 1
+		}
+		message.ImageFilenames = append(message.ImageFilenames, copied)
+	}
+
+	err = post(context.Background(), &message, chosen)
+	printResults(stdout, chosen, &message)
+	recordInArchive(stdout, &message)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// recordInArchive records a message posted from the command line in the
+// archive, if there is one
+func recordInArchive(stdout io.Writer, message *Message) {
+	commandArchive, err := openArchive(config)
+	if err != nil {
+		fmt.Fprintf(stdout, "error opening archive: %s\n", err)
+		return
+	}
+	if commandArchive == nil {
+		return
+	}
+	defer commandArchive.Close()
+	if _, err = commandArchive.Record(message); err != nil {
+		fmt.Fprintf(stdout, "error archiving message: %s\n", err)
+	}
+}
+
+// sender returns the phone number & name for a phone number in the users
+// file, or for a name that's one of the users'
+func sender(users map[string]string, from string) (string, string) {
+	if name, ok := users[from]; ok {
+		return from, name
+	}
+	for phone, name := range users {
+		if strings.EqualFold(name, from) {
+			return phone, name
+		}
+	}
+	return "", ""
+}
+
+// printResults prints the URL, or error, for each destination
+func printResults(stdout io.Writer, publishers []Publisher, message *Message) {
+	for _, publisher := range publishers {
+		result, ok := message.Results[publisher.Name()]
+		switch {
+		case !ok:
+			fmt.Fprintf(stdout, "%s: skipped\n", publisher.Name())
+		case result.Err != nil:
+			fmt.Fprintf(stdout, "%s: error: %s\n", publisher.Name(), result.Err)
+		default:
+			fmt.Fprintf(stdout, "%s: %s\n", publisher.Name(), result.URL)
+		}
+	}
+}
+
+// checkConfigCommand implements `txt2mary config check`
+func checkConfigCommand(filename string, stdout io.Writer) int {
+	checkConfig, err := ReadConfig(filename)
+	if err != nil {
+		fmt.Fprintf(stdout, "error: %s\n", err)
+		return 1
+	}
+
+	problems, warnings := CheckConfig(checkConfig)
+	for _, warning := range warnings {
+		fmt.Fprintf(stdout, "warning: %s\n", warning)
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(stdout, "error: %s\n", problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+
+	var names []string
+	for _, publisher := range ConfiguredPublishers(checkConfig) {
+		names = append(names, publisher.Name())
+	}
+	fmt.Fprintf(stdout, "%s is OK; posting to: %s\n", filename, listOrNone(names))
+	return 0
+}
+
+// CheckConfig looks for mistakes in the config, returning problems that would
+// stop the server working, and warnings about things that might not be meant.
+func CheckConfig(c Config) (problems []string, warnings []string) {
+	if c.Server == "" {
+		warnings = append(warnings, "no Server configured; listening on port 80")
+	}
+	if !strings.HasPrefix(c.ServerRoute, "/") {
+		problems = append(problems, fmt.Sprintf("ServerRoute %q must begin with \"/\"", c.ServerRoute))
+	}
+
+	users, err := ReadUsersFile(c.UsersFilename)
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else if len(users) == 0 {
+		warnings = append(warnings, fmt.Sprintf("no users in %s, so nobody can text in", c.UsersFilename))
+	}
+
+	if c.Twilio.AuthToken == "" {
+		warnings = append(warnings, "no Twilio AuthToken configured, so webhook signatures won't be checked")
+	}
+	if c.Mastodon != (MastodonConfig{}) {
+		if !strings.HasPrefix(c.Mastodon.Server, "https://") && !strings.HasPrefix(c.Mastodon.Server, "http://") {
+			problems = append(problems, fmt.Sprintf("Mastodon Server %q must be a URL, like \"https://mastodon.social\"", c.Mastodon.Server))
+		}
+		switch c.Mastodon.Visibility {
+		case "", "public", "unlisted", "private", "direct":
+		default:
+			problems = append(problems, fmt.Sprintf("Mastodon Visibility %q must be public, unlisted, private, or direct", c.Mastodon.Visibility))
+		}
+	}
+	if c.Bluesky != (BlueskyConfig{}) && (c.Bluesky.Handle == "" || c.Bluesky.AppPassword == "") {
+		problems = append(problems, "Bluesky needs both a Handle and an AppPassword")
+	}
+	for i, site := range c.Micropub {
+		label := fmt.Sprintf("Micropub site #%d", i+1)
+		if site.Name != "" {
+			label = fmt.Sprintf("Micropub site %q", site.Name)
+		}
+		if _, ok := micropubPresets[site.Preset]; site.Preset != "" && !ok {
+			problems = append(problems, fmt.Sprintf("%s has unknown Preset %q", label, site.Preset))
+		} else if site.Preset == "" && site.Site == "" && site.Endpoint == "" {
+			problems = append(problems, fmt.Sprintf("%s needs a Site or an Endpoint", label))
+		}
+		if site.Token == "" {
+			problems = append(problems, fmt.Sprintf("%s has no Token", label))
+		}
+	}
+
+	if c.StaticSite.ContentDir != "" && c.StaticSite.AssetsDir == "" {
+		problems = append(problems, "StaticSite needs an AssetsDir to copy images into")
+	}
+
+	if c.Web.Password != "" {
+		if route := c.Web.route(); !strings.HasPrefix(route, "/") || route == "/" || route == "" || route == c.ServerRoute || route == "/status" {
+			problems = append(problems, fmt.Sprintf("Web Route %q must begin with \"/\" and not be \"/\", \"/status\", or the ServerRoute", c.Web.Route))
+		}
+		if c.archiveFile() == "" {
+			warnings = append(warnings, "the web UI is configured, but there's no archive for it to show")
+		}
+	}
+
+	if c.Feed.URL != "" {
+		if u, err := url.Parse(c.Feed.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("Feed URL %q must be the server's public URL, e.g. https://txt.example.com", c.Feed.URL))
+		}
+		taken := map[string]bool{c.ServerRoute: true, "/status": true, feedImageRoute: true}
+		if c.Web.Password != "" {
+			taken[c.Web.route()] = true
+		}
+		for _, format := range []string{"rss", "atom", "json"} {
+			feedPath, ok := c.Feed.paths()[format]
+			if !ok {
+				continue
+			}
+			if !strings.HasPrefix(feedPath, "/") || feedPath == "/" || taken[feedPath] {
+				problems = append(problems, fmt.Sprintf("Feed %s path %q must begin with \"/\" and not be \"/\" or already in use", format, feedPath))
+			}
+			taken[feedPath] = true
+		}
+		if c.archiveFile() == "" {
+			warnings = append(warnings, "feeds are configured, but there's no archive for them to show")
+		}
+	}
+
+	configured := ConfiguredPublishers(c)
+	problems = append(problems, duplicateNames(configured)...)
+	if len(configured) == 0 {
+		warnings = append(warnings, "no destinations configured, so messages won't be posted anywhere")
+	}
+
+	templateErrors, templateWarnings := templateProblems(c)
+	problems = append(problems, templateErrors...)
+	warnings = append(warnings, templateWarnings...)
+	return
+}
+
+// listUsersCommand implements `txt2mary users list`
+func listUsersCommand(filename string, stdout io.Writer) int {
+	usersConfig, err := ReadConfig(filename)
+	if err != nil {
+		fmt.Fprintf(stdout, "error: %s\n", err)
+		return 1
+	}
+	users, err := ReadUsersFile(usersConfig.UsersFilename)
+	if err != nil {
+		fmt.Fprintf(stdout, "error: %s\n", err)
+		return 1
+	}
+
+	phones := make([]string, 0, len(users))
+	for phone := range users {
+		phones = append(phones, phone)
+	}
+	sort.Strings(phones)
+	for _, phone := range phones {
+		fmt.Fprintf(stdout, "%s\t%s\n", phone, users[phone])
+	}
+	return 0
+}
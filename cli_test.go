@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunConfigCheck(t *testing.T) {
+	defer func() { ConfigFilename = "config.json" }()
+
+	var stdout bytes.Buffer
+	code := run([]string{"--config", "./fixtures/config_test.json", "config", "check"}, &stdout)
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d: %s", code, stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "./fixtures/config_test.json is OK; posting to: microblog, twitter") {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+
+	// a config with mistakes
+	broken := filepath.Join(t.TempDir(), "config.json")
+	_ = os.WriteFile(broken, []byte(`{"ServerRoute": "txt", "UsersFilename": "./fixtures/users_test.json"}`), 0600)
+	stdout.Reset()
+	code = run([]string{"--config", broken, "config", "check"}, &stdout)
+	if code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	output := stdout.String()
+	if !strings.Contains(output, `error: ServerRoute "txt" must begin with "/"`) {
+		t.Errorf("expected ServerRoute error, got %q", output)
+	}
+	if !strings.Contains(output, "warning: no Twilio AuthToken configured") || !strings.Contains(output, "warning: no destinations configured") {
+		t.Errorf("expected warnings, got %q", output)
+	}
+
+	stdout.Reset()
+	if code = run([]string{"--config", "nope.json", "config", "check"}, &stdout); code != 1 {
+		t.Errorf("expected a missing config file to fail, got exit code %d", code)
+	}
+}
+
+func TestRunUsersList(t *testing.T) {
+	defer func() { ConfigFilename = "config.json" }()
+
+	var stdout bytes.Buffer
+	code := run([]string{"--config", "./fixtures/config_test.json", "users", "list"}, &stdout)
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if stdout.String() != "+15125551212\tGon\n+15125551213\tKillua\n" {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+}
+
+func TestRunUnknownCommand(t *testing.T) {
+	var stdout bytes.Buffer
+	if code := run([]string{"frobnicate"}, &stdout); code != 2 {
+		t.Errorf("expected exit code 2, got %d", code)
+	}
+	if !strings.Contains(stdout.String(), `unknown command "frobnicate"`) {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+}
+
+func TestPostCommand(t *testing.T) {
+	TestMode = true
+	config = LoadConfig()
+	config.ArchiveFile = filepath.Join(t.TempDir(), "archive.db")
+	config.ArchiveImageDir = t.TempDir()
+	microblog := &fakePublisher{name: "microblog", enabled: true}
+	twitter := &fakePublisher{name: "twitter", enabled: true}
+	publishers = []Publisher{microblog, twitter}
+	defer func() {
+		config = Config{}
+		publishers = nil
+	}()
+
+	var tests = []struct {
+		args          []string
+		expectedCode  int
+		expectedOut   string
+		expectedPosts int
+	}{
+		{args: []string{"--from", "+15125551212", "--text", "hi"}, expectedCode: 0, expectedOut: "microblog: https://microblog.example.com/1\ntwitter: https://twitter.example.com/1\n", expectedPosts: 1},
+		{args: []string{"--from", "killua", "--text", "hi", "--only", "twitter"}, expectedCode: 0, expectedOut: "twitter: https://twitter.example.com/1\n", expectedPosts: 1},
+		{args: []string{"--from", "Gon", "--text", "hi", "--image", "a.jpg", "--image", "b.jpg", "--dry-run"}, expectedCode: 0, expectedOut: "would post message from Gon, with 2 images: \"hi\"\n  to: microblog\n  to: twitter\n", expectedPosts: 0},
+		{args: []string{"--from", "+15125551214", "--text", "hi"}, expectedCode: 1, expectedOut: "\"+15125551214\" isn't a phone number or name in ./fixtures/users_test.json\n", expectedPosts: 0},
+	}
+
+	for _, test := range tests {
+		microblog.posted, twitter.posted = nil, nil
+		var stdout bytes.Buffer
+		code := postCommand(test.args, &stdout)
+		if code != test.expectedCode {
+			t.Errorf("postCommand(%v): expected exit code %d, got %d", test.args, test.expectedCode, code)
+		}
+		if stdout.String() != test.expectedOut {
+			t.Errorf("postCommand(%v): expected output %q, got %q", test.args, test.expectedOut, stdout.String())
+		}
+		if len(twitter.posted) != test.expectedPosts {
+			t.Errorf("postCommand(%v): expected %d posts, got %d", test.args, test.expectedPosts, len(twitter.posted))
+		}
+	}
+
+	// the posted messages were archived, with the sender's number
+	archive, err := OpenArchive(config.ArchiveFile, "")
+	if err != nil {
+		t.Fatalf("error opening archive: %s", err)
+	}
+	defer archive.Close()
+	var phones []string
+	rows, _ := archive.db.Query("SELECT phone FROM messages ORDER BY id")
+	for rows.Next() {
+		var phone string
+		_ = rows.Scan(&phone)
+		phones = append(phones, phone)
+	}
+	if strings.Join(phones, " ") != "+15125551212 +15125551213" {
+		t.Errorf("expected 2 messages archived, got %v", phones)
+	}
+}
+
+func TestPostCommandLeavesImages(t *testing.T) {
+	TestMode = true
+	config = LoadConfig()
+	config.ArchiveFile = "-"
+	microblog := &fakePublisher{name: "microblog", enabled: true}
+	publishers = []Publisher{microblog}
+	defer func() {
+		config = Config{}
+		publishers = nil
+	}()
+
+	// the metadata's removed from what's posted, not from the picture itself
+	image := copyFixtureImage(t, "gps.jpg")
+	var stdout bytes.Buffer
+	if code := postCommand([]string{"--from", "Gon", "--text", "hi", "--image", image}, &stdout); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stdout.String())
+	}
+	if !bytes.Equal(mustReadFile(t, image), mustReadFile(t, "fixtures/images/gps.jpg")) {
+		t.Errorf("expected %s left as it was", image)
+	}
+}
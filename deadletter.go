@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DeadLetter is a message that couldn't be posted to every destination, even
+// after retrying, saved with its error so it can be replayed later.
+type DeadLetter struct {
+	ID       string
+	Failed   time.Time
+	Error    string
+	Message  Message
+	filename string
+}
+
+// WriteDeadLetter saves the message & error as a JSON file in the dead-letter
+// directory, returning its filename. The message's downloaded images are
+// copied alongside it, since the originals are about to be removed; if one
+// can't be, it & the ones after it are downloaded again on replay.
+func WriteDeadLetter(dir string, message Message, postErr error) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	id := message.MessageSid
+	if !IsMessageSid(id) {
+		id = newJobID()
+	}
+
+	var copies []string
+	for i, filename := range message.ImageFilenames {
+		copied := filepath.Join(dir, fmt.Sprintf("%s-%d-%s", id, i, filepath.Base(filename)))
+		if err := copyFile(filename, copied); err != nil {
+			log.Printf("error copying %q to dead letters: %s", filename, err)
+			break
+		}
+		copies = append(copies, copied)
+	}
+	message.ImageFilenames = copies
+
+	letter := DeadLetter{ID: id, Failed: time.Now(), Error: postErr.Error(), Message: message}
+	contents, err := json.MarshalIndent(letter, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	filename := filepath.Join(dir, id+".json")
+	return filename, writeFileAtomic(filename, contents)
+}
+
+// LoadDeadLetter reads a dead letter, given either the path of its file or
+// its ID (the MessageSid, usually), which is looked for in the directory.
+func LoadDeadLetter(dir string, ref string) (*DeadLetter, error) {
+	filename := ref
+	if _, err := os.Stat(filename); err != nil {
+		filename = filepath.Join(dir, ref+".json")
+	}
+	contents, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no dead letter %q, either as a file or in %q", ref, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var letter DeadLetter
+	if err = json.Unmarshal(contents, &letter); err != nil {
+		return nil, fmt.Errorf("error parsing dead letter %q: %w", filename, err)
+	}
+	letter.filename = filename
+	return &letter, nil
+}
+
+// Save rewrites a loaded dead letter, e.g. with the results of replaying it
+func (letter *DeadLetter) Save() error {
+	contents, err := json.MarshalIndent(letter, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(letter.filename, contents)
+}
+
+// Remove deletes a loaded dead letter, along with its saved images
+func (letter *DeadLetter) Remove() error {
+	RemoveTwilioImages(&letter.Message)
+	return os.Remove(letter.filename)
+}
+
+func copyFile(from string, to string) error {
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(destination, source); err != nil {
+		destination.Close()
+		return err
+	}
+	return destination.Close()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteDeadLetter(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(t.TempDir(), "ME456_temp.jpg")
+	if err := os.WriteFile(image, []byte("jpeg"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	message := Message{
+		MessageSid:     "SM0123",
+		From:           "Gon",
+		Text:           "hi",
+		NumImages:      1,
+		ImageFilenames: []string{image},
+		Results: map[string]PublishResult{
+			"microblog": {URL: "https://foo.micro.blog/1"},
+			"twitter":   {Err: errors.New("boom")},
+		},
+	}
+	filename, err := WriteDeadLetter(dir, message, errors.New("failed posting to twitter"))
+	if err != nil {
+		t.Fatalf("expected no error, got %q", err)
+	}
+	if filename != filepath.Join(dir, "SM0123.json") {
+		t.Errorf("expected dead letter named for the MessageSid, got %q", filename)
+	}
+
+	contents, _ := os.ReadFile(filename)
+	var letter DeadLetter
+	if err = json.Unmarshal(contents, &letter); err != nil {
+		t.Fatalf("error parsing dead letter: %s", err)
+	}
+	if letter.Error != "failed posting to twitter" || letter.Message.Text != "hi" {
+		t.Errorf("expected message & error to be saved, got %+v", letter)
+	}
+	if letter.Message.Results["twitter"].Err == nil || letter.Message.Results["microblog"].URL != "https://foo.micro.blog/1" {
+		t.Errorf("expected results to be saved, got %+v", letter.Message.Results)
+	}
+
+	// the image is kept, even once the original is removed
+	RemoveTwilioImages(&message)
+	if len(letter.Message.ImageFilenames) != 1 {
+		t.Fatalf("expected 1 saved image, got %v", letter.Message.ImageFilenames)
+	}
+	if saved, err := os.ReadFile(letter.Message.ImageFilenames[0]); err != nil || string(saved) != "jpeg" {
+		t.Errorf("expected image copied to dead letters, got %q (%v)", saved, err)
+	}
+}
+
+func TestWriteDeadLetterMissingImage(t *testing.T) {
+	dir := t.TempDir()
+	images := writeTestMedia(t, "jpeg", "png")
+	missing := filepath.Join(t.TempDir(), "ME789_temp.gif")
+	message := Message{MessageSid: "SM0123", NumImages: 3, ImageFilenames: []string{images[0], missing, images[1]}}
+
+	// what comes after one that can't be copied is downloaded again on replay
+	filename, err := WriteDeadLetter(dir, message, errors.New("failed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	letter, err := LoadDeadLetter(dir, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letter.Message.ImageFilenames) != 1 || letter.Message.NumImages != 3 {
+		t.Errorf("expected just the first image kept, got %+v", letter.Message)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// SeenMessage records a message that's been received, so a repeated delivery
+// of it (Twilio retries webhooks that time out) isn't posted again.
+type SeenMessage struct {
+	Received time.Time
+	Finished time.Time // zero while the message is still being posted
+	Results  map[string]PublishResult
+}
+
+// DedupeStore remembers the Twilio MessageSids of received messages, and the
+// results of posting them, in a JSON file. Entries are forgotten once they're
+// older than the expiry, by which time Twilio has long since stopped retrying.
+type DedupeStore struct {
+	filename string
+	expiry   time.Duration
+	mu       sync.Mutex
+	seen     map[string]*SeenMessage
+}
+
+// OpenDedupeStore loads the store from the given file, if it exists.
+func OpenDedupeStore(filename string, expiry time.Duration) (*DedupeStore, error) {
+	store := &DedupeStore{filename: filename, expiry: expiry, seen: make(map[string]*SeenMessage)}
+	contents, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(contents, &store.seen); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// save writes the store to disk; the caller must hold the lock
+func (s *DedupeStore) save() error {
+	cutoff := time.Now().Add(-s.expiry)
+	for sid, seen := range s.seen {
+		if seen.Received.Before(cutoff) {
+			delete(s.seen, sid)
+		}
+	}
+
+	contents, err := json.MarshalIndent(s.seen, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.filename, contents)
+}
+
+// Claim records the MessageSid as received, returning true if it's new. If
+// it's been seen before, what's known about it is returned instead.
+func (s *DedupeStore) Claim(sid string) (SeenMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seen, ok := s.seen[sid]; ok && time.Since(seen.Received) < s.expiry {
+		return *seen, false
+	}
+	s.seen[sid] = &SeenMessage{Received: time.Now()}
+	if err := s.save(); err != nil {
+		log.Printf("error saving dedupe store %q: %s", s.filename, err)
+	}
+	return SeenMessage{}, true
+}
+
+// Finish records the results of posting the message with the given MessageSid
+func (s *DedupeStore) Finish(sid string, results map[string]PublishResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen, ok := s.seen[sid]
+	if !ok {
+		seen = &SeenMessage{Received: time.Now()}
+		s.seen[sid] = seen
+	}
+	seen.Finished = time.Now()
+	seen.Results = results
+	if err := s.save(); err != nil {
+		log.Printf("error saving dedupe store %q: %s", s.filename, err)
+	}
+}
+
+// Forget removes the MessageSid, so a retry of it is treated as new
+func (s *DedupeStore) Forget(sid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.seen, sid)
+	if err := s.save(); err != nil {
+		log.Printf("error saving dedupe store %q: %s", s.filename, err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDedupeStoreClaim(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dedupe.json")
+	store, err := OpenDedupeStore(filename, time.Hour)
+	if err != nil {
+		t.Fatalf("error opening dedupe store: %s", err)
+	}
+
+	if _, isNew := store.Claim("SM1"); !isNew {
+		t.Errorf("expected first Claim to be new")
+	}
+	seen, isNew := store.Claim("SM1")
+	if isNew {
+		t.Errorf("expected second Claim not to be new")
+	}
+	if !seen.Finished.IsZero() {
+		t.Errorf("expected message not to be finished yet")
+	}
+
+	store.Finish("SM1", map[string]PublishResult{
+		"microblog": {URL: "https://foo.micro.blog/1"},
+		"twitter":   {Err: errors.New("boom")},
+	})
+	seen, _ = store.Claim("SM1")
+	if seen.Finished.IsZero() || seen.Results["microblog"].URL != "https://foo.micro.blog/1" {
+		t.Errorf("expected finished message with results, got %+v", seen)
+	}
+
+	store.Forget("SM1")
+	if _, isNew := store.Claim("SM1"); !isNew {
+		t.Errorf("expected a forgotten MessageSid to be new")
+	}
+}
+
+func TestDedupeStorePersists(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dedupe.json")
+	store, _ := OpenDedupeStore(filename, time.Hour)
+	store.Claim("SM1")
+	store.Finish("SM1", map[string]PublishResult{"microblog": {URL: "https://foo.micro.blog/1"}})
+
+	reopened, err := OpenDedupeStore(filename, time.Hour)
+	if err != nil {
+		t.Fatalf("error reopening dedupe store: %s", err)
+	}
+	seen, isNew := reopened.Claim("SM1")
+	if isNew {
+		t.Errorf("expected MessageSid to be remembered after reopening")
+	}
+	if seen.Results["microblog"].URL != "https://foo.micro.blog/1" {
+		t.Errorf("expected results to be remembered, got %+v", seen.Results)
+	}
+}
+
+func TestDedupeStoreExpiry(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dedupe.json")
+	store, _ := OpenDedupeStore(filename, time.Hour)
+	store.Claim("SM1")
+	store.seen["SM1"].Received = time.Now().Add(-2 * time.Hour)
+
+	if _, isNew := store.Claim("SM1"); !isNew {
+		t.Errorf("expected an expired MessageSid to be new again")
+	}
+
+	// expired entries are dropped from the file
+	store.seen["SM1"].Received = time.Now().Add(-2 * time.Hour)
+	store.Claim("SM2")
+	reopened, _ := OpenDedupeStore(filename, time.Hour)
+	if _, ok := reopened.seen["SM1"]; ok {
+		t.Errorf("expected expired MessageSid to be removed from the file")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// exifOrientationTag is the EXIF tag saying which way up a picture is
+const exifOrientationTag = 0x0112
+
+// jpegSegment is a marker segment from the start of a JPEG, from its 0xFF to
+// the end of its data
+type jpegSegment struct {
+	marker     byte
+	start, end int
+}
+
+// data returns the segment's contents, after its marker & length
+func (s jpegSegment) data(contents []byte) []byte {
+	return contents[s.start+4 : s.end]
+}
+
+// jpegSegments returns the JPEG's marker segments up to the image data, or
+// nil if it isn't a JPEG
+func jpegSegments(contents []byte) []jpegSegment {
+	if len(contents) < 4 || contents[0] != 0xFF || contents[1] != 0xD8 {
+		return nil
+	}
+	var segments []jpegSegment
+	for i := 2; i+4 <= len(contents) && contents[i] == 0xFF; {
+		marker := contents[i+1]
+		if marker == 0xFF { // padding
+			i++
+			continue
+		}
+		if marker == 0xD9 || marker == 0xDA { // the end, or the image data
+			break
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(contents[i+2:]))
+		if end > len(contents) || end < i+4 {
+			break
+		}
+		segments = append(segments, jpegSegment{marker: marker, start: i, end: end})
+		i = end
+	}
+	return segments
+}
+
+// jpegExif returns the TIFF structure in the JPEG's EXIF segment, or nil if
+// there isn't one
+func jpegExif(contents []byte) []byte {
+	for _, segment := range jpegSegments(contents) {
+		data := segment.data(contents)
+		if segment.marker == 0xE1 && bytes.HasPrefix(data, []byte("Exif\x00\x00")) {
+			return data[6:]
+		}
+	}
+	return nil
+}
+
+// tiffShort returns the value of a SHORT tag in the first IFD of a TIFF
+// structure, like EXIF's
+func tiffShort(tiff []byte, tag uint16) (uint16, bool) {
+	if len(tiff) < 8 {
+		return 0, false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 0, false
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, false
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == tag && order.Uint16(tiff[entry+2:]) == 3 { // 3 is SHORT
+			return order.Uint16(tiff[entry+8:]), true
+		}
+	}
+	return 0, false
+}
+
+// webpExif returns the TIFF structure in the WebP's EXIF chunk, or nil if
+// there isn't one
+func webpExif(contents []byte) []byte {
+	if len(contents) < 12 || string(contents[:4]) != "RIFF" || string(contents[8:12]) != "WEBP" {
+		return nil
+	}
+	for i := 12; i+8 <= len(contents); {
+		length := int(binary.LittleEndian.Uint32(contents[i+4:]))
+		if length < 0 || i+8+length > len(contents) {
+			return nil
+		}
+		if string(contents[i:i+4]) == "EXIF" {
+			// some encoders start it with "Exif\0\0", as in a JPEG
+			return bytes.TrimPrefix(contents[i+8:i+8+length], []byte("Exif\x00\x00"))
+		}
+		i += 8 + length + length%2 // chunks are padded to an even length
+	}
+	return nil
+}
+
+// exifOrientation returns the orientation in the EXIF's TIFF structure, from
+// 1 (upright) to 8, or 1 if it doesn't say
+func exifOrientation(tiff []byte) int {
+	orientation, ok := tiffShort(tiff, exifOrientationTag)
+	if !ok || orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return int(orientation)
+}
+
+// jpegOrientation returns the JPEG's EXIF orientation, from 1 (upright) to 8,
+// or 1 if it doesn't say
+func jpegOrientation(contents []byte) int {
+	return exifOrientation(jpegExif(contents))
+}
+
+// webpOrientation returns the WebP's EXIF orientation, like jpegOrientation
+func webpOrientation(contents []byte) int {
+	return exifOrientation(webpExif(contents))
+}
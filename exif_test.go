@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestJPEGOrientation(t *testing.T) {
+	rotated := mustReadFile(t, "fixtures/images/rotated.jpg")
+	// the same, with the orientation in little-endian EXIF
+	little := append([]byte{}, rotated...)
+	exif := jpegExif(little)
+	copy(exif, "II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00\x03\x00")
+
+	var tests = []struct {
+		name     string
+		contents []byte
+		expected int
+	}{
+		{name: "big-endian", contents: rotated, expected: 6},
+		{name: "little-endian", contents: little, expected: 3},
+		{name: "no EXIF", contents: mustReadFile(t, "fixtures/images/picture.bmp"), expected: 1},
+		{name: "truncated", contents: rotated[:30], expected: 1},
+		{name: "empty", contents: nil, expected: 1},
+	}
+	for _, test := range tests {
+		if actual := jpegOrientation(test.contents); actual != test.expected {
+			t.Errorf("expected the %s orientation %d, got %d", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestWebPOrientation(t *testing.T) {
+	rotated := mustReadFile(t, "fixtures/images/gps-rotated.webp")
+	var tests = []struct {
+		name     string
+		contents []byte
+		expected int
+	}{
+		{name: "rotated", contents: rotated, expected: 6},
+		{name: "upright", contents: mustReadFile(t, "fixtures/images/gps.webp"), expected: 1},
+		{name: "no EXIF", contents: mustReadFile(t, "fixtures/images/picture.webp"), expected: 1},
+		{name: "truncated", contents: rotated[:bytes.Index(rotated, []byte("EXIF"))+20], expected: 1},
+		{name: "a JPEG", contents: mustReadFile(t, "fixtures/images/rotated.jpg"), expected: 1},
+	}
+	for _, test := range tests {
+		if actual := webpOrientation(test.contents); actual != test.expected {
+			t.Errorf("expected the %s orientation %d, got %d", test.name, test.expected, actual)
+		}
+	}
+}
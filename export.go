@@ -0,0 +1,268 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportedMessage is how an archived message is exported, as a line of JSON
+type exportedMessage struct {
+	ID         int64            `json:"id"`
+	MessageSid string           `json:"messageSid,omitempty"`
+	Phone      string           `json:"phone,omitempty"`
+	Sender     string           `json:"sender"`
+	Text       string           `json:"text"`
+	Received   time.Time        `json:"received"`
+	Processed  *time.Time       `json:"processed,omitempty"`
+	Results    []exportedResult `json:"results"`
+	Images     []exportedImage  `json:"images"`
+}
+
+type exportedResult struct {
+	Destination string   `json:"destination"`
+	URL         string   `json:"url,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	Media       []string `json:"media,omitempty"`
+}
+
+type exportedImage struct {
+	Position  int    `json:"position"`
+	TwilioURL string `json:"twilioURL,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	File      string `json:"file,omitempty"` // its path in a bundle, if it was kept
+}
+
+// exportImageName is the stable path of an archived image in a bundle, e.g.
+// images/2023-11-27-SM0123-1.jpg: the same however often it's exported.
+// Images that weren't kept have none.
+func exportImageName(message ArchivedMessage, image ArchivedImage) string {
+	if image.Filename == "" {
+		return ""
+	}
+	key := message.MessageSid
+	if key == "" {
+		key = strconv.FormatInt(message.ID, 10)
+	}
+	ext := strings.ToLower(filepath.Ext(image.Filename))
+	return path.Join("images", fmt.Sprintf("%s-%s-%d%s", message.Received.UTC().Format("2006-01-02"), key, image.Position, ext))
+}
+
+func exportMessage(message ArchivedMessage) exportedMessage {
+	exported := exportedMessage{
+		ID:         message.ID,
+		MessageSid: message.MessageSid,
+		Phone:      message.Phone,
+		Sender:     message.Sender,
+		Text:       message.Text,
+		Received:   message.Received,
+		Results:    []exportedResult{},
+		Images:     []exportedImage{},
+	}
+	if !message.Processed.IsZero() {
+		exported.Processed = &message.Processed
+	}
+	for _, result := range message.Results {
+		exported.Results = append(exported.Results, exportedResult(result))
+	}
+	for _, image := range message.Images {
+		exported.Images = append(exported.Images, exportedImage{
+			Position:  image.Position,
+			TwilioURL: image.TwilioURL,
+			SHA256:    image.SHA256,
+			File:      exportImageName(message, image),
+		})
+	}
+	return exported
+}
+
+// ExportJSONLines writes the messages matching the query as JSON Lines: one
+// JSON object per message, oldest first
+func (a *Archive) ExportJSONLines(w io.Writer, query MessageQuery) error {
+	encoder := json.NewEncoder(w)
+	return a.EachMessage(query, func(message ArchivedMessage) error {
+		return encoder.Encode(exportMessage(message))
+	})
+}
+
+// ExportCSV writes the messages matching the query as CSV, oldest first,
+// with a URL & error column for each destination & the images' bundle paths
+// separated by spaces
+func (a *Archive) ExportCSV(w io.Writer, query MessageQuery) error {
+	destinations, err := a.Destinations()
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(w)
+	header := []string{"id", "message_sid", "received", "processed", "phone", "sender", "text", "images"}
+	for _, destination := range destinations {
+		header = append(header, destination+" url", destination+" error")
+	}
+	if err = writer.Write(header); err != nil {
+		return err
+	}
+
+	err = a.EachMessage(query, func(message ArchivedMessage) error {
+		var processed string
+		if !message.Processed.IsZero() {
+			processed = message.Processed.Format(time.RFC3339)
+		}
+		var images []string
+		for _, image := range message.Images {
+			if name := exportImageName(message, image); name != "" {
+				images = append(images, name)
+			}
+		}
+		record := []string{
+			strconv.FormatInt(message.ID, 10), message.MessageSid, message.Received.Format(time.RFC3339), processed,
+			message.Phone, message.Sender, message.Text, strings.Join(images, " "),
+		}
+		results := make(map[string]ArchivedResult)
+		for _, result := range message.Results {
+			results[result.Destination] = result
+		}
+		for _, destination := range destinations {
+			record = append(record, results[destination].URL, results[destination].Error)
+		}
+		return writer.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// ExportBundle writes a zip file of the messages matching the query: them as
+// messages.jsonl & messages.csv, & every image the archive kept, under
+// images/ with the names the messages give them
+func (a *Archive) ExportBundle(w io.Writer, query MessageQuery) error {
+	bundle := zip.NewWriter(w)
+	modified := time.Now()
+	create := func(name string, method uint16) (io.Writer, error) {
+		return bundle.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: modified})
+	}
+
+	file, err := create("messages.jsonl", zip.Deflate)
+	if err == nil {
+		err = a.ExportJSONLines(file, query)
+	}
+	if err == nil {
+		file, err = create("messages.csv", zip.Deflate)
+	}
+	if err == nil {
+		err = a.ExportCSV(file, query)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = a.EachMessage(query, func(message ArchivedMessage) error {
+		for _, image := range message.Images {
+			name := exportImageName(message, image)
+			if name == "" || a.imageDir == "" {
+				continue
+			}
+			stored, err := os.Open(filepath.Join(a.imageDir, image.Filename))
+			if err != nil {
+				log.Printf("error exporting image %d of message %d: %s", image.Position, message.ID, err)
+				continue
+			}
+			file, err := create(name, zip.Store) // already compressed
+			if err == nil {
+				_, err = io.Copy(file, stored)
+			}
+			stored.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return bundle.Close()
+}
+
+// exportCommand implements `txt2mary export`, writing the export to stdout
+// (unless it's to a file) & anything else to stderr, so it can't end up in it
+func exportCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "jsonl", "jsonl, csv, or zip (a bundle of both with the images)")
+	output := flags.String("output", "-", "the file to write, or - for standard output")
+	since := flags.String("since", "", "only messages received on or after this date, e.g. 2023-11-27")
+	until := flags.String("until", "", "only messages received on or before this date")
+	sender := flags.String("sender", "", "only messages from this user")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: txt2mary export [--format jsonl|csv|zip] [--output file] [--since date] [--until date] [--sender name]\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	archiveExport := map[string]func(*Archive, io.Writer, MessageQuery) error{
+		"jsonl": (*Archive).ExportJSONLines,
+		"csv":   (*Archive).ExportCSV,
+		"zip":   (*Archive).ExportBundle,
+	}[*format]
+	if archiveExport == nil {
+		fmt.Fprintf(stderr, "unknown format %q; it can be jsonl, csv, or zip\n", *format)
+		return 2
+	}
+	start, end, err := parseDateRange(*since, *until)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return 2
+	}
+
+	commandArchive, err := openArchive(config)
+	if err == nil && commandArchive == nil {
+		err = fmt.Errorf("there's no archive to export (ArchiveFile is %q)", config.ArchiveFile)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return 1
+	}
+	defer commandArchive.Close()
+
+	w, file := stdout, (*os.File)(nil)
+	if *output != "-" {
+		if file, err = os.Create(*output); err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+			return 1
+		}
+		w = file
+	}
+	err = archiveExport(commandArchive, w, MessageQuery{Sender: *sender, Since: start, Until: end})
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Printf("error exporting the archive: %s", err)
+		fmt.Fprintf(stderr, "error exporting the archive: %s\n", err)
+		if *output != "-" {
+			os.Remove(*output)
+		}
+		return 1
+	}
+	return 0
+}
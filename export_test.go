@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupExportTest archives a message from Gon with 2 pictures, & one from
+// Killua without
+func setupExportTest(t *testing.T, archive *Archive) {
+	received := time.Date(2023, 11, 27, 14, 0, 0, 0, time.UTC)
+	messages := []Message{
+		{MessageSid: "SM1", Phone: "+15125551212", From: "Gon", Text: "just a couple bros", Received: received,
+			TwilioImageURLs: []string{"https://api.twilio.com/1", "https://api.twilio.com/2"},
+			ImageFilenames:  writeTestImages(t, 10, 20),
+			Results:         map[string]PublishResult{"microblog": {URL: "https://foo.micro.blog/1"}}},
+		{From: "Killua", Text: "fishing, \"again\"\nat the lake", Received: received.AddDate(0, 0, 1),
+			Results: map[string]PublishResult{"twitter": {Err: errors.New("boom")}}},
+	}
+	for _, message := range messages {
+		if _, err := archive.Record(&message); err != nil {
+			t.Fatalf("error archiving: %s", err)
+		}
+	}
+}
+
+func TestExportJSONLines(t *testing.T) {
+	archive := openTestArchive(t, t.TempDir())
+	setupExportTest(t, archive)
+
+	var output bytes.Buffer
+	if err := archive.ExportJSONLines(&output, MessageQuery{}); err != nil {
+		t.Fatalf("expected no error, got %q", err)
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a line per message, got %q", output.String())
+	}
+	var gon, killua exportedMessage
+	_ = json.Unmarshal([]byte(lines[0]), &gon)
+	_ = json.Unmarshal([]byte(lines[1]), &killua)
+	if gon.Sender != "Gon" || gon.Phone != "+15125551212" || !gon.Received.Equal(time.Date(2023, 11, 27, 14, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected first message %+v", gon)
+	}
+	if len(gon.Images) != 2 || gon.Images[0].File != "images/2023-11-27-SM1-1.jpg" || gon.Images[1].TwilioURL != "https://api.twilio.com/2" {
+		t.Errorf("unexpected images %+v", gon.Images)
+	}
+	if killua.Text != "fishing, \"again\"\nat the lake" || len(killua.Results) != 1 || killua.Results[0].Error != "boom" {
+		t.Errorf("unexpected second message %+v", killua)
+	}
+
+	// filtered
+	output.Reset()
+	_ = archive.ExportJSONLines(&output, MessageQuery{Sender: "Killua"})
+	if strings.Count(output.String(), "\n") != 1 || !strings.Contains(output.String(), "Killua") {
+		t.Errorf("expected only Killua's message, got %q", output.String())
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	archive := openTestArchive(t, t.TempDir())
+	setupExportTest(t, archive)
+
+	var output bytes.Buffer
+	if err := archive.ExportCSV(&output, MessageQuery{}); err != nil {
+		t.Fatalf("expected no error, got %q", err)
+	}
+	records, err := csv.NewReader(&output).ReadAll()
+	if err != nil || len(records) != 3 {
+		t.Fatalf("expected a header & 2 records, got %q (%v)", records, err)
+	}
+	header := strings.Join(records[0], ",")
+	if !strings.HasPrefix(header, "id,message_sid,received,processed,phone,sender,text,images,") ||
+		!strings.Contains(header, "microblog url,microblog error") || !strings.Contains(header, "twitter url,twitter error") {
+		t.Errorf("unexpected header %q", header)
+	}
+	if records[1][7] != "images/2023-11-27-SM1-1.jpg images/2023-11-27-SM1-2.jpg" {
+		t.Errorf("unexpected images %q", records[1][7])
+	}
+	if records[2][6] != "fishing, \"again\"\nat the lake" || !strings.Contains(strings.Join(records[2], ","), "boom") {
+		t.Errorf("unexpected second record %q", records[2])
+	}
+}
+
+func TestExportBundle(t *testing.T) {
+	imageDir := t.TempDir()
+	archive := openTestArchive(t, imageDir)
+	setupExportTest(t, archive)
+
+	bundle := filepath.Join(t.TempDir(), "export.zip")
+	file, _ := os.Create(bundle)
+	err := archive.ExportBundle(file, MessageQuery{})
+	file.Close()
+	if err != nil {
+		t.Fatalf("expected no error, got %q", err)
+	}
+
+	reader, err := zip.OpenReader(bundle)
+	if err != nil {
+		t.Fatalf("expected a zip file: %s", err)
+	}
+	defer reader.Close()
+	var names []string
+	for _, file := range reader.File {
+		names = append(names, file.Name)
+	}
+	expected := "messages.jsonl,messages.csv,images/2023-11-27-SM1-1.jpg,images/2023-11-27-SM1-2.jpg"
+	if strings.Join(names, ",") != expected {
+		t.Fatalf("expected %s in the bundle, got %s", expected, strings.Join(names, ","))
+	}
+
+	image, _ := reader.File[2].Open()
+	contents, _ := io.ReadAll(image)
+	image.Close()
+	original, _ := os.ReadFile(storedImage(t, archive, "SM1", 1))
+	if !bytes.Equal(contents, original) {
+		t.Errorf("expected the stored image in the bundle")
+	}
+}
+
+// storedImage returns where the archive stored the message's image
+func storedImage(t *testing.T, a *Archive, sid string, position int) string {
+	var stored string
+	err := a.db.QueryRow(`SELECT filename FROM images JOIN messages ON messages.id = images.message_id
+		WHERE message_sid = ? AND position = ?`, sid, position).Scan(&stored)
+	if err != nil {
+		t.Fatalf("error finding image: %s", err)
+	}
+	return filepath.Join(a.imageDir, stored)
+}
+
+func TestExportCommand(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "archive.db")
+	imageDir := t.TempDir()
+	archive, err := OpenArchive(filename, imageDir)
+	if err != nil {
+		t.Fatalf("error opening archive: %s", err)
+	}
+	setupExportTest(t, archive)
+	archive.Close()
+	config = Config{ArchiveFile: filename, ArchiveImageDir: imageDir}
+	defer func() { config = Config{} }()
+
+	var stdout, stderr bytes.Buffer
+	if code := exportCommand([]string{"--since", "2023-11-28"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected success, got %d: %s", code, stderr.String())
+	}
+	if strings.Count(stdout.String(), "\n") != 1 || !strings.Contains(stdout.String(), `"sender":"Killua"`) {
+		t.Errorf("expected Killua's message as JSON, got %q", stdout.String())
+	}
+
+	output := filepath.Join(t.TempDir(), "export.csv")
+	stdout.Reset()
+	if code := exportCommand([]string{"--format", "csv", "--output", output}, &stdout, &stderr); code != 0 || stdout.Len() != 0 {
+		t.Fatalf("expected success, got %d: %s", code, stderr.String())
+	}
+	if contents, _ := os.ReadFile(output); !strings.HasPrefix(string(contents), "id,message_sid,") {
+		t.Errorf("expected CSV written to %s, got %q", output, contents)
+	}
+
+	// problems go to stderr, never mixed in with the export
+	for _, args := range [][]string{{"--format", "xml"}, {"--until", "tomorrow"}, {"extra"}} {
+		stdout.Reset()
+		stderr.Reset()
+		if code := exportCommand(args, &stdout, &stderr); code != 2 {
+			t.Errorf("expected %q to be a usage error, got %d", args, code)
+		}
+		if stdout.Len() != 0 || stderr.Len() == 0 {
+			t.Errorf("expected %q's problem on stderr, got %q on stdout", args, stdout.String())
+		}
+	}
+	stderr.Reset()
+	missing := filepath.Join(t.TempDir(), "missing", "export.csv")
+	if code := exportCommand([]string{"--output", missing}, &stdout, &stderr); code != 1 || stdout.Len() != 0 || !strings.Contains(stderr.String(), missing) {
+		t.Errorf("expected the error on stderr, got %d %q %q", code, stdout.String(), stderr.String())
+	}
+}
+
+func TestArchiveEachMessageBatches(t *testing.T) {
+	archive := openTestArchive(t, "")
+	for i := 0; i < eachMessageBatch*2+1; i++ {
+		message := Message{From: "Gon", Text: "hi", Received: time.Unix(int64(i), 0)}
+		_, _ = archive.Record(&message)
+	}
+
+	var count int
+	var lastID int64
+	err := archive.EachMessage(MessageQuery{}, func(message ArchivedMessage) error {
+		if message.ID <= lastID {
+			t.Errorf("expected messages in order, got %d after %d", message.ID, lastID)
+		}
+		count, lastID = count+1, message.ID
+		return nil
+	})
+	if err != nil || count != eachMessageBatch*2+1 {
+		t.Errorf("expected every message, got %d (%v)", count, err)
+	}
+
+	stop := errors.New("stop")
+	if err = archive.EachMessage(MessageQuery{}, func(ArchivedMessage) error { return stop }); err != stop {
+		t.Errorf("expected the callback's error returned, got %v", err)
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var defaultFeedPaths = map[string]string{"rss": "/feed.rss", "atom": "/feed.atom", "json": "/feed.json"}
+
+const (
+	defaultFeedItems = 20
+	feedImageRoute   = "/feed-images/"
+)
+
+var feedContentTypes = map[string]string{
+	"rss":  "application/rss+xml; charset=utf-8",
+	"atom": "application/atom+xml; charset=utf-8",
+	"json": "application/feed+json; charset=utf-8",
+}
+
+// Published returns the most recent messages that were posted somewhere,
+// newest first, leaving out test messages
+func (a *Archive) Published(limit int) ([]ArchivedMessage, error) {
+	rows, err := a.db.Query(`SELECT id, coalesce(message_sid, ''), phone, sender, text, received_at, coalesce(processed_at, '')
+		FROM messages
+		WHERE substr(text, 1, 6) != 'TEST: '
+			AND EXISTS (SELECT 1 FROM results WHERE message_id = messages.id AND url != '' AND error = '')
+		ORDER BY received_at DESC, id DESC
+		LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	return messages, a.loadDetails(messages)
+}
+
+// isPublishedImage reports whether the stored image is one of a published
+// message's, so it can be shown to anyone
+func (a *Archive) isPublishedImage(stored string) (bool, error) {
+	var count int
+	err := a.db.QueryRow(`SELECT count(*) FROM images JOIN messages ON messages.id = images.message_id
+		WHERE images.filename = ? AND substr(messages.text, 1, 6) != 'TEST: '
+			AND EXISTS (SELECT 1 FROM results WHERE message_id = messages.id AND url != '' AND error = '')`,
+		filepath.FromSlash(stored)).Scan(&count)
+	return count > 0, err
+}
+
+// feedItem is a message as it's shown in every kind of feed
+type feedItem struct {
+	ID        string
+	URL       string
+	Title     string
+	Author    string
+	Text      string // as posted, e.g. "> text\n\n– Gon"
+	HTML      string
+	Published time.Time
+	Updated   time.Time
+	Images    []feedImage
+}
+
+type feedImage struct {
+	URL    string
+	Type   string
+	Length int64
+}
+
+// feedHTML renders the formatted post (by default, a Markdown quote &
+// attribution) as HTML, followed by the images, & links to any other files
+func feedHTML(content string, images []feedImage) string {
+	var rendered strings.Builder
+	for _, paragraph := range strings.Split(content, "\n\n") {
+		quote := strings.HasPrefix(paragraph, ">")
+		paragraph = strings.TrimSpace(strings.TrimPrefix(paragraph, ">"))
+		paragraph = strings.ReplaceAll(html.EscapeString(html.UnescapeString(paragraph)), "\n", "<br>\n")
+		if quote {
+			fmt.Fprintf(&rendered, "<blockquote><p>%s</p></blockquote>\n", paragraph)
+		} else {
+			fmt.Fprintf(&rendered, "<p>%s</p>\n", paragraph)
+		}
+	}
+	for _, image := range images {
+		if !webImageTypes[baseMediaType(image.Type)] {
+			fmt.Fprintf(&rendered, "<p><a href=\"%s\">%s</a></p>\n", html.EscapeString(image.URL), html.EscapeString(path.Base(image.URL)))
+			continue
+		}
+		fmt.Fprintf(&rendered, "<p><img src=\"%s\" alt=\"\"></p>\n", html.EscapeString(image.URL))
+	}
+	return rendered.String()
+}
+
+// feedItems turns archived messages into feed items, formatted with the
+// template, linking each to where it was first posted, & its images to where
+// the server shows them
+func feedItems(config FeedConfig, postTemplate *PostTemplate, archive *Archive, messages []ArchivedMessage) []feedItem {
+	base := strings.TrimSuffix(config.URL, "/")
+	host := base
+	if parsed, err := url.Parse(base); err == nil && parsed.Host != "" {
+		host = parsed.Hostname()
+	}
+
+	var items []feedItem
+	for _, archived := range messages {
+		message := Message{From: archived.Sender, Text: archived.Text, Received: archived.Received}
+		content, err := postTemplate.Format(&message)
+		if err != nil {
+			log.Printf("error formatting message %d for the feeds: %s", archived.ID, err)
+			continue
+		}
+		key := archived.MessageSid
+		if key == "" {
+			key = fmt.Sprintf("%d", archived.ID)
+		}
+		item := feedItem{
+			ID:        fmt.Sprintf("tag:%s,%s:%s", host, archived.Received.Format("2006-01-02"), key),
+			URL:       base + "/",
+			Title:     postTitle(archived.Text),
+			Author:    archived.Sender,
+			Text:      html.UnescapeString(content),
+			Published: archived.Received,
+			Updated:   archived.Processed,
+		}
+		if item.Title == "" {
+			item.Title = "from " + archived.Sender
+		}
+		if item.Updated.IsZero() {
+			item.Updated = item.Published
+		}
+		for _, result := range archived.Results {
+			if result.URL != "" && result.Error == "" {
+				item.URL = result.URL
+				break
+			}
+		}
+		for _, image := range archived.Images {
+			if image.Filename == "" || archive.imageDir == "" {
+				continue
+			}
+			info, err := os.Stat(filepath.Join(archive.imageDir, image.Filename))
+			if err != nil {
+				continue
+			}
+			item.Images = append(item.Images, feedImage{
+				URL:    base + feedImageRoute + filepath.ToSlash(image.Filename),
+				Type:   mime.TypeByExtension(path.Ext(image.Filename)),
+				Length: info.Size(),
+			})
+		}
+		item.HTML = feedHTML(content, item.Images)
+		items = append(items, item)
+	}
+	return items
+}
+
+type rssFeed struct {
+	XMLName xml.Name `xml:"rss"`
+	Version string   `xml:"version,attr"`
+	DC      string   `xml:"xmlns:dc,attr"`
+	Channel struct {
+		Title         string    `xml:"title"`
+		Link          string    `xml:"link"`
+		Description   string    `xml:"description"`
+		LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+		Items         []rssItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+type rssItem struct {
+	Title string `xml:"title"`
+	Link  string `xml:"link"`
+	GUID  struct {
+		IsPermaLink bool   `xml:"isPermaLink,attr"`
+		ID          string `xml:",chardata"`
+	} `xml:"guid"`
+	PubDate     string         `xml:"pubDate"`
+	Creator     string         `xml:"dc:creator"`
+	Description string         `xml:"description"`
+	Enclosures  []rssEnclosure `xml:"enclosure"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Length int64  `xml:"length,attr"`
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Links    []atomLink  `xml:"link"`
+	Updated  string      `xml:"updated"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Links     []atomLink `xml:"link"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Author    struct {
+		Name string `xml:"name"`
+	} `xml:"author"`
+	Content struct {
+		Type string `xml:"type,attr"`
+		Body string `xml:",chardata"`
+	} `xml:"content"`
+}
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Description string         `json:"description,omitempty"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string               `json:"id"`
+	URL           string               `json:"url"`
+	Title         string               `json:"title"`
+	ContentHTML   string               `json:"content_html"`
+	ContentText   string               `json:"content_text"`
+	DatePublished time.Time            `json:"date_published"`
+	DateModified  time.Time            `json:"date_modified"`
+	Authors       []jsonFeedAuthor     `json:"authors"`
+	Attachments   []jsonFeedAttachment `json:"attachments,omitempty"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedAttachment struct {
+	URL      string `json:"url"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size_in_bytes"`
+}
+
+// renderFeed renders the items as a feed of the given format, served at
+// feedPath
+func renderFeed(config FeedConfig, format string, feedPath string, items []feedItem, updated time.Time) ([]byte, error) {
+	base := strings.TrimSuffix(config.URL, "/")
+	switch format {
+	case "rss":
+		feed := rssFeed{Version: "2.0", DC: "http://purl.org/dc/elements/1.1/"}
+		feed.Channel.Title, feed.Channel.Link, feed.Channel.Description = config.title(), base+"/", config.Description
+		if !updated.IsZero() {
+			feed.Channel.LastBuildDate = updated.Format(time.RFC1123Z)
+		}
+		for _, item := range items {
+			rss := rssItem{Title: item.Title, Link: item.URL, PubDate: item.Published.Format(time.RFC1123Z), Creator: item.Author, Description: item.HTML}
+			rss.GUID.ID = item.ID
+			for _, image := range item.Images {
+				rss.Enclosures = append(rss.Enclosures, rssEnclosure{URL: image.URL, Type: image.Type, Length: image.Length})
+			}
+			feed.Channel.Items = append(feed.Channel.Items, rss)
+		}
+		output, err := xml.MarshalIndent(feed, "", "  ")
+		return append([]byte(xml.Header), output...), err
+
+	case "atom":
+		feed := atomFeed{
+			Title:    config.title(),
+			Subtitle: config.Description,
+			ID:       base + feedPath,
+			Links:    []atomLink{{Href: base + "/"}, {Rel: "self", Href: base + feedPath}},
+			Updated:  updated.UTC().Format(time.RFC3339),
+		}
+		for _, item := range items {
+			entry := atomEntry{
+				Title:     item.Title,
+				ID:        item.ID,
+				Links:     []atomLink{{Rel: "alternate", Href: item.URL}},
+				Published: item.Published.UTC().Format(time.RFC3339),
+				Updated:   item.Updated.UTC().Format(time.RFC3339),
+			}
+			entry.Author.Name = item.Author
+			entry.Content.Type, entry.Content.Body = "html", item.HTML
+			for _, image := range item.Images {
+				entry.Links = append(entry.Links, atomLink{Rel: "enclosure", Href: image.URL, Type: image.Type, Length: image.Length})
+			}
+			feed.Entries = append(feed.Entries, entry)
+		}
+		output, err := xml.MarshalIndent(feed, "", "  ")
+		return append([]byte(xml.Header), output...), err
+
+	case "json":
+		feed := jsonFeed{
+			Version:     "https://jsonfeed.org/version/1.1",
+			Title:       config.title(),
+			HomePageURL: base + "/",
+			FeedURL:     base + feedPath,
+			Description: config.Description,
+			Items:       []jsonFeedItem{},
+		}
+		for _, item := range items {
+			jsonItem := jsonFeedItem{
+				ID:            item.ID,
+				URL:           item.URL,
+				Title:         item.Title,
+				ContentHTML:   item.HTML,
+				ContentText:   item.Text,
+				DatePublished: item.Published,
+				DateModified:  item.Updated,
+				Authors:       []jsonFeedAuthor{{Name: item.Author}},
+			}
+			for _, image := range item.Images {
+				jsonItem.Attachments = append(jsonItem.Attachments, jsonFeedAttachment{URL: image.URL, MimeType: image.Type, Size: image.Length})
+			}
+			feed.Items = append(feed.Items, jsonItem)
+		}
+		return json.MarshalIndent(feed, "", "  ")
+	}
+	return nil, fmt.Errorf("unknown feed format %q", format)
+}
+
+// feedHandler serves the feed of the given format, answering conditional
+// requests (with If-None-Match or If-Modified-Since) with 304 Not Modified
+// when nothing's been posted since
+func feedHandler(config FeedConfig, postTemplate *PostTemplate, archive *Archive, format string, feedPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		messages, err := archive.Published(config.items())
+		if err != nil {
+			log.Printf("error reading the archive for the %s feed: %s", format, err)
+			http.Error(w, "error reading the archive", http.StatusInternalServerError)
+			return
+		}
+		items := feedItems(config, postTemplate, archive, messages)
+		var updated time.Time
+		for _, item := range items {
+			if item.Updated.After(updated) {
+				updated = item.Updated
+			}
+		}
+		body, err := renderFeed(config, format, feedPath, items, updated)
+		if err != nil {
+			log.Printf("error rendering the %s feed: %s", format, err)
+			http.Error(w, "error rendering the feed", http.StatusInternalServerError)
+			return
+		}
+
+		sum := sha256.Sum256(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		w.Header().Set("Content-Type", feedContentTypes[format])
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		http.ServeContent(w, r, "", updated, bytes.NewReader(body))
+	}
+}
+
+// feedImageHandler serves the published messages' images from the archive's
+// image store
+func feedImageHandler(archive *Archive) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stored := strings.TrimPrefix(r.URL.Path, feedImageRoute)
+		if archive.imageDir == "" || !storedImagePattern.MatchString(stored) {
+			http.NotFound(w, r)
+			return
+		}
+		published, err := archive.isPublishedImage(stored)
+		if err != nil || !published {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable") // named for its contents
+		http.ServeFile(w, r, filepath.Join(archive.imageDir, filepath.FromSlash(stored)))
+	}
+}
+
+// FeedHandlers returns the handlers for each feed that's configured, & for
+// their images, by path. Messages are formatted with the template.
+func FeedHandlers(config FeedConfig, postTemplate *PostTemplate, archive *Archive) map[string]http.Handler {
+	handlers := map[string]http.Handler{feedImageRoute: feedImageHandler(archive)}
+	for format, feedPath := range config.paths() {
+		handlers[feedPath] = feedHandler(config, postTemplate, archive, format, feedPath)
+	}
+	return handlers
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupFeedTest archives a posted message with a picture, one that failed
+// everywhere, & a posted test message, & returns the feeds' handlers
+func setupFeedTest(t *testing.T) (map[string]http.Handler, *Archive) {
+	archive := openTestArchive(t, t.TempDir())
+	received := time.Date(2023, 11, 27, 14, 0, 0, 0, time.UTC)
+	messages := []Message{
+		{MessageSid: "SM1", From: "Gon", Text: "just a couple <bros> & fish", Received: received,
+			ImageFilenames: writeTestImages(t, 10),
+			Results: map[string]PublishResult{
+				"twitter":   {Err: errors.New("boom")},
+				"microblog": {URL: "https://foo.micro.blog/1"},
+			}},
+		{MessageSid: "SM2", From: "Killua", Text: "didn't make it", Received: received.Add(time.Hour),
+			ImageFilenames: writeTestImages(t, 20),
+			Results:        map[string]PublishResult{"microblog": {Err: errors.New("boom")}}},
+		{MessageSid: "SM3", From: "Gon", Text: "TEST: hello", Received: received.Add(2 * time.Hour),
+			Results: map[string]PublishResult{"microblog": {URL: "https://foo-test.micro.blog/3"}}},
+	}
+	for _, message := range messages {
+		if _, err := archive.Record(&message); err != nil {
+			t.Fatalf("error archiving: %s", err)
+		}
+	}
+	config := FeedConfig{URL: "https://txt.example.com/", Title: "Mary", AtomPath: "/atom.xml", JSONPath: "-"}
+	return FeedHandlers(config, markdownPostTemplate, archive), archive
+}
+
+func getFeed(handler http.Handler, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestFeedPaths(t *testing.T) {
+	handlers, _ := setupFeedTest(t)
+	for _, path := range []string{"/feed.rss", "/atom.xml", feedImageRoute} {
+		if handlers[path] == nil {
+			t.Errorf("expected a handler for %s", path)
+		}
+	}
+	if len(handlers) != 3 {
+		t.Errorf("expected no JSON Feed, got %d handlers", len(handlers))
+	}
+}
+
+func TestRSSFeed(t *testing.T) {
+	handlers, _ := setupFeedTest(t)
+	w := getFeed(handlers["/feed.rss"], "/feed.rss", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/rss+xml; charset=utf-8" {
+		t.Fatalf("expected RSS, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	var feed rssFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("expected valid XML: %s", err)
+	}
+	if feed.Channel.Title != "Mary" || feed.Channel.Link != "https://txt.example.com/" || len(feed.Channel.Items) != 1 {
+		t.Fatalf("expected only the posted message, got %+v", feed.Channel)
+	}
+	item := feed.Channel.Items[0]
+	if item.Link != "https://foo.micro.blog/1" || item.GUID.ID != "tag:txt.example.com,2023-11-27:SM1" || item.PubDate != "Mon, 27 Nov 2023 14:00:00 +0000" {
+		t.Errorf("unexpected item %+v", item)
+	}
+	if !strings.Contains(w.Body.String(), "<dc:creator>Gon</dc:creator>") {
+		t.Errorf("expected the sender credited, got %s", w.Body.String())
+	}
+	if !strings.HasPrefix(item.Description, "<blockquote><p>just a couple &lt;bros&gt; &amp; fish</p></blockquote>\n<p>– Gon</p>\n<p><img src=\"https://txt.example.com/feed-images/") {
+		t.Errorf("unexpected description %q", item.Description)
+	}
+	if len(item.Enclosures) != 1 || item.Enclosures[0].Type != "image/jpeg" || item.Enclosures[0].Length == 0 ||
+		!strings.HasPrefix(item.Enclosures[0].URL, "https://txt.example.com/feed-images/") {
+		t.Errorf("expected the picture enclosed, got %+v", item.Enclosures)
+	}
+}
+
+func TestAtomAndJSONFeeds(t *testing.T) {
+	handlers, archive := setupFeedTest(t)
+	w := getFeed(handlers["/atom.xml"], "/atom.xml", nil)
+	var atom atomFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &atom); err != nil || len(atom.Entries) != 1 {
+		t.Fatalf("expected an Atom feed of 1 entry, got %s (%v)", w.Body.String(), err)
+	}
+	entry := atom.Entries[0]
+	if entry.Author.Name != "Gon" || entry.Content.Type != "html" || len(entry.Links) != 2 || entry.Links[1].Rel != "enclosure" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if atom.ID != "https://txt.example.com/atom.xml" || atom.Updated == "" {
+		t.Errorf("unexpected feed %+v", atom)
+	}
+
+	jsonHandler := FeedHandlers(FeedConfig{URL: "https://txt.example.com"}, markdownPostTemplate, archive)["/feed.json"]
+	w = getFeed(jsonHandler, "/feed.json", nil)
+	var feed jsonFeed
+	if err := json.Unmarshal(w.Body.Bytes(), &feed); err != nil || len(feed.Items) != 1 {
+		t.Fatalf("expected a JSON Feed of 1 item, got %s (%v)", w.Body.String(), err)
+	}
+	item := feed.Items[0]
+	if feed.Title != "txt2mary" || item.ContentText != "> just a couple <bros> & fish\n\n– Gon" || item.Authors[0].Name != "Gon" || len(item.Attachments) != 1 {
+		t.Errorf("unexpected item %+v", item)
+	}
+}
+
+func TestFeedConditionalGet(t *testing.T) {
+	handlers, archive := setupFeedTest(t)
+	w := getFeed(handlers["/feed.rss"], "/feed.rss", nil)
+	etag, modified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if etag == "" || modified == "" {
+		t.Fatalf("expected an ETag & Last-Modified, got %q %q", etag, modified)
+	}
+
+	if w = getFeed(handlers["/feed.rss"], "/feed.rss", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Errorf("expected the same ETag not modified, got %d", w.Code)
+	}
+	if w = getFeed(handlers["/feed.rss"], "/feed.rss", http.Header{"If-Modified-Since": {modified}}); w.Code != http.StatusNotModified {
+		t.Errorf("expected not modified since %s, got %d", modified, w.Code)
+	}
+
+	// once something else is posted, the feed's changed
+	message := Message{MessageSid: "SM4", From: "Killua", Text: "new", Received: time.Date(2023, 11, 28, 0, 0, 0, 0, time.UTC),
+		Results: map[string]PublishResult{"microblog": {URL: "https://foo.micro.blog/4"}}}
+	_, _ = archive.Record(&message)
+	if w = getFeed(handlers["/feed.rss"], "/feed.rss", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("expected the changed feed, got %d", w.Code)
+	}
+}
+
+func TestFeedImages(t *testing.T) {
+	handlers, archive := setupFeedTest(t)
+	var published, unpublished string
+	_ = archive.db.QueryRow(`SELECT filename FROM images JOIN messages ON messages.id = message_id WHERE message_sid = 'SM1'`).Scan(&published)
+	_ = archive.db.QueryRow(`SELECT filename FROM images JOIN messages ON messages.id = message_id WHERE message_sid = 'SM2'`).Scan(&unpublished)
+
+	if w := getFeed(handlers[feedImageRoute], feedImageRoute+published, nil); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("expected the published picture, got %d", w.Code)
+	}
+	for _, stored := range []string{unpublished, "../archive.db"} {
+		if w := getFeed(handlers[feedImageRoute], feedImageRoute+stored, nil); w.Code != http.StatusNotFound {
+			t.Errorf("expected %s not found, got %d", stored, w.Code)
+		}
+	}
+}
+
+func TestFeedConfigCheck(t *testing.T) {
+	c := Config{ServerRoute: "/txt", Feed: FeedConfig{URL: "txt.example.com", RSSPath: "/txt", AtomPath: "/feed.json"}}
+	problems, _ := CheckConfig(c)
+	expected := []string{
+		`Feed URL "txt.example.com" must be the server's public URL`,
+		`Feed rss path "/txt" must begin with "/"`,
+		`Feed json path "/feed.json" must begin with "/"`,
+	}
+	for _, problem := range expected {
+		if !strings.Contains(strings.Join(problems, "\n"), problem) {
+			t.Errorf("expected problem %q, got %q", problem, problems)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterPublisher("git", 60, func(config Config) Publisher {
+		if config.GitArchive.Dir == "" {
+			return nil
+		}
+		return &GitArchivePublisher{config: config.GitArchive, template: config.postTemplate("git", textPostTemplate)}
+	})
+}
+
+const defaultGitArchiveEmail = "txt2mary@localhost"
+
+// GitArchivePublisher commits each message to a local git repository, as
+// Markdown & JSON with its images alongside, for a permanent, versioned
+// history that doesn't depend on any social network. It runs the git command.
+type GitArchivePublisher struct {
+	config   GitArchiveConfig
+	mu       sync.Mutex // git allows one commit at a time
+	template *PostTemplate
+}
+
+// archivedMessage is the message.json saved in the archive
+type archivedMessage struct {
+	MessageSid string `json:",omitempty"`
+	From       string
+	Received   time.Time
+	Text       string
+	Images     []string `json:",omitempty"`
+}
+
+func (p *GitArchivePublisher) Name() string {
+	return "git"
+}
+
+// Enabled only archives test messages in a test archive (& real messages in
+// the real one), like Twitter
+func (p *GitArchivePublisher) Enabled(message *Message) bool {
+	return IsTestMessage(message) == p.config.TestArchive
+}
+
+// messageDir is the message's directory within the repository, e.g.
+// 2023/11/2023-11-27-just-a-couple-bros-abc123
+func (p *GitArchivePublisher) messageDir(message *Message) string {
+	received := message.ReceivedTime()
+	return filepath.Join(received.Format("2006"), received.Format("01"), postSlug(message))
+}
+
+// git runs a git command in the repository, returning its trimmed output
+func (p *GitArchivePublisher) git(ctx context.Context, env []string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = p.config.Dir
+	cmd.Env = append(os.Environ(), env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error running git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// initRepo creates the repository, if it isn't one already
+func (p *GitArchivePublisher) initRepo(ctx context.Context) error {
+	if _, err := os.Stat(filepath.Join(p.config.Dir, ".git")); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(p.config.Dir, 0755); err != nil {
+		return err
+	}
+	if _, err := p.git(ctx, nil, "init", "--quiet"); err != nil {
+		return err
+	}
+	log.Printf("created git archive %s", p.config.Dir)
+	return nil
+}
+
+// gitArchiveImageLimits is the pictures copied into the git archive, which
+// may be pushed somewhere public, so, as on a static site, they're web
+// pictures, converted & turned upright if need be
+var gitArchiveImageLimits = ImageLimits{Types: webImageTypes}
+
+// UploadMedia copies the Message's already-downloaded images into its
+// directory in the repository, returning their file names there. Pictures
+// browsers can't show are converted, & files of other types skipped.
+func (p *GitArchivePublisher) UploadMedia(ctx context.Context, message *Message) ([]string, error) {
+	files, remove := message.prepareMedia("the git archive", gitArchiveImageLimits)
+	defer remove()
+	if len(files) == 0 {
+		return nil, nil
+	}
+	dir := filepath.Join(p.config.Dir, p.messageDir(message))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for i, file := range files {
+		filename := file.Filename
+		name := fmt.Sprintf("%d%s", i+1, mediaExtension(file.Type))
+		if err := copyFile(filename, filepath.Join(dir, name)); err != nil {
+			log.Printf("error copying %q into the git archive: %s", filename, err)
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Publish writes the message as message.md & message.json, then commits it
+// (with the sender as the author) & pushes, if there's a Remote. It returns
+// the commit's URL, if a CommitURL is configured.
+func (p *GitArchivePublisher) Publish(ctx context.Context, message *Message, images []string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.initRepo(ctx); err != nil {
+		return "", err
+	}
+
+	body, err := p.template.or(textPostTemplate).Format(message)
+	if err != nil {
+		return "", Permanent(err)
+	}
+	messageDir := p.messageDir(message)
+	dir := filepath.Join(p.config.Dir, messageDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	archived, err := json.MarshalIndent(archivedMessage{
+		MessageSid: message.MessageSid,
+		From:       message.From,
+		Received:   message.ReceivedTime(),
+		Text:       message.Text,
+		Images:     images,
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	files := map[string][]byte{
+		"message.md":   markdownPost(message, body, images),
+		"message.json": append(archived, '\n'),
+	}
+	for name, contents := range files {
+		if err = writeFileAtomic(filepath.Join(dir, name), contents); err != nil {
+			return "", err
+		}
+		_ = os.Chmod(filepath.Join(dir, name), 0644)
+	}
+
+	if _, err = p.git(ctx, nil, "add", "--", messageDir); err != nil {
+		return "", err
+	}
+	// a replayed message may have nothing new to commit, but might still need
+	// pushing
+	changes, err := p.git(ctx, nil, "status", "--porcelain", "--", messageDir)
+	if err != nil {
+		return "", err
+	}
+	if changes != "" {
+		if err = p.commit(ctx, message, messageDir); err != nil {
+			return "", err
+		}
+	}
+
+	if p.config.Remote != "" {
+		if _, err = p.git(ctx, nil, "push", "--quiet", p.config.Remote, "HEAD"); err != nil {
+			log.Printf("error pushing the git archive: %s", err)
+			return "", err
+		}
+	}
+
+	commit, err := p.git(ctx, nil, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	log.Printf("committed message to the git archive as %s\n", commit)
+	if p.config.CommitURL == "" {
+		return "", nil
+	}
+	return strings.ReplaceAll(p.config.CommitURL, "{commit}", commit), nil
+}
+
+// commit commits the message's directory, authored by the sender when the
+// message was received
+func (p *GitArchivePublisher) commit(ctx context.Context, message *Message, messageDir string) error {
+	email := p.config.Email
+	if email == "" {
+		email = defaultGitArchiveEmail
+	}
+	date := message.ReceivedTime().Format(time.RFC3339)
+	env := []string{
+		"GIT_AUTHOR_NAME=" + message.From,
+		"GIT_AUTHOR_EMAIL=" + email,
+		"GIT_AUTHOR_DATE=" + date,
+		"GIT_COMMITTER_NAME=txt2mary",
+		"GIT_COMMITTER_EMAIL=" + email,
+	}
+	subject := fmt.Sprintf("%s: %s", message.From, postTitle(message.Text))
+	_, err := p.git(ctx, env, "commit", "--quiet", "--no-verify", "-m", subject, "--", messageDir)
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func gitOutput(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %s: %s", args[0], err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func TestGitArchivePublisher(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	gitOutput(t, t.TempDir(), "init", "--quiet", "--bare", remote)
+
+	dir := filepath.Join(t.TempDir(), "archive")
+	publisher := &GitArchivePublisher{config: GitArchiveConfig{
+		Dir:       dir,
+		Remote:    remote,
+		CommitURL: "https://git.example.com/mary/commit/{commit}",
+	}}
+	message := Message{
+		MessageSid:     "SM0123456789ABCDEF",
+		From:           "Gon",
+		Text:           "just a couple bros",
+		Received:       time.Date(2023, 11, 27, 14, 32, 5, 0, time.UTC),
+		ImageFilenames: writeTestImages(t, 10),
+	}
+
+	result := publish(context.Background(), publisher, &message, defaultPublishTimeout)
+	if result.Err != nil {
+		t.Fatalf("expected no error, got %q", result.Err)
+	}
+	head := gitOutput(t, dir, "rev-parse", "HEAD")
+	if result.URL != "https://git.example.com/mary/commit/"+head {
+		t.Errorf("unexpected commit URL %q", result.URL)
+	}
+
+	messageDir := filepath.Join("2023", "11", "2023-11-27-just-a-couple-bros-abcdef")
+	for _, name := range []string{"message.md", "message.json", "1.jpg"} {
+		if _, err := os.Stat(filepath.Join(dir, messageDir, name)); err != nil {
+			t.Errorf("expected %s in the archive: %s", name, err)
+		}
+	}
+	markdown, _ := os.ReadFile(filepath.Join(dir, messageDir, "message.md"))
+	if !strings.Contains(string(markdown), "![picture 1 of 1 texted by Gon](1.jpg)") {
+		t.Errorf("expected the image linked relative to the post, got %s", markdown)
+	}
+
+	commit := gitOutput(t, dir, "log", "-1", "--format=%an|%ae|%aI|%s")
+	if commit != "Gon|txt2mary@localhost|2023-11-27T14:32:05+00:00|Gon: just a couple bros" {
+		t.Errorf("unexpected commit %q", commit)
+	}
+	if pushed := gitOutput(t, remote, "rev-parse", "HEAD"); pushed != head {
+		t.Errorf("expected the commit pushed, got %s", pushed)
+	}
+
+	// archiving the same message again doesn't make another commit
+	if result = publish(context.Background(), publisher, &message, defaultPublishTimeout); result.Err != nil {
+		t.Fatalf("expected no error, got %q", result.Err)
+	}
+	if count := gitOutput(t, dir, "rev-list", "--count", "HEAD"); count != "1" {
+		t.Errorf("expected 1 commit, got %s", count)
+	}
+}
+
+// a message with no Received time has its pictures & post in the same place
+func TestGitArchiveNoReceivedTime(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	dir := filepath.Join(t.TempDir(), "archive")
+	publisher := &GitArchivePublisher{config: GitArchiveConfig{Dir: dir}}
+	message := Message{From: "Gon", Text: "hi", ImageFilenames: writeTestImages(t, 10)}
+
+	publishAll(context.Background(), []Publisher{publisher}, &message, defaultPublishTimeout)
+	if err := message.Results["git"].Err; err != nil {
+		t.Fatalf("expected no error, got %q", err)
+	}
+	if message.Received.IsZero() {
+		t.Errorf("expected the message given a Received time")
+	}
+	for _, name := range []string{"message.md", "1.jpg"} {
+		if _, err := os.Stat(filepath.Join(dir, publisher.messageDir(&message), name)); err != nil {
+			t.Errorf("expected %s in the message's directory: %s", name, err)
+		}
+	}
+}
+
+func TestGitArchiveEnabled(t *testing.T) {
+	publisher := &GitArchivePublisher{}
+	if !publisher.Enabled(&Message{Text: "hi"}) || publisher.Enabled(&Message{Text: "TEST: hi"}) {
+		t.Errorf("expected only real messages archived")
+	}
+	publisher.config.TestArchive = true
+	if publisher.Enabled(&Message{Text: "hi"}) || !publisher.Enabled(&Message{Text: "TEST: hi"}) {
+		t.Errorf("expected only test messages archived in a test archive")
+	}
+}
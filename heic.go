@@ -0,0 +1,12 @@
+//go:build heic
+
+package main
+
+// Building with `-tags heic` lets pictures be converted from HEIC, as iPhones
+// send them, with goheif, which uses cgo (so it's not in the default build).
+// Without it, HEIC pictures are only sent to destinations that take them.
+import _ "github.com/jdeng/goheif"
+
+func init() {
+	heicSupported = true
+}
@@ -0,0 +1,52 @@
+//go:build heic
+
+package main
+
+import "testing"
+
+// expectRedAndBlue fails the test unless the picture is picture.heic's 32x16,
+// red on the left & blue on the right
+func expectRedAndBlue(t *testing.T, filename string) {
+	t.Helper()
+	picture, format := decodeTestImage(t, filename)
+	if format != "jpeg" {
+		t.Errorf("expected a JPEG, got %s", format)
+	}
+	if size := picture.Bounds().Size(); size.X != 32 || size.Y != 16 {
+		t.Fatalf("expected 32x16, got %dx%d", size.X, size.Y)
+	}
+	if r, _, b, _ := picture.At(4, 8).RGBA(); r < 0xc000 || b > 0x4000 {
+		t.Errorf("expected red on the left, got %v", picture.At(4, 8))
+	}
+	if r, _, b, _ := picture.At(28, 8).RGBA(); b < 0xc000 || r > 0x4000 {
+		t.Errorf("expected blue on the right, got %v", picture.At(28, 8))
+	}
+}
+
+func TestPrepareImageHEIC(t *testing.T) {
+	original := copyFixtureImage(t, "picture.heic")
+	if mediaType := detectMediaType(mustReadFile(t, original)); mediaType != "image/heic" {
+		t.Fatalf("expected the fixture to be a HEIC, got %s", mediaType)
+	}
+
+	file, err := prepareImage(MediaFile{Filename: original, Type: "image/heic"}, twitterImageLimits)
+	if err != nil {
+		t.Fatalf("expected the HEIC converted, got %s", err)
+	}
+	if file.Filename == original || file.Type != "image/jpeg" {
+		t.Fatalf("expected a converted copy, got %+v", file)
+	}
+	expectRedAndBlue(t, file.Filename)
+}
+
+func TestStripMetadataHEIC(t *testing.T) {
+	original := copyFixtureImage(t, "picture.heic")
+	filename, mediaType, err := stripMetadata(original, "image/heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename == original || mediaType != "image/jpeg" {
+		t.Fatalf("expected the HEIC converted to a JPEG, got %s (%s)", filename, mediaType)
+	}
+	expectRedAndBlue(t, filename)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"golang.org/x/image/draw"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	// the other formats pictures arrive in; HEIC needs the heic build tag
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// convertedImageQuality is the JPEG quality pictures are converted at, &
+// lowestImageQuality the lowest it's turned down to, to fit a destination's
+// limit on bytes, before they're shrunk instead
+const (
+	convertedImageQuality = 85
+	lowestImageQuality    = 55
+)
+
+// jpegHeaderLength is how much of a JPEG is read to find its EXIF, which is
+// in a segment of at most 64KB near the start
+const jpegHeaderLength = 128 << 10
+
+// heicSupported is whether HEIC pictures can be converted, which they can
+// only be in builds with the heic tag
+var heicSupported = false
+
+// ImageLimits is what a destination takes: the media types it shows, & the
+// most bytes & pixels (along the longer side) a picture can have, & the most
+// bytes a video can have, where 0 is no limit
+type ImageLimits struct {
+	Types         mediaTypeSet
+	MaxBytes      int64
+	MaxSide       int
+	MaxVideoBytes int64
+}
+
+// fits reports whether a picture of the type, size, & dimensions is within
+// the limits
+func (l ImageLimits) fits(mediaType string, size int64, width int, height int) bool {
+	if !l.Types[mediaType] || (l.MaxBytes > 0 && size > l.MaxBytes) {
+		return false
+	}
+	return l.MaxSide == 0 || (width <= l.MaxSide && height <= l.MaxSide)
+}
+
+// prepareMedia returns the Message's files as the destination can take them:
+// pictures it can't show, or that are sideways or too big, are converted to
+// upright JPEGs within its limits, & files it can't take are skipped. remove
+// deletes the converted files, once they've been posted.
+func (m *Message) prepareMedia(destination string, limits ImageLimits) (files []MediaFile, remove func()) {
+	var converted []string
+	for i, filename := range m.ImageFilenames {
+		file, err := prepareImage(MediaFile{Filename: filename, Type: m.MediaType(i)}, limits)
+		if err != nil && isHEIC(file.Type) && !heicSupported {
+			log.Printf("WARNING: %s can't take the HEIC picture %q, & it can't be converted, since txt2mary wasn't built with `-tags heic`; skipping it\n", destination, filename)
+			continue
+		}
+		if err != nil {
+			log.Printf("%s can't take %q: %s; skipping it\n", destination, filename, err)
+			continue
+		}
+		if file.Filename != filename {
+			log.Printf("converted %q to %q for %s\n", filename, file.Filename, destination)
+			converted = append(converted, file.Filename)
+		}
+		files = append(files, file)
+	}
+	return files, func() {
+		for _, filename := range converted {
+			if err := os.Remove(filename); err != nil {
+				log.Printf("error removing file %q: %s\n", filename, err)
+			}
+		}
+	}
+}
+
+// prepareImage returns the file if it's within the limits, or else a
+// converted copy of it if it's a picture that can be made to fit
+func prepareImage(file MediaFile, limits ImageLimits) (MediaFile, error) {
+	opened, err := os.Open(file.Filename)
+	if err != nil {
+		return file, err
+	}
+	defer opened.Close()
+	info, err := opened.Stat()
+	if err != nil {
+		return file, err
+	}
+	size := info.Size()
+
+	config, _, err := image.DecodeConfig(opened)
+	if err != nil {
+		// not a picture that can be converted, so it's posted as it is, or not
+		if !limits.Types[file.Type] {
+			return file, fmt.Errorf("%s isn't a type it takes", file.Type)
+		}
+		maxBytes := limits.MaxBytes
+		if isVideo(file.Type) {
+			maxBytes = limits.MaxVideoBytes
+		}
+		if maxBytes > 0 && size > maxBytes {
+			return file, fmt.Errorf("it's too big (%d bytes)", size)
+		}
+		return file, nil
+	}
+
+	orientation := 1
+	if file.Type == "image/jpeg" {
+		header := make([]byte, jpegHeaderLength)
+		n, _ := opened.ReadAt(header, 0)
+		orientation = jpegOrientation(header[:n])
+	}
+	if orientation == 1 && limits.fits(file.Type, size, config.Width, config.Height) {
+		return file, nil
+	}
+
+	// it's a picture that needs converting, so it's read in whole
+	contents, err := os.ReadFile(file.Filename)
+	if err != nil {
+		return file, err
+	}
+	if limits.Types[file.Type] && isAnimatedGIF(bytes.NewReader(contents)) {
+		// converting it would lose the animation
+		return file, nil
+	}
+
+	picture, _, err := image.Decode(bytes.NewReader(contents))
+	if err != nil {
+		return file, err
+	}
+	encoded, err := encodeJPEG(orientImage(picture, orientation), limits)
+	if err != nil {
+		return file, err
+	}
+
+	base := strings.TrimSuffix(filepath.Base(file.Filename), filepath.Ext(file.Filename))
+	converted, err := os.CreateTemp(filepath.Dir(file.Filename), base+"-*.jpg")
+	if err != nil {
+		return file, err
+	}
+	_, err = converted.Write(encoded)
+	if closeErr := converted.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(converted.Name())
+		return file, err
+	}
+	return MediaFile{Filename: converted.Name(), Type: "image/jpeg"}, nil
+}
+
+// isAnimatedGIF reports whether the picture is a GIF of more than one frame,
+// reading only as far as its second frame
+func isAnimatedGIF(r io.Reader) bool {
+	reader := bufio.NewReader(r)
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(reader, header); err != nil || !bytes.HasPrefix(header, []byte("GIF8")) {
+		return false
+	}
+	if header[10]&0x80 != 0 { // it has a global color table
+		if _, err := reader.Discard(3 << (header[10]&7 + 1)); err != nil {
+			return false
+		}
+	}
+	frames := 0
+	for {
+		introducer, err := reader.ReadByte()
+		if err != nil {
+			return false
+		}
+		switch introducer {
+		case 0x21: // an extension, which has a label before its data
+			if _, err = reader.ReadByte(); err != nil {
+				return false
+			}
+		case 0x2C: // a frame
+			if frames++; frames > 1 {
+				return true
+			}
+			descriptor := make([]byte, 9)
+			if _, err = io.ReadFull(reader, descriptor); err != nil {
+				return false
+			}
+			if descriptor[8]&0x80 != 0 { // it has a local color table
+				if _, err = reader.Discard(3 << (descriptor[8]&7 + 1)); err != nil {
+					return false
+				}
+			}
+			if _, err = reader.ReadByte(); err != nil { // the LZW code size
+				return false
+			}
+		default: // the end
+			return false
+		}
+		// the data's in blocks, each after its length, up to an empty one
+		for {
+			length, err := reader.ReadByte()
+			if err != nil {
+				return false
+			}
+			if length == 0 {
+				break
+			}
+			if _, err = reader.Discard(int(length)); err != nil {
+				return false
+			}
+		}
+	}
+}
+
+// encodeJPEG encodes the picture as a JPEG within the limits, shrinking it to
+// fit the longest side, then lowering the quality & shrinking it further
+// until it's few enough bytes
+func encodeJPEG(picture image.Image, limits ImageLimits) ([]byte, error) {
+	width, height := fitSize(picture.Bounds().Dx(), picture.Bounds().Dy(), limits.MaxSide)
+	for {
+		resized := resizeImage(picture, width, height)
+		for quality := convertedImageQuality; quality >= lowestImageQuality; quality -= 15 {
+			var encoded bytes.Buffer
+			if err := jpeg.Encode(&encoded, resized, &jpeg.Options{Quality: quality}); err != nil {
+				return nil, err
+			}
+			if limits.MaxBytes == 0 || int64(encoded.Len()) <= limits.MaxBytes {
+				return encoded.Bytes(), nil
+			}
+		}
+		if width < 16 || height < 16 {
+			return nil, fmt.Errorf("it can't be made small enough (%d bytes)", limits.MaxBytes)
+		}
+		width, height = width*3/4, height*3/4
+	}
+}
+
+// fitSize scales the dimensions down so neither is more than maxSide, if
+// that's not 0
+func fitSize(width int, height int, maxSide int) (int, int) {
+	if maxSide == 0 || (width <= maxSide && height <= maxSide) {
+		return width, height
+	}
+	if width >= height {
+		return maxSide, max(1, height*maxSide/width)
+	}
+	return max(1, width*maxSide/height), maxSide
+}
+
+// resizeImage draws the picture at the size, on white, since JPEGs can't be
+// transparent
+func resizeImage(picture image.Image, width int, height int) *image.RGBA {
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(resized, resized.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(resized, resized.Bounds(), picture, picture.Bounds(), draw.Over, nil)
+	return resized
+}
+
+// orientImage turns the picture upright, given its EXIF orientation
+func orientImage(picture image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return picture
+	}
+	bounds := picture.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if orientation >= 5 { // these swap the width & height
+		w, h = h, w
+	}
+	oriented := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// where this pixel comes from in the picture as stored
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // upside down & mirrored
+				sx, sy = x, h-1-y
+			case 5: // on its side & mirrored
+				sx, sy = y, x
+			case 6: // turned anticlockwise, so it's turned back clockwise
+				sx, sy = y, w-1-x
+			case 7:
+				sx, sy = h-1-y, w-1-x
+			case 8: // turned clockwise
+				sx, sy = h-1-y, x
+			}
+			oriented.Set(x, y, picture.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return oriented
+}
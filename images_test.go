@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// copyFixtureImage copies a picture from fixtures/images into a temp dir,
+// where converted copies of it can be written
+func copyFixtureImage(t *testing.T, name string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := copyFile(filepath.Join("fixtures", "images", name), filename); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func decodeTestImage(t *testing.T, filename string) (image.Image, string) {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	picture, format, err := image.Decode(file)
+	if err != nil {
+		t.Fatalf("expected %s to be a picture: %s", filename, err)
+	}
+	return picture, format
+}
+
+func TestPrepareImage(t *testing.T) {
+	var tests = []struct {
+		name      string
+		mediaType string
+		limits    ImageLimits
+		converted bool
+		width     int
+		height    int
+	}{
+		// within the limits, so left as they are
+		{name: "wide.png", mediaType: "image/png", limits: ImageLimits{Types: webImageTypes}, width: 5000, height: 100},
+		{name: "picture.webp", mediaType: "image/webp", limits: ImageLimits{Types: webImageTypes}, width: 150, height: 100},
+		{name: "animated.gif", mediaType: "image/gif", limits: twitterImageLimits, width: 10, height: 10},
+		// too wide
+		{name: "wide.png", mediaType: "image/png", limits: twitterImageLimits, converted: true, width: 4096, height: 81},
+		{name: "wide.png", mediaType: "image/png", limits: blueskyImageLimits, converted: true, width: 2000, height: 40},
+		// sideways
+		{name: "rotated.jpg", mediaType: "image/jpeg", limits: twitterImageLimits, converted: true, width: 20, height: 40},
+		// not taken
+		{name: "picture.bmp", mediaType: "image/bmp", limits: twitterImageLimits, converted: true, width: 16, height: 12},
+		{name: "picture.webp", mediaType: "image/webp", limits: ImageLimits{Types: newMediaTypeSet("image/jpeg")}, converted: true, width: 150, height: 100},
+		{name: "animated.gif", mediaType: "image/gif", limits: blueskyImageLimits, converted: true, width: 10, height: 10},
+	}
+	for _, test := range tests {
+		original := copyFixtureImage(t, test.name)
+		file, err := prepareImage(MediaFile{Filename: original, Type: test.mediaType}, test.limits)
+		if err != nil {
+			t.Errorf("expected %s to be prepared, got %s", test.name, err)
+			continue
+		}
+		if converted := file.Filename != original; converted != test.converted {
+			t.Errorf("expected %s converted: %v, got %+v", test.name, test.converted, file)
+		}
+		picture, format := decodeTestImage(t, file.Filename)
+		if test.converted && (format != "jpeg" || file.Type != "image/jpeg" || filepath.Ext(file.Filename) != ".jpg") {
+			t.Errorf("expected %s converted to JPEG, got %s %+v", test.name, format, file)
+		}
+		if size := picture.Bounds().Size(); size.X != test.width || size.Y != test.height {
+			t.Errorf("expected %s to be %dx%d, got %dx%d", test.name, test.width, test.height, size.X, size.Y)
+		}
+	}
+}
+
+func TestPrepareImageOrientation(t *testing.T) {
+	file, err := prepareImage(MediaFile{Filename: copyFixtureImage(t, "rotated.jpg"), Type: "image/jpeg"}, ImageLimits{Types: webImageTypes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stored on its side, red on the left; upright, red is on top
+	picture, _ := decodeTestImage(t, file.Filename)
+	top, bottom := picture.At(10, 5), picture.At(10, 35)
+	if r, _, b, _ := top.RGBA(); r < 0xc000 || b > 0x4000 {
+		t.Errorf("expected red at the top, got %v", top)
+	}
+	if r, _, b, _ := bottom.RGBA(); r > 0x4000 || b < 0xc000 {
+		t.Errorf("expected blue at the bottom, got %v", bottom)
+	}
+	if jpegOrientation(mustReadFile(t, file.Filename)) != 1 {
+		t.Errorf("expected the converted picture to have no orientation")
+	}
+}
+
+func TestPrepareImageTransparency(t *testing.T) {
+	file, err := prepareImage(MediaFile{Filename: copyFixtureImage(t, "transparent.png"), Type: "image/png"}, ImageLimits{Types: newMediaTypeSet("image/jpeg")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	picture, _ := decodeTestImage(t, file.Filename)
+	if r, g, b, _ := picture.At(15, 5).RGBA(); r < 0xf000 || g < 0xf000 || b < 0xf000 {
+		t.Errorf("expected the transparent half to be white, got %v", picture.At(15, 5))
+	}
+}
+
+func TestPrepareImageMaxBytes(t *testing.T) {
+	limits := ImageLimits{Types: webImageTypes, MaxBytes: 3000}
+	file, err := prepareImage(MediaFile{Filename: copyFixtureImage(t, "wide.png"), Type: "image/png"}, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(file.Filename)
+	if file.Type != "image/jpeg" || info.Size() > limits.MaxBytes {
+		t.Errorf("expected a JPEG of at most %d bytes, got %+v of %d", limits.MaxBytes, file, info.Size())
+	}
+	if picture, _ := decodeTestImage(t, file.Filename); picture.Bounds().Dx() >= 5000 {
+		t.Errorf("expected the picture to be shrunk to fit, got %v", picture.Bounds())
+	}
+
+	// what can't be read can't be shrunk
+	unknown := writeTestImages(t, 5000)[0]
+	if _, err = prepareImage(MediaFile{Filename: unknown, Type: "image/jpeg"}, limits); err == nil {
+		t.Errorf("expected an error for a file too big that isn't a picture")
+	}
+}
+
+func TestPrepareMedia(t *testing.T) {
+	message := Message{
+		ImageFilenames: []string{copyFixtureImage(t, "picture.bmp"), copyFixtureImage(t, "animated.gif"), writeTestMedia(t, "vcard")[0]},
+		MediaTypes:     []string{"image/bmp", "image/gif", "text/vcard"},
+	}
+	files, remove := message.prepareMedia("Bluesky", blueskyImageLimits)
+	if len(files) != 2 || files[0].Type != "image/jpeg" || files[1].Type != "image/jpeg" {
+		t.Fatalf("expected the pictures converted & the contact card skipped, got %+v", files)
+	}
+	remove()
+	for _, file := range files {
+		if _, err := os.Stat(file.Filename); !os.IsNotExist(err) {
+			t.Errorf("expected %s removed", file.Filename)
+		}
+	}
+	for _, filename := range message.ImageFilenames {
+		if _, err := os.Stat(filename); err != nil {
+			t.Errorf("expected the original %s kept, got %s", filename, err)
+		}
+	}
+}
+
+func TestIsAnimatedGIF(t *testing.T) {
+	animated := mustReadFile(t, "fixtures/images/animated.gif")
+	picture, _ := decodeTestImage(t, "fixtures/images/picture.bmp")
+	var still bytes.Buffer
+	if err := gif.Encode(&still, picture, nil); err != nil {
+		t.Fatal(err)
+	}
+	// only as far as the second frame is needed
+	second := bytes.LastIndexByte(animated, 0x2C)
+	var tests = []struct {
+		name     string
+		contents []byte
+		expected bool
+	}{
+		{name: "animated", contents: animated, expected: true},
+		{name: "up to the second frame", contents: animated[:second+1], expected: true},
+		{name: "still", contents: still.Bytes(), expected: false},
+		{name: "truncated", contents: animated[:30], expected: false},
+		{name: "a PNG", contents: mustReadFile(t, "fixtures/images/wide.png"), expected: false},
+	}
+	for _, test := range tests {
+		if actual := isAnimatedGIF(bytes.NewReader(test.contents)); actual != test.expected {
+			t.Errorf("expected isAnimatedGIF to be %v for the %s GIF, got %v", test.expected, test.name, actual)
+		}
+	}
+}
+
+func TestPrepareMediaHEICWarning(t *testing.T) {
+	if heicSupported {
+		t.Skip("HEIC pictures are converted in this build")
+	}
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	message := Message{ImageFilenames: []string{copyFixtureImage(t, "picture.heic")}, MediaTypes: []string{"image/heic"}}
+	if files, _ := message.prepareMedia("Twitter", twitterImageLimits); len(files) != 0 {
+		t.Errorf("expected the HEIC skipped, got %+v", files)
+	}
+	if !strings.Contains(logged.String(), "WARNING") || !strings.Contains(logged.String(), "-tags heic") {
+		t.Errorf("expected a warning saying to build with the heic tag, got %q", logged.String())
+	}
+}
+
+func mustReadFile(t *testing.T, filename string) []byte {
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
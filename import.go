@@ -0,0 +1,361 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// microBlogFeed is the part of a JSON Feed, like the feed.json in a
+// Micro.blog blog export, that's imported
+type microBlogFeed struct {
+	Items []microBlogFeedItem `json:"items"`
+}
+
+type microBlogFeedItem struct {
+	URL           string    `json:"url"`
+	ContentHTML   string    `json:"content_html"`
+	ContentText   string    `json:"content_text"`
+	DatePublished time.Time `json:"date_published"`
+	Image         string    `json:"image"`
+	Attachments   []struct {
+		URL      string `json:"url"`
+		MimeType string `json:"mime_type"`
+	} `json:"attachments"`
+}
+
+var (
+	imgSrcPattern     = regexp.MustCompile(`(?i)<img[^>]*\ssrc\s*=\s*["']([^"']+)["']`)
+	htmlBreakPattern  = regexp.MustCompile(`(?i)<br\s*/?>`)
+	htmlBlockPattern  = regexp.MustCompile(`(?i)</(p|blockquote|div|h[1-6]|li)>`)
+	htmlTagPattern    = regexp.MustCompile(`<[^>]*>`)
+	blankLinesPattern = regexp.MustCompile(`\n\s*\n\s*`)
+)
+
+// htmlToText reduces a post's HTML to its text, with a blank line between
+// paragraphs
+func htmlToText(content string) string {
+	content = htmlBreakPattern.ReplaceAllString(content, "\n")
+	content = htmlBlockPattern.ReplaceAllString(content, "\n\n")
+	content = htmlTagPattern.ReplaceAllString(content, "")
+	content = html.UnescapeString(content)
+	return strings.TrimSpace(blankLinesPattern.ReplaceAllString(content, "\n\n"))
+}
+
+// parseMicroBlogPost recovers the sender & text of a post made by txt2mary,
+// in the "> text\n\n&ndash; Name" format of the default Markdown template, from its
+// Markdown or HTML. ok is false for posts that aren't in that format.
+func parseMicroBlogPost(item microBlogFeedItem) (text string, sender string, ok bool) {
+	content := html.UnescapeString(item.ContentText)
+	if strings.TrimSpace(content) == "" {
+		content = htmlToText(item.ContentHTML)
+	}
+	content = strings.TrimSpace(strings.ReplaceAll(content, "\r\n", "\n"))
+
+	// the attribution is the last paragraph, & maybe the only one, if the
+	// text was empty
+	split := strings.LastIndex(content, "\n\n")
+	if split < 0 {
+		split = 0
+	}
+	attribution := strings.TrimSpace(content[split:])
+	if !strings.HasPrefix(attribution, "–") {
+		return "", "", false
+	}
+	sender = strings.TrimSpace(strings.TrimPrefix(attribution, "–"))
+	if sender == "" || strings.Contains(sender, "\n") {
+		return "", "", false
+	}
+
+	lines := strings.Split(content[:split], "\n")
+	for i, line := range lines {
+		line = strings.TrimPrefix(line, ">")
+		lines[i] = strings.TrimPrefix(line, " ")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")), sender, true
+}
+
+// microBlogImageURLs returns the URLs of the post's pictures: those in its
+// HTML, & its image & attachments
+func microBlogImageURLs(item microBlogFeedItem) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	add := func(u string) {
+		u = html.UnescapeString(strings.TrimSpace(u))
+		if u != "" && !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+	for _, match := range imgSrcPattern.FindAllStringSubmatch(item.ContentHTML, -1) {
+		add(match[1])
+	}
+	add(item.Image)
+	for _, attachment := range item.Attachments {
+		if strings.HasPrefix(attachment.MimeType, "image/") {
+			add(attachment.URL)
+		}
+	}
+	return urls
+}
+
+// microBlogExport is a JSON Feed to import, with the files alongside it
+// (e.g. the uploads in a blog export), which may be in a zip file
+type microBlogExport struct {
+	feed    microBlogFeed
+	files   fs.FS  // where the feed's pictures might be
+	feedDir string // the feed's directory within files
+	closer  io.Closer
+}
+
+// openMicroBlogExport opens a JSON Feed file, a directory with a feed.json
+// in it, or a zip file of one, like Micro.blog's blog export
+func openMicroBlogExport(source string) (*microBlogExport, error) {
+	export := &microBlogExport{}
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	var feedName string
+	switch {
+	case info.IsDir():
+		export.files, feedName = os.DirFS(source), "feed.json"
+	case strings.EqualFold(filepath.Ext(source), ".zip"):
+		reader, err := zip.OpenReader(source)
+		if err != nil {
+			return nil, err
+		}
+		export.files, export.closer = reader, reader
+		for _, file := range reader.File {
+			// the shallowest feed.json, in case the export is in a directory
+			if path.Base(file.Name) == "feed.json" && (feedName == "" || len(file.Name) < len(feedName)) {
+				feedName = file.Name
+			}
+		}
+		if feedName == "" {
+			reader.Close()
+			return nil, fmt.Errorf("there's no feed.json in %s", source)
+		}
+	default:
+		export.files, feedName = os.DirFS(filepath.Dir(source)), filepath.Base(source)
+	}
+	export.feedDir = path.Dir(feedName)
+
+	contents, err := fs.ReadFile(export.files, feedName)
+	if err == nil {
+		err = json.Unmarshal(contents, &export.feed)
+	}
+	if err != nil {
+		export.Close()
+		return nil, fmt.Errorf("error reading the feed in %s: %w", source, err)
+	}
+	return export, nil
+}
+
+func (e *microBlogExport) Close() error {
+	if e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
+
+// localFile returns the path within the export's files of a picture's URL,
+// if it's there: relative URLs are relative to the feed, & an absolute
+// URL's path (e.g. /uploads/2023/abc.jpg) is looked for alongside it.
+func (e *microBlogExport) localFile(imageURL string) (string, bool) {
+	parsed, err := url.Parse(imageURL)
+	if err != nil {
+		return "", false
+	}
+	name := path.Clean(path.Join(e.feedDir, strings.TrimPrefix(parsed.Path, "/")))
+	if !fs.ValidPath(name) {
+		return "", false
+	}
+	if _, err = fs.Stat(e.files, name); err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+// fetchImage saves the picture at the URL into dir, from the export if it's
+// there, or else by downloading it, returning the file's name
+func (e *microBlogExport) fetchImage(ctx context.Context, imageURL string, dir string) (string, error) {
+	ext := strings.ToLower(path.Ext(strings.SplitN(imageURL, "?", 2)[0]))
+	if ext == "" || len(ext) > 5 {
+		ext = ".jpg"
+	}
+	file, err := os.CreateTemp(dir, "import-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if name, ok := e.localFile(imageURL); ok {
+		source, err := e.files.Open(name)
+		if err != nil {
+			return "", err
+		}
+		defer source.Close()
+		_, err = io.Copy(file, source)
+		return file.Name(), err
+	}
+
+	if !strings.HasPrefix(imageURL, "http://") && !strings.HasPrefix(imageURL, "https://") {
+		return "", fmt.Errorf("picture %q isn't in the export", imageURL)
+	}
+	err = retryPolicy.Do(ctx, "downloading "+imageURL, func() error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+		if err != nil {
+			return Permanent(err)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if err = checkStatus(request.URL.Host, response); err != nil {
+			return err
+		}
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return Permanent(err)
+		}
+		if err = file.Truncate(0); err != nil {
+			return Permanent(err)
+		}
+		_, err = io.Copy(file, response.Body)
+		return err
+	})
+	return file.Name(), err
+}
+
+// importCommand implements `txt2mary import`, which archives the messages in
+// a Micro.blog export, without posting them anywhere
+func importCommand(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	destination := flags.String("destination", "microblog", "the destination to record the posts as results for")
+	dryRun := flags.Bool("dry-run", false, "show what would be imported, without importing anything")
+	flags.Usage = func() {
+		fmt.Fprintf(stdout, "usage: txt2mary import [--destination name] [--dry-run] <feed.json, export directory, or export zip>\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	export, err := openMicroBlogExport(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return 1
+	}
+	defer export.Close()
+
+	commandArchive, err := openArchive(config)
+	if err == nil && commandArchive == nil {
+		err = fmt.Errorf("there's no archive to import into (ArchiveFile is %q)", config.ArchiveFile)
+	}
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return 1
+	}
+	defer commandArchive.Close()
+
+	// the users file is only for filling in senders' numbers
+	users, _ := ReadUsersFile(config.UsersFilename)
+	tempDir, err := os.MkdirTemp("", "txt2mary-import-")
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return 1
+	}
+	defer os.RemoveAll(tempDir)
+
+	var imported, archived, unrecognized, failed int
+	for _, item := range export.feed.Items {
+		text, name, ok := parseMicroBlogPost(item)
+		if !ok {
+			unrecognized++
+			continue
+		}
+		if item.URL != "" {
+			found, err := commandArchive.HasResult(*destination, item.URL)
+			if err != nil {
+				fmt.Fprintf(stdout, "%s\n", err)
+				return 1
+			}
+			if found {
+				archived++
+				continue
+			}
+		}
+
+		phone, _ := sender(users, name)
+		imageURLs := microBlogImageURLs(item)
+		message := Message{
+			Phone:     phone,
+			From:      name,
+			Text:      text,
+			Received:  item.DatePublished,
+			NumImages: len(imageURLs),
+			Results:   map[string]PublishResult{*destination: {URL: item.URL, Media: imageURLs}},
+		}
+		if *dryRun {
+			fmt.Fprintf(stdout, "would import %s from %s, with %d images: %q\n", item.URL, message.From, message.NumImages, message.Text)
+			imported++
+			continue
+		}
+
+		err = nil
+		for _, imageURL := range imageURLs {
+			var filename string
+			if filename, err = export.fetchImage(context.Background(), imageURL, tempDir); err != nil {
+				break
+			}
+			message.ImageFilenames = append(message.ImageFilenames, filename)
+		}
+		if err == nil {
+			_, err = commandArchive.Record(&message)
+		}
+		for _, filename := range message.ImageFilenames {
+			os.Remove(filename)
+		}
+		if err != nil {
+			log.Printf("error importing %s: %s", item.URL, err)
+			fmt.Fprintf(stdout, "error importing %s: %s\n", item.URL, err)
+			failed++
+			continue
+		}
+		imported++
+	}
+
+	verb := "imported"
+	if *dryRun {
+		verb = "would import"
+	}
+	fmt.Fprintf(stdout, "%s %d messages; %d already archived, %d not posted by txt2mary", verb, imported, archived, unrecognized)
+	if failed > 0 {
+		fmt.Fprintf(stdout, ", %d failed", failed)
+	}
+	fmt.Fprintf(stdout, "\n")
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMicroBlogPost(t *testing.T) {
+	var tests = []struct {
+		item   microBlogFeedItem
+		text   string
+		sender string
+		ok     bool
+	}{
+		{item: microBlogFeedItem{ContentText: "> just a couple bros\n\n&ndash; Gon"}, text: "just a couple bros", sender: "Gon", ok: true},
+		{item: microBlogFeedItem{ContentText: "> line one\nline two\n\n– Killua"}, text: "line one\nline two", sender: "Killua", ok: true},
+		{item: microBlogFeedItem{ContentHTML: "<blockquote>\n<p>fishing &amp; <em>stuff</em></p>\n</blockquote>\n<p>&ndash; Gon</p>"}, text: "fishing & stuff", sender: "Gon", ok: true},
+		{item: microBlogFeedItem{ContentHTML: "<blockquote><p>one<br />two</p></blockquote><p>&ndash; Gon</p><p><img src=\"a.jpg\"></p>"}, text: "one\ntwo", sender: "Gon", ok: true},
+		{item: microBlogFeedItem{ContentHTML: "<blockquote><p>&nbsp;</p></blockquote><p>&ndash; Gon</p>"}, text: "", sender: "Gon", ok: true},
+		{item: microBlogFeedItem{ContentHTML: "<p>Just a regular post</p>"}, ok: false},
+		{item: microBlogFeedItem{ContentText: "> a quote\n\n&ndash; someone\nand more"}, ok: false},
+	}
+	for _, test := range tests {
+		text, sender, ok := parseMicroBlogPost(test.item)
+		if ok != test.ok || (ok && (text != test.text || sender != test.sender)) {
+			t.Errorf("parseMicroBlogPost(%+v) = %q, %q, %v; expected %q, %q, %v", test.item, text, sender, ok, test.text, test.sender, test.ok)
+		}
+	}
+}
+
+// writeMicroBlogExport writes a blog export to dir: a feed.json of 3 posts
+// by txt2mary (one with a picture in the export's uploads, one with a
+// picture on the given host) & one not, & returns the picture's contents
+func writeMicroBlogExport(t *testing.T, dir string, host string) []byte {
+	picture, _ := os.ReadFile(writeTestImages(t, 10)[0])
+	if err := os.MkdirAll(filepath.Join(dir, "uploads", "2023"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "uploads", "2023", "abc.jpg"), picture, 0644); err != nil {
+		t.Fatal(err)
+	}
+	feed := map[string]interface{}{
+		"version": "https://jsonfeed.org/version/1",
+		"items": []map[string]interface{}{
+			{"id": "1", "url": "https://foo.micro.blog/2023/11/27/1.html", "date_published": "2023-11-27T14:32:05-06:00",
+				"content_html": `<blockquote><p>just a couple bros</p></blockquote><p>&ndash; Gon</p><img src="https://foo.micro.blog/uploads/2023/abc.jpg" />`},
+			{"id": "2", "url": "https://foo.micro.blog/2023/11/28/2.html", "date_published": "2023-11-28T09:00:00-06:00",
+				"content_text": "> gone fishing\n\n&ndash; Killua", "image": host + "/fish.jpg"},
+			{"id": "3", "url": "https://foo.micro.blog/2023/11/29/3.html", "date_published": "2023-11-29T09:00:00-06:00",
+				"content_html": "<p>Mary's own post</p>"},
+		},
+	}
+	contents, _ := json.Marshal(feed)
+	if err := os.WriteFile(filepath.Join(dir, "feed.json"), contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return picture
+}
+
+func setupImportTest(t *testing.T) (string, string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/fish.jpg" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("fish picture"))
+	}))
+	t.Cleanup(server.Close)
+
+	users := filepath.Join(t.TempDir(), "users.json")
+	_ = os.WriteFile(users, []byte(`{"+15125551212": "Gon"}`), 0644)
+	config = Config{
+		ArchiveFile:     filepath.Join(t.TempDir(), "archive.db"),
+		ArchiveImageDir: t.TempDir(),
+		UsersFilename:   users,
+	}
+	t.Cleanup(func() { config = Config{} })
+	return server.URL, config.ArchiveFile
+}
+
+func TestImportCommand(t *testing.T) {
+	host, filename := setupImportTest(t)
+	dir := t.TempDir()
+	picture := writeMicroBlogExport(t, dir, host)
+
+	var stdout bytes.Buffer
+	if code := importCommand([]string{filepath.Join(dir, "feed.json")}, &stdout); code != 0 {
+		t.Fatalf("expected success, got %d: %s", code, stdout.String())
+	}
+	if expected := "imported 2 messages; 0 already archived, 1 not posted by txt2mary\n"; stdout.String() != expected {
+		t.Errorf("expected %q, got %q", expected, stdout.String())
+	}
+
+	archive := openTestArchiveFile(t, filename)
+	archive.imageDir = config.ArchiveImageDir
+	messages, err := archive.Messages(MessageQuery{})
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("expected 2 messages archived, got %d (%v)", len(messages), err)
+	}
+	killua, gon := messages[0], messages[1]
+	if gon.Sender != "Gon" || gon.Phone != "+15125551212" || gon.Text != "just a couple bros" ||
+		!gon.Received.Equal(time.Date(2023, 11, 27, 20, 32, 5, 0, time.UTC)) {
+		t.Errorf("unexpected message %+v", gon)
+	}
+	if len(gon.Results) != 1 || gon.Results[0].Destination != "microblog" || gon.Results[0].URL != "https://foo.micro.blog/2023/11/27/1.html" {
+		t.Errorf("expected the post recorded as a result, got %+v", gon.Results)
+	}
+	if len(gon.Images) != 1 || gon.Images[0].Filename == "" {
+		t.Fatalf("expected the picture kept, got %+v", gon.Images)
+	}
+	if stored, _ := os.ReadFile(filepath.Join(config.ArchiveImageDir, gon.Images[0].Filename)); !bytes.Equal(stored, picture) {
+		t.Errorf("expected the picture from the export's uploads")
+	}
+	if killua.Sender != "Killua" || killua.Phone != "" || len(killua.Images) != 1 {
+		t.Errorf("unexpected message %+v", killua)
+	}
+	if stored, _ := os.ReadFile(filepath.Join(config.ArchiveImageDir, killua.Images[0].Filename)); string(stored) != "fish picture" {
+		t.Errorf("expected the picture downloaded, got %q", stored)
+	}
+	archive.Close()
+
+	// importing again adds nothing
+	stdout.Reset()
+	if code := importCommand([]string{dir}, &stdout); code != 0 || !strings.HasPrefix(stdout.String(), "imported 0 messages; 2 already archived") {
+		t.Errorf("expected nothing imported again, got %d %q", code, stdout.String())
+	}
+}
+
+func TestImportCommandFromZip(t *testing.T) {
+	host, _ := setupImportTest(t)
+	dir := t.TempDir()
+	writeMicroBlogExport(t, dir, host)
+
+	// zipped inside a directory, as Micro.blog's blog export is
+	bundle := filepath.Join(t.TempDir(), "export.zip")
+	file, _ := os.Create(bundle)
+	writer := zip.NewWriter(file)
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relative, _ := filepath.Rel(dir, path)
+		w, _ := writer.Create("export/" + filepath.ToSlash(relative))
+		contents, _ := os.ReadFile(path)
+		_, err = w.Write(contents)
+		return err
+	})
+	writer.Close()
+	file.Close()
+
+	var stdout bytes.Buffer
+	if code := importCommand([]string{"--dry-run", bundle}, &stdout); code != 0 {
+		t.Fatalf("expected success, got %d: %s", code, stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "would import https://foo.micro.blog/2023/11/27/1.html from Gon, with 1 images: \"just a couple bros\"") ||
+		!strings.HasSuffix(stdout.String(), "would import 2 messages; 0 already archived, 1 not posted by txt2mary\n") {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+
+	stdout.Reset()
+	if code := importCommand([]string{bundle}, &stdout); code != 0 || !strings.HasPrefix(stdout.String(), "imported 2 messages") {
+		t.Errorf("expected 2 messages imported from the zip, got %d %q", code, stdout.String())
+	}
+}
+
+func TestImportCommandFailedImage(t *testing.T) {
+	_, filename := setupImportTest(t)
+	retryPolicy = RetryPolicy{Attempts: 1}
+	defer func() { retryPolicy = defaultRetryPolicy }()
+	dir := t.TempDir()
+	writeMicroBlogExport(t, dir, "http://127.0.0.1:1") // nothing listening
+
+	var stdout bytes.Buffer
+	if code := importCommand([]string{dir}, &stdout); code != 1 || !strings.HasSuffix(stdout.String(), "imported 1 messages; 0 already archived, 1 not posted by txt2mary, 1 failed\n") {
+		t.Errorf("expected the message with a missing picture to fail, got %d %q", code, stdout.String())
+	}
+	archive := openTestArchiveFile(t, filename)
+	if messages, _ := archive.Messages(MessageQuery{}); len(messages) != 1 {
+		t.Errorf("expected only the other message archived, got %d", len(messages))
+	}
+}
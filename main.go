@@ -1,61 +1,112 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/honeybadger-io/honeybadger-go"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 type Message struct {
-	From            string
+	MessageSid      string
+	Phone           string // the sender's number
+	From            string // the sender's name, from the users file
 	Text            string
+	Received        time.Time
 	NumImages       int
 	TwilioImageURLs []string
 	ImageFilenames  []string
-	MBImageURLs     []string
-	MBPostURL       string
-	TwitterMediaIds []string
-	TwitterPostURL  string
+	MediaTypes      []string                 // of each of TwilioImageURLs, & then ImageFilenames
+	Results         map[string]PublishResult // keyed by Publisher name
+	Withheld        []string                 // the types of the files withheld, since their metadata couldn't be removed
+}
+
+// ReceivedTime returns when the message was received, or now for a message
+// with no Received time (e.g. one queued before it was recorded)
+func (m *Message) ReceivedTime() time.Time {
+	if m.Received.IsZero() {
+		return time.Now()
+	}
+	return m.Received
+}
+
+// PostURL returns the URL of the message's post on the first destination, in
+// priority order, that it was posted to.
+func (m *Message) PostURL() string {
+	for _, name := range m.Succeeded() {
+		if postURL := m.Results[name].URL; postURL != "" {
+			return postURL
+		}
+	}
+	return ""
 }
 
 var config Config
+var publishers []Publisher
+var queue *Queue
+var dedupe *DedupeStore
+var archive *Archive
 var Version = "development"
 
-func post(message *Message) error {
-	// download images, if there are any
-	if message.NumImages > 0 {
-		err := DownloadTwilioImages(message)
+// post downloads the message's images, removes their metadata (unless the
+// config keeps it), and posts it to the given destinations,
+// returning an error describing any that failed.
+func post(ctx context.Context, message *Message, publishers []Publisher) error {
+	// download images, if there are any that aren't already here (replays
+	// have the ones downloaded before)
+	if len(message.ImageFilenames) < message.NumImages {
+		err := DownloadTwilioImages(ctx, message)
 		if err != nil {
 			log.Printf("error downloading from Twilio")
 			return err
 		}
 	}
-
-	// post the message to Micro.blog, if it's configured
-	if config.MicroBlog != (MicroBlogConfig{}) {
-		err := UploadMessageToMicroBlog(message)
-		if err != nil {
-			log.Printf("error posting message to Micro.blog")
+	if !config.KeepImageMetadata {
+		if err := message.stripImageMetadata(); err != nil {
 			return err
 		}
-	} else {
-		log.Printf("no configuration for Micro.blog - skipping")
 	}
 
-	// post the message to Twitter, if it's configured
-	if config.Twitter != (TwitterConfig{}) {
-		err := UploadMessageToTwitter(message)
-		if err != nil {
-			log.Printf("error posting message to Twitter")
-			return err
+	publishAll(ctx, publishers, message, config.publishTimeout())
+	return message.PublishError()
+}
+
+// replyText describes what happened to the message, for the sender
+func replyText(message *Message) string {
+	var reply string
+	succeeded, failed := message.Succeeded(), message.Failed()
+	switch {
+	case len(failed) == 0:
+		reply = fmt.Sprintf("message posted %s", message.PostURL())
+	case len(succeeded) == 0:
+		reply = fmt.Sprintf("sorry, your message could not be posted (failed: %s)", strings.Join(failed, ", "))
+	default:
+		reply = fmt.Sprintf("message posted %s (but failed: %s)", message.PostURL(), strings.Join(failed, ", "))
+	}
+	if unposted := message.unpostedMedia(); len(unposted) > 0 {
+		reply += fmt.Sprintf(" - %d of its files couldn't be posted anywhere (%s)", len(unposted), strings.Join(unposted, ", "))
+	}
+	return reply
+}
+
+// unpostedMedia returns the types of the Message's files that no destination
+// could post: the ones withheld, & HEIC pictures, if this build can't read
+// them
+func (m *Message) unpostedMedia() []string {
+	unposted := append([]string{}, m.Withheld...)
+	if !heicSupported {
+		for _, mediaType := range m.MediaTypes {
+			if isHEIC(mediaType) {
+				unposted = append(unposted, mediaType)
+			}
 		}
-	} else {
-		log.Printf("no configuration for Twitter - skipping")
 	}
-	return nil
+	return unposted
 }
 
 func statusHandler(w http.ResponseWriter, r *http.Request) {
@@ -68,6 +119,12 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("error reading parsing form data: %s\n", err)
 	}
 
+	if !ValidateTwilioRequest(r) {
+		log.Printf("rejecting request with invalid Twilio signature from %s for %s", r.RemoteAddr, twilioRequestURL(r))
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
 	message := ParseTwilioWebhook(r.PostForm)
 
 	// check for an unrecognized sender
@@ -80,29 +137,129 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = post(&message)
-	if err != nil && config.HoneybadgerAPIKey != "" {
-		log.Printf("notifying Honeybadger of err: %s\n", err)
-		_, _ = honeybadger.Notify(err)
+	// Twilio retries webhooks that time out, so a message seen before gets
+	// the original reply rather than being posted again
+	if IsMessageSid(message.MessageSid) {
+		if seen, isNew := dedupe.Claim(message.MessageSid); !isNew {
+			if reply, ok := duplicateReply(message.MessageSid, seen); ok {
+				log.Printf("ignoring repeated delivery of message %s", message.MessageSid)
+				writeReply(w, reply)
+				return
+			}
+			log.Printf("repeated delivery of message %s, which was never queued; queueing it now", message.MessageSid)
+		}
 	}
 
-	// always respond to Twilio (with rose-tinted message)
-	_, err = io.WriteString(w, Twiml(fmt.Sprintf("message posted %s", message.MBPostURL)))
+	// save the message before replying, so it's posted even if we crash
+	job, err := queue.Enqueue(message)
+	if err != nil {
+		log.Printf("error queueing message: %s\n", err)
+		if IsMessageSid(message.MessageSid) {
+			dedupe.Forget(message.MessageSid)
+		}
+		if config.HoneybadgerAPIKey != "" {
+			_, _ = honeybadger.Notify(err)
+		}
+		http.Error(w, "error queueing message", http.StatusInternalServerError)
+		return
+	}
+
+	writeReply(w, awaitReply(job.ID))
+}
+
+// awaitReply waits a little while for a queued job to be posted, returning
+// the reply for the sender
+func awaitReply(jobID string) string {
+	if wait := config.replyWait(); wait > 0 {
+		if posted, ok := queue.Wait(jobID, wait); ok {
+			return replyText(&posted)
+		}
+	}
+	return "message received - it will be posted shortly"
+}
+
+// duplicateReply returns the reply for a repeated delivery of a message: the
+// original results if it's been posted, or the usual reply if it's still
+// queued. It returns false if the message isn't either, i.e. it was lost.
+func duplicateReply(sid string, seen SeenMessage) (string, bool) {
+	if !seen.Finished.IsZero() {
+		return replyText(&Message{Results: seen.Results}), true
+	}
+	if queue.Has(sid) {
+		return awaitReply(sid), true
+	}
+	return "", false
+}
+
+func writeReply(w http.ResponseWriter, reply string) {
+	_, err := io.WriteString(w, Twiml(reply))
 	if err != nil {
 		log.Printf("error writing twiml response")
 	}
+}
 
-	RemoveTwilioImages(message)
+// processMessage posts a queued message, then cleans up after it
+func processMessage(ctx context.Context, message *Message) {
+	// even if posting panics
+	defer RemoveTwilioImages(message)
+
+	err := post(ctx, message, publishers)
+	if err != nil {
+		log.Printf("error posting message: %s\n", err)
+		saveDeadLetter(message, err)
+	}
+	if succeeded := message.Succeeded(); len(succeeded) > 0 {
+		log.Printf("posted message to %s", strings.Join(succeeded, ", "))
+	}
+
+	if IsMessageSid(message.MessageSid) {
+		dedupe.Finish(message.MessageSid, message.Results)
+	}
+	archiveMessage(archive, message)
 
 	log.Printf("done processing message from %s, with %d images: %q\n", message.From, message.NumImages, message.Text)
 }
 
-func main() {
+// abandonMessage saves a message the queue gave up on, e.g. one that panics
+// or crashes the server whenever it's posted, as a dead letter to replay once
+// that's fixed
+func abandonMessage(message *Message, err error) {
+	defer RemoveTwilioImages(message)
+	saveDeadLetter(message, err)
+	if IsMessageSid(message.MessageSid) {
+		dedupe.Finish(message.MessageSid, message.Results)
+	}
+}
+
+// saveDeadLetter saves a message that failed as a dead letter, & tells
+// Honeybadger about it
+func saveDeadLetter(message *Message, err error) {
+	filename, dlErr := WriteDeadLetter(config.deadLetterDir(), *message, err)
+	if dlErr != nil {
+		log.Printf("error writing dead letter: %s\n", dlErr)
+	} else {
+		log.Printf("saved message to %q for replaying\n", filename)
+	}
+	if config.HoneybadgerAPIKey != "" {
+		log.Printf("notifying Honeybadger of err: %s\n", err)
+		_, _ = honeybadger.Notify(err)
+	}
+}
+
+// setup loads the config and gets everything ready that every command needs
+func setup() {
 	config = LoadConfig()
+	if problems, _ := templateProblems(config); len(problems) > 0 {
+		log.Fatalf("error in the config's Templates: %s", strings.Join(problems, "; "))
+	}
+	publishers = ConfiguredPublishers(config)
+	if problems := duplicateNames(publishers); len(problems) > 0 {
+		log.Fatalf("error in the config: %s", strings.Join(problems, "; "))
+	}
+	retryPolicy = config.retryPolicy()
 
 	if config.HoneybadgerAPIKey != "" {
 		honeybadger.Configure(honeybadger.Configuration{APIKey: config.HoneybadgerAPIKey})
-		defer honeybadger.Monitor() // reports unhandled panics
 	}
 
 	if config.Logfile != "stderr" && config.Logfile != "" {
@@ -112,9 +269,63 @@ func main() {
 		}
 		log.SetOutput(file)
 	}
+}
+
+// serve runs the webhook server, which is what txt2mary is for
+func serve() {
+	if config.HoneybadgerAPIKey != "" {
+		defer honeybadger.Monitor() // reports unhandled panics
+	}
+
 	log.Printf("config loaded; version %q listening on %s%s", Version, config.Server, config.ServerRoute)
+	if config.Twilio.AuthToken == "" {
+		log.Printf("no Twilio AuthToken configured - webhook signatures will not be validated")
+	}
+
+	var err error
+	dedupe, err = OpenDedupeStore(config.dedupeFile(), config.dedupeExpiry())
+	if err != nil {
+		log.Fatalf("error opening dedupe store %q: %s", config.dedupeFile(), err)
+	}
+	queue, err = OpenQueue(config.queueDir())
+	if err != nil {
+		log.Fatalf("error opening queue %q: %s", config.queueDir(), err)
+	}
+	archive, err = openArchive(config)
+	if err != nil {
+		log.Fatalf("error opening archive %q: %s", config.archiveFile(), err)
+	}
+	if err = ensureMediaDir(config.mediaDir()); err != nil {
+		log.Fatalf("error with the media dir: %s", err)
+	}
+	sweepMediaDir(config.mediaDir(), staleMediaAge)
+	queue.Run(context.Background(), config.workers(), processMessage, abandonMessage)
 
 	http.HandleFunc("/status", statusHandler)
+	if config.Web.Password != "" {
+		if archive == nil {
+			log.Printf("no archive, so no web UI to browse it")
+		} else {
+			web := ArchiveWebHandler(archive, config.Web, config.archiveImageDir())
+			http.Handle(config.Web.route(), web)
+			http.Handle(config.Web.route()+"/", web)
+			log.Printf("serving the archive at %s/", config.Web.route())
+		}
+	}
+	if config.Feed.URL != "" {
+		if archive == nil {
+			log.Printf("no archive, so no feeds of it")
+		} else {
+			for feedPath, feed := range FeedHandlers(config.Feed, config.postTemplate(feedTemplateName, markdownPostTemplate), archive) {
+				http.Handle(feedPath, feed)
+			}
+			log.Printf("serving feeds of recent messages")
+		}
+	}
 	http.HandleFunc(config.ServerRoute, handler)
 	log.Fatal(http.ListenAndServe(config.Server, nil))
 }
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout))
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redirectTransport sends every request to the target server, whatever host
+// it was meant for
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// fakeServices stands in for Micro.blog & Twitter, recording what was posted
+type fakeServices struct {
+	microBlog         *httptest.Server
+	twitter           *httptest.Server
+	mu                sync.Mutex
+	microBlogErr      bool
+	microBlogRequests int
+	mbPosts           []url.Values
+	tweets            []string
+}
+
+func newFakeServices(t *testing.T) *fakeServices {
+	services := &fakeServices{}
+
+	services.microBlog = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer foo-bar-42" {
+			t.Errorf("expected Micro.blog token, got %q", r.Header.Get("Authorization"))
+		}
+		services.mu.Lock()
+		services.microBlogRequests++
+		services.mu.Unlock()
+		if services.microBlogErr {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		switch r.URL.Path {
+		case "/micropub/media":
+			w.Header().Set("Location", "https://foo.micro.blog/uploads/1.jpg")
+			w.WriteHeader(http.StatusAccepted)
+		case "/micropub":
+			_ = r.ParseForm()
+			services.mu.Lock()
+			services.mbPosts = append(services.mbPosts, r.PostForm)
+			services.mu.Unlock()
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte(`{"url": "https://foo.micro.blog/2023/11/27/1.html", "preview": ""}`))
+		default:
+			t.Errorf("unexpected Micro.blog request to %s", r.URL.Path)
+		}
+	}))
+
+	services.twitter = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/1.1/media/upload.json":
+			_, _ = w.Write([]byte(`{"media_id": 710511363345354753, "media_id_string": "710511363345354753"}`))
+		case "/2/tweets":
+			var body struct{ Text string }
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			services.mu.Lock()
+			services.tweets = append(services.tweets, body.Text)
+			services.mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"data": {"id": "1445880548472328192", "text": "hi"}}`))
+		default:
+			t.Errorf("unexpected Twitter request to %s", r.URL.Path)
+		}
+	}))
+
+	twitterUrl, _ := url.Parse(services.twitter.URL)
+	twitterTransport = redirectTransport{target: twitterUrl}
+	t.Setenv("GOTWI_API_KEY", "key123")
+	t.Setenv("GOTWI_API_KEY_SECRET", "secret456")
+
+	return services
+}
+
+func (s *fakeServices) Close() {
+	s.microBlog.Close()
+	s.twitter.Close()
+	twitterTransport = nil
+}
+
+// signedRequest builds a webhook request as Twilio would send it
+func signedRequest(data url.Values) *http.Request {
+	signature := TwilioSignature(config.Twilio.AuthToken, "https://txt.example.com/txt", data)
+	r := httptest.NewRequest(http.MethodPost, "http://127.0.0.1:8088/txt", strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Twilio-Signature", signature)
+	return r
+}
+
+func setupHandlerTest(t *testing.T) *fakeServices {
+	TestMode = true
+	config = LoadConfig()
+	config.HoneybadgerAPIKey = ""
+	config.DeadLetterDir = t.TempDir()
+	useTestMediaDir(t)
+	retryPolicy = RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	services := newFakeServices(t)
+	config.MicroBlog.Endpoint = services.microBlog.URL + "/micropub"
+	publishers = ConfiguredPublishers(config)
+
+	var err error
+	dedupe, err = OpenDedupeStore(filepath.Join(t.TempDir(), "dedupe.json"), time.Hour)
+	if err != nil {
+		t.Fatalf("error opening dedupe store: %s", err)
+	}
+	archive, err = OpenArchive(filepath.Join(t.TempDir(), "archive.db"), "")
+	if err != nil {
+		t.Fatalf("error opening archive: %s", err)
+	}
+	queue, err = OpenQueue(t.TempDir())
+	if err != nil {
+		t.Fatalf("error opening queue: %s", err)
+	}
+	queue.Run(context.Background(), 1, processMessage, abandonMessage)
+
+	t.Cleanup(func() {
+		queue.Close()
+		queue = nil
+		dedupe = nil
+		archive.Close()
+		archive = nil
+		retryPolicy = defaultRetryPolicy
+		services.Close()
+		config = Config{}
+		publishers = nil
+	})
+	return services
+}
+
+func TestHandlerPostsToAllDestinations(t *testing.T) {
+	services := setupHandlerTest(t)
+
+	data := url.Values{}
+	data.Set("From", "+15125551212")
+	data.Set("Body", "just a couple bros")
+	data.Set("NumMedia", "0")
+	w := httptest.NewRecorder()
+	handler(w, signedRequest(data))
+
+	if len(services.mbPosts) != 1 {
+		t.Fatalf("expected 1 post to Micro.blog, got %d", len(services.mbPosts))
+	}
+	if services.mbPosts[0].Get("content") != "> just a couple bros\n\n&ndash; Gon" {
+		t.Errorf("unexpected Micro.blog content %q", services.mbPosts[0].Get("content"))
+	}
+	if len(services.tweets) != 1 || services.tweets[0] != "\"just a couple bros\"\n\n– Gon" {
+		t.Errorf("expected 1 tweet, got %q", services.tweets)
+	}
+
+	expected := Twiml("message posted https://foo.micro.blog/2023/11/27/1.html")
+	if w.Body.String() != expected {
+		t.Errorf("expected reply %q, got %q", expected, w.Body.String())
+	}
+
+	var phone, sender string
+	var results int
+	_ = archive.db.QueryRow("SELECT phone, sender, (SELECT count(*) FROM results) FROM messages").Scan(&phone, &sender, &results)
+	if phone != "+15125551212" || sender != "Gon" || results != 2 {
+		t.Errorf("expected the message archived with 2 results, got %q %q %d", phone, sender, results)
+	}
+}
+
+func TestHandlerReportsPartialFailure(t *testing.T) {
+	services := setupHandlerTest(t)
+	services.microBlogErr = true
+
+	data := url.Values{}
+	data.Set("From", "+15125551213")
+	data.Set("Body", "hello")
+	data.Set("NumMedia", "0")
+	w := httptest.NewRecorder()
+	handler(w, signedRequest(data))
+
+	if len(services.tweets) != 1 {
+		t.Errorf("expected Twitter to be posted to despite the Micro.blog failure")
+	}
+
+	expected := Twiml(fmt.Sprintf("message posted %s (but failed: microblog)", "https://twitter.com/i/web/status/1445880548472328192"))
+	if w.Body.String() != expected {
+		t.Errorf("expected reply %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestHandlerRepliesWithoutWaiting(t *testing.T) {
+	services := setupHandlerTest(t)
+	config.ReplyWait = -1
+
+	data := url.Values{}
+	data.Set("From", "+15125551212")
+	data.Set("Body", "hello")
+	data.Set("NumMedia", "0")
+	w := httptest.NewRecorder()
+	handler(w, signedRequest(data))
+
+	expected := Twiml("message received - it will be posted shortly")
+	if w.Body.String() != expected {
+		t.Errorf("expected reply %q, got %q", expected, w.Body.String())
+	}
+
+	// the message is still posted, in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if jobs, _ := queue.Jobs(); len(jobs) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	services.mu.Lock()
+	defer services.mu.Unlock()
+	if len(services.mbPosts) != 1 {
+		t.Errorf("expected message to be posted to Micro.blog in the background")
+	}
+}
+
+func TestHandlerIgnoresRepeatedDelivery(t *testing.T) {
+	services := setupHandlerTest(t)
+
+	data := url.Values{}
+	data.Set("MessageSid", "SM0123456789abcdef0123456789abcdef")
+	data.Set("From", "+15125551212")
+	data.Set("Body", "only once, please")
+	data.Set("NumMedia", "0")
+
+	first := httptest.NewRecorder()
+	handler(first, signedRequest(data))
+	second := httptest.NewRecorder()
+	handler(second, signedRequest(data))
+
+	if len(services.mbPosts) != 1 {
+		t.Errorf("expected 1 post to Micro.blog, got %d", len(services.mbPosts))
+	}
+	if len(services.tweets) != 1 {
+		t.Errorf("expected 1 tweet, got %d", len(services.tweets))
+	}
+
+	// the retry gets the original post's URL
+	expected := Twiml("message posted https://foo.micro.blog/2023/11/27/1.html")
+	if first.Body.String() != expected {
+		t.Errorf("expected first reply %q, got %q", expected, first.Body.String())
+	}
+	if second.Body.String() != expected {
+		t.Errorf("expected repeated reply %q, got %q", expected, second.Body.String())
+	}
+
+	// a different message is still posted
+	data.Set("MessageSid", "SM00000000000000000000000000000001")
+	handler(httptest.NewRecorder(), signedRequest(data))
+	if len(services.mbPosts) != 2 {
+		t.Errorf("expected a new MessageSid to be posted, got %d posts", len(services.mbPosts))
+	}
+}
+
+func TestHandlerRequeuesLostDelivery(t *testing.T) {
+	services := setupHandlerTest(t)
+
+	// claimed by an earlier delivery, which crashed before it was queued
+	sid := "SM0123456789abcdef0123456789abcdef"
+	dedupe.Claim(sid)
+
+	data := url.Values{}
+	data.Set("MessageSid", sid)
+	data.Set("From", "+15125551212")
+	data.Set("Body", "try again")
+	data.Set("NumMedia", "0")
+	handler(httptest.NewRecorder(), signedRequest(data))
+
+	if len(services.mbPosts) != 1 {
+		t.Errorf("expected the lost message to be posted, got %d posts", len(services.mbPosts))
+	}
+}
+
+func TestHandlerDeadLettersFailures(t *testing.T) {
+	services := setupHandlerTest(t)
+	services.microBlogErr = true
+
+	data := url.Values{}
+	data.Set("MessageSid", "SM0123456789abcdef0123456789abcdef")
+	data.Set("From", "+15125551213")
+	data.Set("Body", "hello")
+	data.Set("NumMedia", "0")
+	handler(httptest.NewRecorder(), signedRequest(data))
+
+	// a post that got a 500 might have been made anyway, so it isn't retried
+	if services.microBlogRequests != 1 {
+		t.Errorf("expected Micro.blog to be tried once, got %d", services.microBlogRequests)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(config.DeadLetterDir, "SM0123456789abcdef0123456789abcdef.json"))
+	if err != nil {
+		t.Fatalf("expected a dead letter: %s", err)
+	}
+	var letter DeadLetter
+	_ = json.Unmarshal(contents, &letter)
+	if !strings.Contains(letter.Error, "status code 500") || letter.Message.Text != "hello" {
+		t.Errorf("expected dead letter with the message & error, got %+v", letter)
+	}
+}
+
+func TestProcessMessageRemovesMedia(t *testing.T) {
+	services := setupHandlerTest(t)
+	services.microBlogErr = true // it's removed even when posting fails
+
+	image := filepath.Join(config.MediaDir, "ME456_temp-1.jpg")
+	if err := copyFile(filepath.Join("fixtures", "images", "gps.jpg"), image); err != nil {
+		t.Fatal(err)
+	}
+	message := Message{From: "Gon", Phone: "+15125551212", Text: "hi", NumImages: 1, ImageFilenames: []string{image}}
+	processMessage(context.Background(), &message)
+
+	if entries, _ := os.ReadDir(config.MediaDir); len(entries) != 0 {
+		t.Errorf("expected the media dir emptied, got %v", entries)
+	}
+	// but the dead letter has a copy
+	if entries, _ := filepath.Glob(filepath.Join(config.DeadLetterDir, "*.jpg")); len(entries) != 1 {
+		t.Errorf("expected the dead letter to keep the picture, got %v", entries)
+	}
+}
+
+func TestAbandonMessage(t *testing.T) {
+	setupHandlerTest(t)
+	message := Message{MessageSid: "SM0123456789abcdef0123456789abcdef", From: "Gon", Text: "hi"}
+	abandonMessage(&message, fmt.Errorf("job %s panicked: a bad picture", message.MessageSid))
+
+	// it's saved to replay, & a repeated delivery isn't posted again
+	letter, err := LoadDeadLetter(config.DeadLetterDir, message.MessageSid)
+	if err != nil {
+		t.Fatalf("expected a dead letter: %s", err)
+	}
+	if !strings.Contains(letter.Error, "a bad picture") || letter.Message.Text != "hi" {
+		t.Errorf("expected the message & why it was given up on saved, got %+v", letter)
+	}
+	if seen, isNew := dedupe.Claim(message.MessageSid); isNew || seen.Finished.IsZero() {
+		t.Errorf("expected the message marked finished, got %+v", seen)
+	}
+}
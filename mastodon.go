@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+func init() {
+	RegisterPublisher("mastodon", 30, func(config Config) Publisher {
+		if config.Mastodon == (MastodonConfig{}) {
+			return nil
+		}
+		return &MastodonPublisher{config: config.Mastodon, template: config.postTemplate("mastodon", plainPostTemplate)}
+	})
+}
+
+// MastodonPublisher posts messages as statuses on a Mastodon account.
+type MastodonPublisher struct {
+	config   MastodonConfig
+	template *PostTemplate
+}
+
+func (p *MastodonPublisher) Name() string {
+	return "mastodon"
+}
+
+// Enabled only posts test messages to a test account (& real messages to the
+// real account), like Twitter
+func (p *MastodonPublisher) Enabled(message *Message) bool {
+	return IsTestMessage(message) == p.config.TestAccount
+}
+
+// send makes an authorized request to the Mastodon API, retrying per the
+// retryPolicy, and decodes the JSON response into out
+func (p *MastodonPublisher) send(ctx context.Context, what string, path string, contentType string, body []byte, headers map[string]string, out interface{}) error {
+	endpoint := strings.TrimSuffix(p.config.Server, "/") + path
+	return retryPolicy.Do(ctx, what, func() error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return Permanent(err)
+		}
+		request.Header.Set("Authorization", "Bearer "+p.config.AccessToken)
+		request.Header.Set("Content-Type", contentType)
+		for key, value := range headers {
+			request.Header.Set(key, value)
+		}
+
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err = checkStatus("Mastodon", resp); err != nil {
+			return err
+		}
+		return Permanent(json.NewDecoder(resp.Body).Decode(out))
+	})
+}
+
+// mastodonImageLimits is the pictures Mastodon takes, up to its default 16MB
+// (it shrinks big ones itself, but not past that)
+var mastodonImageLimits = ImageLimits{Types: webImageTypes, MaxBytes: 16 << 20, MaxSide: 4096}
+
+// mastodonMaxImages is the most attachments a status can have; Mastodon
+// rejects more (& an MMS can carry 10)
+const mastodonMaxImages = 4
+
+// uploadMedia uploads a file, with alt text, returning its media ID
+func (p *MastodonPublisher) uploadMedia(ctx context.Context, media MediaFile, description string) (string, error) {
+	filename := media.Filename
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	fw, err := createFormFile(writer, "file", media)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(fw, file); err != nil {
+		return "", err
+	}
+	_ = writer.WriteField("description", description)
+	_ = writer.Close()
+
+	var uploaded struct {
+		ID string
+	}
+	err = p.send(ctx, "uploading "+filename+" to Mastodon", "/api/v2/media", writer.FormDataContentType(), body.Bytes(), nil, &uploaded)
+	if err != nil {
+		return "", err
+	}
+	return uploaded.ID, nil
+}
+
+// UploadMedia uploads each of the Message's images to Mastodon, returning
+// their media IDs. Pictures are converted or shrunk for Mastodon if need be,
+// & files of other types skipped.
+func (p *MastodonPublisher) UploadMedia(ctx context.Context, message *Message) ([]string, error) {
+	var mediaIds []string
+	files, remove := message.prepareMedia("Mastodon", mastodonImageLimits)
+	defer remove()
+	if len(files) > mastodonMaxImages {
+		for _, file := range files[mastodonMaxImages:] {
+			log.Printf("Mastodon allows only %d images per status; skipping %q\n", mastodonMaxImages, file.Filename)
+		}
+		files = files[:mastodonMaxImages]
+	}
+	for i, file := range files {
+		filename := file.Filename
+		description := fmt.Sprintf("picture %d of %d texted by %s", i+1, len(files), message.From)
+		mediaId, err := p.uploadMedia(ctx, file, description)
+		if err != nil {
+			log.Printf("error uploading %q to Mastodon: %s", filename, err)
+			return mediaIds, err
+		}
+		log.Printf("uploaded image %q to Mastodon, got media ID %q\n", filename, mediaId)
+		mediaIds = append(mediaIds, mediaId)
+	}
+	return mediaIds, nil
+}
+
+// Publish posts a status with the Message's text & already-uploaded media,
+// returning the URL of the status.
+func (p *MastodonPublisher) Publish(ctx context.Context, message *Message, mediaIds []string) (string, error) {
+	text, err := p.template.or(plainPostTemplate).Format(message)
+	if err != nil {
+		return "", Permanent(err)
+	}
+	data := url.Values{}
+	data.Set("status", text)
+	if p.config.Visibility != "" {
+		data.Set("visibility", p.config.Visibility)
+	}
+	for _, mediaId := range mediaIds {
+		data.Add("media_ids[]", mediaId)
+	}
+
+	// makes retries safe: Mastodon won't post the same key twice
+	headers := map[string]string{}
+	if message.MessageSid != "" {
+		headers["Idempotency-Key"] = "txt2mary-" + message.MessageSid
+	}
+
+	var status struct {
+		ID  string
+		URL string
+	}
+	err = p.send(ctx, "posting to Mastodon", "/api/v1/statuses", "application/x-www-form-urlencoded", []byte(data.Encode()), headers, &status)
+	if err != nil {
+		log.Printf("error posting to Mastodon: %s", err)
+		return "", err
+	}
+	log.Printf("posted message to Mastodon\n")
+	return status.URL, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMastodon stands in for a Mastodon server's API, recording what was
+// uploaded & posted
+type fakeMastodon struct {
+	*httptest.Server
+	mu           sync.Mutex
+	descriptions []string
+	types        []string // of the uploads
+	statuses     []*http.Request
+	status       int // if set, the status code statuses get
+}
+
+func newFakeMastodon(t *testing.T) *fakeMastodon {
+	fake := &fakeMastodon{}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		switch r.URL.Path {
+		case "/api/v2/media":
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Errorf("error parsing media upload: %s", err)
+			}
+			if _, header, err := r.FormFile("file"); err != nil {
+				t.Errorf("expected a file in the media upload: %s", err)
+			} else {
+				fake.types = append(fake.types, header.Header.Get("Content-Type"))
+			}
+			fake.descriptions = append(fake.descriptions, r.FormValue("description"))
+			_, _ = fmt.Fprintf(w, `{"id": "media%d", "type": "image"}`, len(fake.descriptions))
+		case "/api/v1/statuses":
+			if fake.status != 0 {
+				w.WriteHeader(fake.status)
+				return
+			}
+			_ = r.ParseForm()
+			fake.statuses = append(fake.statuses, r)
+			_, _ = w.Write([]byte(`{"id": "109", "url": "https://mastodon.example/@mary/109"}`))
+		default:
+			t.Errorf("unexpected Mastodon request to %s", r.URL.Path)
+		}
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func TestMastodonPublisher(t *testing.T) {
+	fake := newFakeMastodon(t)
+	publisher := &MastodonPublisher{config: MastodonConfig{Server: fake.URL + "/", AccessToken: "token123", Visibility: "unlisted"}}
+
+	image := filepath.Join(t.TempDir(), "ME456_temp.jpg")
+	_ = os.WriteFile(image, []byte("jpeg"), 0600)
+	message := Message{MessageSid: "SM0123", From: "Gon", Text: "hello", NumImages: 1, ImageFilenames: []string{image}}
+
+	result := publish(context.Background(), publisher, &message, defaultPublishTimeout)
+	if result.Err != nil {
+		t.Fatalf("expected no error, got %q", result.Err)
+	}
+	if result.URL != "https://mastodon.example/@mary/109" {
+		t.Errorf("expected status URL, got %q", result.URL)
+	}
+
+	if len(fake.descriptions) != 1 || fake.descriptions[0] != "picture 1 of 1 texted by Gon" {
+		t.Errorf("expected 1 image with alt text, got %q", fake.descriptions)
+	}
+	if len(fake.statuses) != 1 {
+		t.Fatalf("expected 1 status, got %d", len(fake.statuses))
+	}
+	status := fake.statuses[0]
+	if status.PostForm.Get("status") != "\"hello\"\n\n– Gon" {
+		t.Errorf("unexpected status text %q", status.PostForm.Get("status"))
+	}
+	if status.PostForm.Get("visibility") != "unlisted" {
+		t.Errorf("expected unlisted visibility, got %q", status.PostForm.Get("visibility"))
+	}
+	if ids := status.PostForm["media_ids[]"]; len(ids) != 1 || ids[0] != "media1" {
+		t.Errorf("expected media ID to be attached, got %v", ids)
+	}
+	if status.Header.Get("Idempotency-Key") != "txt2mary-SM0123" {
+		t.Errorf("expected Idempotency-Key header, got %q", status.Header.Get("Idempotency-Key"))
+	}
+}
+
+func TestMastodonMaxImages(t *testing.T) {
+	fake := newFakeMastodon(t)
+	publisher := &MastodonPublisher{config: MastodonConfig{Server: fake.URL + "/", AccessToken: "token123"}}
+
+	// an MMS can carry 10, but a status only 4
+	images := writeTestImages(t, 10, 10, 10, 10, 10, 10)
+	message := Message{From: "Gon", Text: "hello", NumImages: len(images), ImageFilenames: images}
+	result := publish(context.Background(), publisher, &message, defaultPublishTimeout)
+	if result.Err != nil {
+		t.Fatalf("expected no error, got %q", result.Err)
+	}
+	if len(result.Media) != mastodonMaxImages || len(fake.descriptions) != mastodonMaxImages {
+		t.Errorf("expected %d images uploaded, got %v", mastodonMaxImages, result.Media)
+	}
+	if fake.descriptions[0] != "picture 1 of 4 texted by Gon" {
+		t.Errorf("unexpected alt text %q", fake.descriptions[0])
+	}
+	if ids := fake.statuses[0].PostForm["media_ids[]"]; len(ids) != mastodonMaxImages {
+		t.Errorf("expected %d media IDs attached, got %v", mastodonMaxImages, ids)
+	}
+}
+
+func TestMastodonPublisherErrors(t *testing.T) {
+	retryPolicy = fastRetries
+	defer func() { retryPolicy = defaultRetryPolicy }()
+	fake := newFakeMastodon(t)
+
+	var tests = []struct {
+		token    string
+		status   int
+		expected string
+	}{
+		{token: "wrong", expected: "uploading"},
+		{token: "token123", status: http.StatusUnprocessableEntity, expected: "got status code 422 from Mastodon"},
+		{token: "token123", status: http.StatusServiceUnavailable, expected: "posting to Mastodon failed after 3 tries: got status code 503 from Mastodon"},
+	}
+
+	for _, test := range tests {
+		fake.status = test.status
+		publisher := &MastodonPublisher{config: MastodonConfig{Server: fake.URL, AccessToken: test.token}}
+		image := filepath.Join(t.TempDir(), "ME456_temp.jpg")
+		_ = os.WriteFile(image, []byte("jpeg"), 0600)
+		message := Message{From: "Gon", Text: "hello", ImageFilenames: []string{image}}
+
+		result := publish(context.Background(), publisher, &message, defaultPublishTimeout)
+		if result.Err == nil {
+			t.Errorf("expected an error for %+v", test)
+			continue
+		}
+		if !strings.Contains(result.Err.Error(), test.expected) {
+			t.Errorf("expected error containing %q, got %q", test.expected, result.Err)
+		}
+	}
+}
+
+func TestMastodonEnabled(t *testing.T) {
+	var tests = []struct {
+		testAccount bool
+		text        string
+		expected    bool
+	}{
+		{testAccount: false, text: "hello", expected: true},
+		{testAccount: false, text: "TEST: hello", expected: false},
+		{testAccount: true, text: "TEST: hello", expected: true},
+		{testAccount: true, text: "hello", expected: false},
+	}
+
+	for _, test := range tests {
+		publisher := &MastodonPublisher{config: MastodonConfig{TestAccount: test.testAccount}}
+		if publisher.Enabled(&Message{Text: test.text}) != test.expected {
+			t.Errorf("Enabled(%q) with TestAccount %v != %v", test.text, test.testAccount, test.expected)
+		}
+	}
+}
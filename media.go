@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// unknownMediaType is the type of a file nothing could be worked out about
+const unknownMediaType = "application/octet-stream"
+
+// mediaSniffLength is how much of a file is looked at to tell what it is
+const mediaSniffLength = 512
+
+// mediaExtensions is the file extension for each media type a message might
+// have: MMS carries pictures, video, audio, & contact cards
+var mediaExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/bmp":       ".bmp",
+	"image/heic":      ".heic",
+	"image/heif":      ".heif",
+	"image/avif":      ".avif",
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+	"video/3gpp":      ".3gp",
+	"video/3gpp2":     ".3g2",
+	"video/webm":      ".webm",
+	"audio/amr":       ".amr",
+	"audio/mpeg":      ".mp3",
+	"audio/mp4":       ".m4a",
+	"audio/ogg":       ".ogg",
+	"audio/wave":      ".wav",
+	"text/vcard":      ".vcf",
+	"text/x-vcard":    ".vcf",
+	"text/calendar":   ".ics",
+	"application/pdf": ".pdf",
+}
+
+// ftypBrands is the media type of each ISO base media file (the format of
+// HEIC pictures & most phones' video) by its major brand, for those
+// http.DetectContentType doesn't know
+var ftypBrands = map[string]string{
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"hevc": "image/heic",
+	"hevx": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+	"avif": "image/avif",
+	"qt  ": "video/quicktime",
+	"isom": "video/mp4",
+	"iso2": "video/mp4",
+	"M4V ": "video/mp4",
+	"M4A ": "audio/mp4",
+	"3gp4": "video/3gpp",
+	"3gp5": "video/3gpp",
+	"3gp6": "video/3gpp",
+	"3g2a": "video/3gpp2",
+}
+
+// baseMediaType returns the media type without any parameters, in lower
+// case, e.g. "text/plain" for "text/plain; charset=utf-8"
+func baseMediaType(mediaType string) string {
+	mediaType, _, _ = strings.Cut(mediaType, ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+// sniffMediaType tells what a file is from its first bytes, returning "" if
+// they don't say (as plain text doesn't)
+func sniffMediaType(head []byte) string {
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		if mediaType, ok := ftypBrands[string(head[8:12])]; ok {
+			return mediaType
+		}
+	}
+	text := bytes.ToUpper(bytes.TrimLeft(head, "\ufeff \t\r\n"))
+	switch {
+	case bytes.HasPrefix(text, []byte("BEGIN:VCARD")):
+		return "text/vcard"
+	case bytes.HasPrefix(text, []byte("BEGIN:VCALENDAR")):
+		return "text/calendar"
+	}
+	detected := baseMediaType(http.DetectContentType(head))
+	if _, ok := mediaExtensions[detected]; !ok {
+		return ""
+	}
+	return detected
+}
+
+// detectMediaType works out a file's media type from its first bytes, or
+// else from the first of the types it was declared as (e.g. by Twilio's
+// MediaContentType0, or its file extension) that's given
+func detectMediaType(head []byte, declared ...string) string {
+	if sniffed := sniffMediaType(head); sniffed != "" {
+		return sniffed
+	}
+	for _, mediaType := range declared {
+		if mediaType = baseMediaType(mediaType); mediaType != "" && mediaType != unknownMediaType {
+			return mediaType
+		}
+	}
+	return unknownMediaType
+}
+
+// mediaExtension returns the file extension for the media type
+func mediaExtension(mediaType string) string {
+	if ext, ok := mediaExtensions[baseMediaType(mediaType)]; ok {
+		return ext
+	}
+	return ".bin"
+}
+
+// fileMediaType works out a file's media type from its contents, or else its
+// extension
+func fileMediaType(filename string) string {
+	head := make([]byte, mediaSniffLength)
+	file, err := os.Open(filename)
+	if err != nil {
+		return unknownMediaType
+	}
+	defer file.Close()
+	n, _ := io.ReadFull(file, head)
+	return detectMediaType(head[:n], mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))))
+}
+
+// MediaType returns the media type of the Message's i'th downloaded file: the
+// one found when it was downloaded, or else what the file looks like (as for
+// pictures given to `txt2mary post`)
+func (m *Message) MediaType(i int) string {
+	if i < len(m.MediaTypes) && m.MediaTypes[i] != "" {
+		return m.MediaTypes[i]
+	}
+	if i < len(m.ImageFilenames) {
+		return fileMediaType(m.ImageFilenames[i])
+	}
+	return unknownMediaType
+}
+
+// mediaTypeSet is the media types a destination can post
+type mediaTypeSet map[string]bool
+
+func newMediaTypeSet(mediaTypes ...string) mediaTypeSet {
+	set := make(mediaTypeSet)
+	for _, mediaType := range mediaTypes {
+		set[mediaType] = true
+	}
+	return set
+}
+
+// isVideo reports whether the media type is a video's
+func isVideo(mediaType string) bool {
+	return strings.HasPrefix(baseMediaType(mediaType), "video/")
+}
+
+// isHEIC reports whether the media type is HEIC's, or HEIF's, which it's a
+// kind of
+func isHEIC(mediaType string) bool {
+	mediaType = baseMediaType(mediaType)
+	return mediaType == "image/heic" || mediaType == "image/heif"
+}
+
+// webImageTypes is the pictures every destination can show
+var webImageTypes = newMediaTypeSet("image/jpeg", "image/png", "image/gif", "image/webp")
+
+// MediaFile is a downloaded file & its media type
+type MediaFile struct {
+	Filename string
+	Type     string
+}
+
+// createFormFile is like multipart.Writer's CreateFormFile, but gives the
+// file's media type, not application/octet-stream
+func createFormFile(writer *multipart.Writer, fieldname string, file MediaFile) (io.Writer, error) {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, fieldname, filepath.Base(file.Filename)))
+	header.Set("Content-Type", file.Type)
+	return writer.CreatePart(header)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectMediaType(t *testing.T) {
+	var tests = []struct {
+		contents string
+		declared []string
+		expected string
+	}{
+		{contents: testMedia["jpeg"], expected: "image/jpeg"},
+		{contents: testMedia["png"], declared: []string{"image/jpeg"}, expected: "image/png"},
+		{contents: testMedia["gif"], expected: "image/gif"},
+		{contents: testMedia["heic"], expected: "image/heic"},
+		{contents: testMedia["mp4"], expected: "video/mp4"},
+		{contents: testMedia["mov"], expected: "video/quicktime"},
+		{contents: testMedia["3gp"], expected: "video/3gpp"},
+		{contents: testMedia["vcard"], declared: []string{"text/x-vcard"}, expected: "text/vcard"},
+		{contents: "\ufeffbegin:vcard\r\n", expected: "text/vcard"},
+		{contents: testMedia["amr"], declared: []string{"audio/amr"}, expected: "audio/amr"},
+		{contents: "who knows", declared: []string{"", "Image/HEIF; q=1"}, expected: "image/heif"},
+		{contents: "who knows", declared: []string{"application/octet-stream"}, expected: "application/octet-stream"},
+		{contents: "", expected: "application/octet-stream"},
+	}
+	for _, test := range tests {
+		if actual := detectMediaType([]byte(test.contents), test.declared...); actual != test.expected {
+			t.Errorf("detectMediaType(%q, %q) = %q; expected %q", test.contents, test.declared, actual, test.expected)
+		}
+	}
+}
+
+func TestMediaExtension(t *testing.T) {
+	var tests = map[string]string{
+		"image/jpeg":               ".jpg",
+		"image/heic":               ".heic",
+		"video/quicktime":          ".mov",
+		"text/vcard":               ".vcf",
+		"text/x-vcard":             ".vcf",
+		"IMAGE/PNG; charset=x":     ".png",
+		"application/octet-stream": ".bin",
+		"application/x-unheard-of": ".bin",
+	}
+	for mediaType, expected := range tests {
+		if actual := mediaExtension(mediaType); actual != expected {
+			t.Errorf("mediaExtension(%q) = %q; expected %q", mediaType, actual, expected)
+		}
+	}
+}
+
+// writeTestMedia writes files of the given testMedia types, named for the
+// type, returning their names
+func writeTestMedia(t *testing.T, kinds ...string) []string {
+	dir := t.TempDir()
+	var filenames []string
+	for _, kind := range kinds {
+		filename := filepath.Join(dir, "ME_"+kind+".dat")
+		if err := os.WriteFile(filename, []byte(testMedia[kind]), 0600); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+	return filenames
+}
+
+func TestMessageMediaType(t *testing.T) {
+	filenames := writeTestMedia(t, "png", "vcard", "mov")
+	jpeg := filepath.Join(t.TempDir(), "ME456_temp.jpg")
+	_ = os.WriteFile(jpeg, []byte("jpeg"), 0600) // which only its name says
+	message := Message{
+		ImageFilenames: append(filenames, jpeg, filepath.Join(t.TempDir(), "missing.png")),
+		MediaTypes:     []string{"image/gif"},
+	}
+
+	expected := []string{"image/gif", "text/vcard", "video/quicktime", "image/jpeg", "application/octet-stream", "application/octet-stream"}
+	for i, mediaType := range expected {
+		if actual := message.MediaType(i); actual != mediaType {
+			t.Errorf("MediaType(%d) = %q; expected %q", i, actual, mediaType)
+		}
+	}
+
+	files, remove := message.prepareMedia("Somewhere", ImageLimits{Types: newMediaTypeSet("image/gif", "image/jpeg")})
+	defer remove()
+	if len(files) != 2 || files[0] != (MediaFile{Filename: filenames[0], Type: "image/gif"}) || files[1] != (MediaFile{Filename: jpeg, Type: "image/jpeg"}) {
+		t.Errorf("expected only the pictures, got %+v", files)
+	}
+}
+
+func TestPublishersSkipMediaTypes(t *testing.T) {
+	fake := newFakeMastodon(t)
+	publisher := &MastodonPublisher{config: MastodonConfig{Server: fake.URL + "/", AccessToken: "token123"}}
+	filenames := writeTestMedia(t, "vcard", "png", "mov", "heic")
+	message := Message{From: "Gon", Text: "hello", NumImages: 4, ImageFilenames: filenames,
+		MediaTypes: []string{"text/vcard", "image/png", "video/quicktime", "image/heic"}}
+
+	mediaIds, err := publisher.UploadMedia(context.Background(), &message)
+	if err != nil || len(mediaIds) != 1 {
+		t.Fatalf("expected only the PNG uploaded, got %q (%v)", mediaIds, err)
+	}
+	if fake.types[0] != "image/png" {
+		t.Errorf("expected the upload to say it's a PNG, got %q", fake.types[0])
+	}
+	if fake.descriptions[0] != "picture 1 of 1 texted by Gon" {
+		t.Errorf("expected the skipped files left out of the alt text, got %q", fake.descriptions[0])
+	}
+
+	message.ImageFilenames, message.MediaTypes = filenames[:1], message.MediaTypes[:1]
+	if mediaIds, err = publisher.UploadMedia(context.Background(), &message); err != nil || len(mediaIds) != 0 {
+		t.Errorf("expected nothing uploaded for a contact card, got %q (%v)", mediaIds, err)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// strippedImageQuality is the JPEG quality a sideways picture is saved at,
+// once it's been turned upright
+const strippedImageQuality = 92
+
+// errMetadataKept is the error for a file that might say where it was taken,
+// like a picture that can't be read or a WebM video, which can't be stripped
+var errMetadataKept = errors.New("its metadata, which could say where it was taken, can't be removed")
+
+// stripImageMetadata removes the metadata from the Message's pictures, in
+// place, before any destination (or the archive) sees them: EXIF & XMP can
+// say where a picture was taken, down to someone's front door. Pictures stored
+// sideways are turned upright, since that's all their EXIF was needed for, &
+// pictures of other formats that can be read are converted to JPEG. Videos
+// lose their metadata too, & files that can't be stripped are withheld from
+// the Message.
+func (m *Message) stripImageMetadata() error {
+	for i := 0; i < len(m.ImageFilenames); {
+		filename, mediaType := m.ImageFilenames[i], m.MediaType(i)
+		stripped, strippedType, err := stripMetadata(filename, mediaType)
+		if errors.Is(err, errMetadataKept) {
+			log.Printf("WARNING: not posting or archiving %q (%s), since %s\n", filename, mediaType, err)
+			m.withholdMedia(i)
+			continue
+		}
+		if err != nil {
+			log.Printf("error removing the metadata from %q: %s", filename, err)
+			return err
+		}
+		if stripped != filename {
+			m.ImageFilenames[i] = stripped
+			for len(m.MediaTypes) <= i {
+				m.MediaTypes = append(m.MediaTypes, "")
+			}
+			m.MediaTypes[i] = strippedType
+		}
+		i++
+	}
+	return nil
+}
+
+// withholdMedia deletes the Message's ith file, & takes it out of the
+// Message, as if it had never been sent, but for noting its type in Withheld
+func (m *Message) withholdMedia(i int) {
+	m.Withheld = append(m.Withheld, m.MediaType(i))
+	if err := os.Remove(m.ImageFilenames[i]); err != nil {
+		log.Printf("error removing file %q: %s\n", m.ImageFilenames[i], err)
+	}
+	m.ImageFilenames = append(m.ImageFilenames[:i], m.ImageFilenames[i+1:]...)
+	if i < len(m.MediaTypes) {
+		m.MediaTypes = append(m.MediaTypes[:i], m.MediaTypes[i+1:]...)
+	}
+	if i < len(m.TwilioImageURLs) {
+		m.TwilioImageURLs = append(m.TwilioImageURLs[:i], m.TwilioImageURLs[i+1:]...)
+	}
+	if m.NumImages > 0 {
+		m.NumImages--
+	}
+}
+
+// mp4VideoTypes is the types of video made of MP4 boxes, which
+// stripMP4Metadata can take the metadata out of
+var mp4VideoTypes = newMediaTypeSet("video/mp4", "video/quicktime", "video/3gpp", "video/3gpp2")
+
+// stripMetadata removes the metadata from the picture or video, returning its
+// name & type, which change if it had to be converted to be stripped.
+// Pictures & videos that can't be read get errMetadataKept.
+func stripMetadata(filename string, mediaType string) (string, string, error) {
+	if isVideo(mediaType) {
+		if !mp4VideoTypes[baseMediaType(mediaType)] {
+			return filename, mediaType, errMetadataKept
+		}
+		if err := stripMP4Metadata(filename); err != nil {
+			return filename, mediaType, fmt.Errorf("%w (%s)", errMetadataKept, err)
+		}
+		return filename, mediaType, nil
+	}
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return filename, mediaType, err
+	}
+
+	var stripped []byte
+	switch mediaType {
+	case "image/jpeg":
+		stripped, err = stripJPEGMetadata(contents)
+	case "image/png":
+		stripped, err = stripPNGMetadata(contents)
+	case "image/webp":
+		if orientation := webpOrientation(contents); orientation != 1 {
+			// there's no WebP encoder to turn it upright with
+			return convertToJPEG(filename, contents, orientation)
+		}
+		stripped, err = stripWebPMetadata(contents)
+	case "image/gif", "image/bmp":
+		return filename, mediaType, nil // no EXIF
+	default:
+		if isHEIC(mediaType) && !heicSupported {
+			// it can't be converted, but its EXIF & XMP can be blanked out
+			if err = stripHEICMetadata(filename); err != nil {
+				return filename, mediaType, fmt.Errorf("%w (%s)", errMetadataKept, err)
+			}
+			return filename, mediaType, nil
+		}
+		// HEIC (if it can be read), TIFF, & the like keep EXIF in ways that
+		// aren't worth taking apart, so they're converted
+		if _, _, err = image.DecodeConfig(bytes.NewReader(contents)); err != nil {
+			if strings.HasPrefix(baseMediaType(mediaType), "image/") {
+				return filename, mediaType, errMetadataKept
+			}
+			return filename, mediaType, nil // not a picture
+		}
+		return convertToJPEG(filename, contents, 1)
+	}
+	if err != nil {
+		return filename, mediaType, err
+	}
+	if bytes.Equal(stripped, contents) {
+		return filename, mediaType, nil
+	}
+	return filename, mediaType, writeFileAtomic(filename, stripped)
+}
+
+// convertToJPEG saves the picture as a JPEG alongside the original, which is
+// removed, turned upright from its EXIF orientation, returning the JPEG's name
+func convertToJPEG(filename string, contents []byte, orientation int) (string, string, error) {
+	picture, _, err := image.Decode(bytes.NewReader(contents))
+	if err != nil {
+		return filename, "", err
+	}
+	picture = orientImage(picture, orientation)
+	var encoded bytes.Buffer
+	if err = jpeg.Encode(&encoded, resizeImage(picture, picture.Bounds().Dx(), picture.Bounds().Dy()), &jpeg.Options{Quality: strippedImageQuality}); err != nil {
+		return filename, "", err
+	}
+	converted := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".jpg"
+	if err = writeFileAtomic(converted, encoded.Bytes()); err != nil {
+		return filename, "", err
+	}
+	if err = os.Remove(filename); err != nil {
+		log.Printf("error removing file %q: %s\n", filename, err)
+	}
+	return converted, "image/jpeg", nil
+}
+
+// keptJPEGSegment reports whether a JPEG marker segment is kept: the ones
+// that describe the picture (e.g. its colour profile) are, & the ones
+// describing where & how it was taken (EXIF, XMP, IPTC, comments) aren't
+func keptJPEGSegment(marker byte, data []byte) bool {
+	switch {
+	case marker == 0xE2: // ICC profiles are kept; FlashPix & the like aren't
+		return bytes.HasPrefix(data, []byte("ICC_PROFILE\x00"))
+	case marker == 0xEE: // Adobe's says how the colours are stored
+		return bytes.HasPrefix(data, []byte("Adobe"))
+	case marker == 0xE0: // JFIF
+		return true
+	case marker >= 0xE1 && marker <= 0xEF, marker == 0xFE:
+		return false
+	}
+	return true
+}
+
+// stripJPEGMetadata removes a JPEG's metadata segments, without re-encoding
+// it, unless its EXIF says it's sideways, in which case it's turned upright
+// (if it can be read)
+func stripJPEGMetadata(contents []byte) ([]byte, error) {
+	if orientation := jpegOrientation(contents); orientation != 1 {
+		if picture, err := jpeg.Decode(bytes.NewReader(contents)); err == nil {
+			var encoded bytes.Buffer
+			err = jpeg.Encode(&encoded, orientImage(picture, orientation), &jpeg.Options{Quality: strippedImageQuality})
+			return encoded.Bytes(), err
+		}
+	}
+
+	segments := jpegSegments(contents)
+	if segments == nil {
+		return contents, nil // not a JPEG after all
+	}
+	stripped := append([]byte{}, contents[:2]...)
+	for _, segment := range segments {
+		if keptJPEGSegment(segment.marker, segment.data(contents)) {
+			stripped = append(stripped, contents[segment.start:segment.end]...)
+		}
+	}
+	end := 2
+	if len(segments) > 0 {
+		end = segments[len(segments)-1].end
+	}
+	return append(stripped, contents[end:]...), nil
+}
+
+// strippedPNGChunks is the PNG chunks of metadata: EXIF, text (which is where
+// XMP goes), & when it was last changed
+var strippedPNGChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripPNGMetadata removes a PNG's metadata chunks, turning it upright first
+// if it has EXIF saying it's sideways
+func stripPNGMetadata(contents []byte) ([]byte, error) {
+	if !bytes.HasPrefix(contents, pngSignature) {
+		return contents, nil
+	}
+	stripped := append([]byte{}, pngSignature...)
+	orientation := 1
+	for i := len(pngSignature); i+12 <= len(contents); {
+		length := int(binary.BigEndian.Uint32(contents[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(contents) {
+			return nil, errors.New("the PNG is truncated")
+		}
+		kind := string(contents[i+4 : i+8])
+		if kind == "eXIf" {
+			if value, ok := tiffShort(contents[i+8:i+8+length], exifOrientationTag); ok && value >= 1 && value <= 8 {
+				orientation = int(value)
+			}
+		}
+		if !strippedPNGChunks[kind] {
+			stripped = append(stripped, contents[i:end]...)
+		}
+		i = end
+	}
+	if orientation == 1 {
+		return stripped, nil
+	}
+
+	picture, err := png.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		return nil, err
+	}
+	var encoded bytes.Buffer
+	err = png.Encode(&encoded, orientImage(picture, orientation))
+	return encoded.Bytes(), err
+}
+
+// stripWebPMetadata removes a WebP's EXIF & XMP chunks, & the flags saying
+// it has them. It's only for upright WebPs, since there's no WebP encoder to
+// turn one upright with.
+func stripWebPMetadata(contents []byte) ([]byte, error) {
+	if len(contents) < 12 || string(contents[:4]) != "RIFF" || string(contents[8:12]) != "WEBP" {
+		return contents, nil
+	}
+	stripped := append([]byte{}, contents[:12]...)
+	for i := 12; i+8 <= len(contents); {
+		kind := string(contents[i : i+4])
+		length := int(binary.LittleEndian.Uint32(contents[i+4:]))
+		end := i + 8 + length + length%2 // chunks are padded to an even length
+		if end > len(contents) {
+			if i+8+length != len(contents) {
+				return nil, errors.New("the WebP is truncated")
+			}
+			end = len(contents)
+		}
+		switch kind {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte{}, contents[i:end]...)
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04 // the EXIF & XMP flags
+			}
+			stripped = append(stripped, chunk...)
+		default:
+			stripped = append(stripped, contents[i:end]...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(stripped[4:], uint32(len(stripped)-8))
+	return stripped, nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"golang.org/x/image/tiff"
+	"image/color"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// gpsLatitude is the start of the fixtures' GPS latitude, 30° as a rational
+var gpsLatitude = []byte("\x00\x00\x00\x1e\x00\x00\x00\x01")
+
+// expectNoMetadata fails the test if the picture still says where it was taken
+func expectNoMetadata(t *testing.T, name string, contents []byte) {
+	t.Helper()
+	for _, metadata := range []string{"Exif\x00\x00", "http://ns.adobe.com", "30.27N", string(gpsLatitude)} {
+		if bytes.Contains(contents, []byte(metadata)) {
+			t.Errorf("expected %q removed from %s", metadata, name)
+		}
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	var tests = []struct {
+		name      string
+		mediaType string
+		width     int
+		height    int
+	}{
+		{name: "gps.jpg", mediaType: "image/jpeg", width: 40, height: 20},
+		{name: "gps-rotated.jpg", mediaType: "image/jpeg", width: 20, height: 40},
+		{name: "gps.png", mediaType: "image/png", width: 30, height: 30},
+		{name: "gps.webp", mediaType: "image/webp", width: 150, height: 100},
+	}
+	for _, test := range tests {
+		original := copyFixtureImage(t, test.name)
+		if !bytes.Contains(mustReadFile(t, original), gpsLatitude) {
+			t.Fatalf("expected the %s fixture to have GPS", test.name)
+		}
+
+		filename, mediaType, err := stripMetadata(original, test.mediaType)
+		if err != nil {
+			t.Errorf("expected the metadata removed from %s, got %s", test.name, err)
+			continue
+		}
+		if filename != original || mediaType != test.mediaType {
+			t.Errorf("expected %s stripped in place, got %s (%s)", test.name, filename, mediaType)
+		}
+		expectNoMetadata(t, test.name, mustReadFile(t, filename))
+		picture, _ := decodeTestImage(t, filename)
+		if size := picture.Bounds().Size(); size.X != test.width || size.Y != test.height {
+			t.Errorf("expected %s to be %dx%d, got %dx%d", test.name, test.width, test.height, size.X, size.Y)
+		}
+	}
+}
+
+func TestStripJPEGMetadataOrientation(t *testing.T) {
+	filename := copyFixtureImage(t, "gps-rotated.jpg")
+	if _, _, err := stripMetadata(filename, "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	// stored on its side, red on the left; upright, red is on top
+	picture, _ := decodeTestImage(t, filename)
+	if r, _, b, _ := picture.At(10, 5).RGBA(); r < 0xc000 || b > 0x4000 {
+		t.Errorf("expected red at the top, got %v", picture.At(10, 5))
+	}
+	if jpegExif(mustReadFile(t, filename)) != nil {
+		t.Errorf("expected no EXIF left")
+	}
+}
+
+func TestStripWebPMetadataOrientation(t *testing.T) {
+	original := copyFixtureImage(t, "gps-rotated.webp")
+	filename, mediaType, err := stripMetadata(original, "image/webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename != filepath.Join(filepath.Dir(original), "gps-rotated.jpg") || mediaType != "image/jpeg" {
+		t.Fatalf("expected the sideways WebP converted to a JPEG, got %s (%s)", filename, mediaType)
+	}
+	expectNoMetadata(t, "the rotated WebP", mustReadFile(t, filename))
+
+	// stored on its side, darker on the left; upright, that's the top
+	picture, _ := decodeTestImage(t, filename)
+	if size := picture.Bounds().Size(); size.X != 100 || size.Y != 150 {
+		t.Fatalf("expected it turned to 100x150, got %dx%d", size.X, size.Y)
+	}
+	top, _, _, _ := color.GrayModel.Convert(picture.At(50, 5)).RGBA()
+	bottom, _, _, _ := color.GrayModel.Convert(picture.At(50, 145)).RGBA()
+	if top+0x3000 > bottom {
+		t.Errorf("expected the top darker than the bottom, got %v & %v", picture.At(50, 5), picture.At(50, 145))
+	}
+}
+
+func TestStripJPEGMetadataKeepsImage(t *testing.T) {
+	original := mustReadFile(t, "fixtures/images/gps.jpg")
+	stripped, err := stripJPEGMetadata(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// upright, so nothing's re-encoded: the image data is the same
+	scan := bytes.Index(original, []byte{0xFF, 0xDA})
+	if scan < 0 || !bytes.HasSuffix(stripped, original[scan:]) {
+		t.Errorf("expected the image data kept as it was")
+	}
+	if len(stripped) >= len(original) {
+		t.Errorf("expected the metadata removed, got %d bytes from %d", len(stripped), len(original))
+	}
+
+	// stripping it again changes nothing
+	again, _ := stripJPEGMetadata(stripped)
+	if !bytes.Equal(again, stripped) {
+		t.Errorf("expected a stripped JPEG left alone")
+	}
+}
+
+func TestStripWebPMetadataFlags(t *testing.T) {
+	stripped, err := stripWebPMetadata(mustReadFile(t, "fixtures/images/gps.webp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stripped[12:16]) != "VP8X" || stripped[20]&(0x08|0x04) != 0 {
+		t.Errorf("expected the VP8X EXIF & XMP flags cleared, got %q %x", stripped[12:16], stripped[20])
+	}
+	if size := int(stripped[4]) | int(stripped[5])<<8 | int(stripped[6])<<16 | int(stripped[7])<<24; size != len(stripped)-8 {
+		t.Errorf("expected the RIFF size %d, got %d", len(stripped)-8, size)
+	}
+}
+
+func TestStripMetadataLeavesOthers(t *testing.T) {
+	for _, test := range []struct{ name, mediaType string }{
+		{name: "animated.gif", mediaType: "image/gif"},
+		{name: "picture.bmp", mediaType: "image/bmp"},
+	} {
+		filename := copyFixtureImage(t, test.name)
+		stripped, _, err := stripMetadata(filename, test.mediaType)
+		if err != nil || stripped != filename {
+			t.Errorf("expected %s left alone, got %s %v", test.name, stripped, err)
+		}
+		if !bytes.Equal(mustReadFile(t, filename), mustReadFile(t, filepath.Join("fixtures", "images", test.name))) {
+			t.Errorf("expected %s unchanged", test.name)
+		}
+	}
+
+	// files that aren't pictures are posted as they are
+	vcard := writeTestMedia(t, "vcard")[0]
+	if stripped, _, err := stripMetadata(vcard, "text/vcard"); err != nil || stripped != vcard {
+		t.Errorf("expected the contact card left alone, got %s %v", stripped, err)
+	}
+}
+
+func TestStripMetadataWithholds(t *testing.T) {
+	// what might say where it was taken, but can't be stripped, isn't posted
+	for _, test := range []struct{ kind, contents, mediaType string }{
+		{kind: "heic", contents: testMedia["heic"], mediaType: "image/heic"},
+		{kind: "broken mp4", contents: testMedia["mp4"][:20], mediaType: "video/mp4"},
+		{kind: "webm", contents: "\x1a\x45\xdf\xa3", mediaType: "video/webm"},
+	} {
+		filename := filepath.Join(t.TempDir(), "ME_temp-1.dat")
+		if err := os.WriteFile(filename, []byte(test.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := stripMetadata(filename, test.mediaType); !errors.Is(err, errMetadataKept) {
+			t.Errorf("expected the %s refused, got %v", test.kind, err)
+		}
+	}
+
+	// but videos that can be read are stripped
+	video, _ := writeTestVideo(t)
+	if stripped, mediaType, err := stripMetadata(video, "video/quicktime"); err != nil || stripped != video || mediaType != "video/quicktime" {
+		t.Errorf("expected the video stripped in place, got %s (%s) %v", stripped, mediaType, err)
+	}
+	if bytes.Contains(mustReadFile(t, video), []byte(testLocation)) {
+		t.Errorf("expected the video's location removed")
+	}
+}
+
+func TestPostWithholdsUnstrippable(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	TestMode = true
+	config = LoadConfig()
+	defer func() { config = Config{} }()
+	archive := &GitArchivePublisher{config: GitArchiveConfig{Dir: filepath.Join(t.TempDir(), "archive")}}
+
+	media := writeTestMedia(t, "heic", "mp4")
+	if err := os.WriteFile(media[1], []byte(testMedia["mp4"][:20]), 0600); err != nil { // broken
+		t.Fatal(err)
+	}
+	message := Message{
+		MessageSid:      "SM0123456789ABCDEF",
+		From:            "Gon",
+		Text:            "hi",
+		Received:        time.Date(2023, 11, 27, 14, 32, 5, 0, time.UTC),
+		NumImages:       3,
+		TwilioImageURLs: []string{"https://api.twilio.com/1", "https://api.twilio.com/2", "https://api.twilio.com/3"},
+		ImageFilenames:  []string{media[0], copyFixtureImage(t, "gps.jpg"), media[1]},
+		MediaTypes:      []string{"image/heic", "image/jpeg", "video/mp4"},
+	}
+	if err := post(context.Background(), &message, []Publisher{archive}); err != nil {
+		t.Fatal(err)
+	}
+
+	if message.NumImages != 1 || len(message.ImageFilenames) != 1 || message.MediaTypes[0] != "image/jpeg" || message.TwilioImageURLs[0] != "https://api.twilio.com/2" {
+		t.Errorf("expected only the JPEG left, got %+v", message)
+	}
+	if len(message.Withheld) != 2 || message.Withheld[0] != "image/heic" || message.Withheld[1] != "video/mp4" {
+		t.Errorf("expected the withheld files noted, got %v", message.Withheld)
+	}
+	for _, filename := range media {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("expected %s deleted", filename)
+		}
+	}
+	files := gitOutput(t, archive.config.Dir, "ls-files")
+	if files != "2023/11/2023-11-27-hi-abcdef/1.jpg\n2023/11/2023-11-27-hi-abcdef/message.json\n2023/11/2023-11-27-hi-abcdef/message.md" {
+		t.Errorf("expected only the stripped JPEG in the git archive, got %s", files)
+	}
+	expectNoMetadata(t, "the archived picture", mustReadFile(t, filepath.Join(archive.config.Dir, "2023/11/2023-11-27-hi-abcdef/1.jpg")))
+}
+
+func TestStripMetadataConverts(t *testing.T) {
+	// a TIFF's EXIF is part of the picture, so it's converted to a JPEG
+	filename := filepath.Join(t.TempDir(), "picture.tiff")
+	picture, _ := decodeTestImage(t, "fixtures/images/picture.bmp")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tiff.Encode(file, picture, nil); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	message := Message{ImageFilenames: []string{filename}, MediaTypes: []string{"image/tiff"}}
+	if err = message.stripImageMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if message.ImageFilenames[0] != filepath.Join(filepath.Dir(filename), "picture.jpg") || message.MediaTypes[0] != "image/jpeg" {
+		t.Errorf("expected the TIFF converted to a JPEG, got %v %v", message.ImageFilenames, message.MediaTypes)
+	}
+	if _, err = os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("expected the TIFF removed")
+	}
+	if _, format := decodeTestImage(t, message.ImageFilenames[0]); format != "jpeg" {
+		t.Errorf("expected a JPEG, got %s", format)
+	}
+}
+
+func TestPostStripsMetadata(t *testing.T) {
+	TestMode = true
+	config = LoadConfig()
+	microblog := &fakePublisher{name: "microblog", enabled: true}
+	defer func() { config = Config{} }()
+
+	message := Message{
+		Text:           "hi",
+		NumImages:      1,
+		ImageFilenames: []string{copyFixtureImage(t, "gps.jpg")},
+		MediaTypes:     []string{"image/jpeg"},
+	}
+	if err := post(context.Background(), &message, []Publisher{microblog}); err != nil {
+		t.Fatal(err)
+	}
+	expectNoMetadata(t, "the posted picture", mustReadFile(t, message.ImageFilenames[0]))
+
+	// unless the config keeps it
+	config.KeepImageMetadata = true
+	message.ImageFilenames = []string{copyFixtureImage(t, "gps.jpg")}
+	if err := post(context.Background(), &message, []Publisher{microblog}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mustReadFile(t, message.ImageFilenames[0]), mustReadFile(t, "fixtures/images/gps.jpg")) {
+		t.Errorf("expected the picture's metadata kept")
+	}
+}
+
+func TestPostVideo(t *testing.T) {
+	TestMode = true
+	config = LoadConfig()
+	microblog := &fakePublisher{name: "microblog", enabled: true}
+	defer func() { config = Config{} }()
+
+	// videos are posted by default, without where they were taken
+	video, _ := writeTestVideo(t)
+	message := Message{Text: "hi", NumImages: 1, ImageFilenames: []string{video}, MediaTypes: []string{"video/mp4"}}
+	if err := post(context.Background(), &message, []Publisher{microblog}); err != nil {
+		t.Fatal(err)
+	}
+	if len(microblog.media) != 1 || microblog.media[0] != "microblog/"+video {
+		t.Errorf("expected the video posted, got %v", microblog.media)
+	}
+	if bytes.Contains(mustReadFile(t, video), []byte(testLocation)) {
+		t.Errorf("expected the posted video's location removed")
+	}
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+func init() {
+	RegisterPublishers("micropub", 15, func(config Config) []Publisher {
+		var publishers []Publisher
+		for _, site := range config.Micropub {
+			publisher := NewMicropubPublisher(site)
+			publisher.template = config.postTemplate(publisher.Name(), markdownPostTemplate)
+			publishers = append(publishers, publisher)
+		}
+		return publishers
+	})
+}
+
+const defaultMicropubName = "micropub"
+
+// MicropubPublisher posts messages to an IndieWeb site via Micropub
+// (https://micropub.spec.indieweb.org/). The endpoints are either configured,
+// filled in by a preset like Micro.blog's, or discovered from the site.
+type MicropubPublisher struct {
+	config  MicropubConfig
+	service string // names the site in logs & errors
+
+	mu            sync.Mutex
+	endpoint      string
+	mediaEndpoint string
+	mediaQueried  bool
+
+	template *PostTemplate
+}
+
+// micropubPreset has the settings for a well-known Micropub service
+type micropubPreset struct {
+	Service       string
+	Endpoint      string
+	MediaEndpoint string // relative to the Micropub endpoint
+}
+
+var micropubPresets = map[string]micropubPreset{
+	"microblog": {Service: "Micro.blog", Endpoint: microBlogEndpoint, MediaEndpoint: "micropub/media"},
+}
+
+// NewMicropubPublisher returns a Publisher for the site, with any preset's
+// settings filled in
+func NewMicropubPublisher(config MicropubConfig) *MicropubPublisher {
+	p := &MicropubPublisher{config: config, service: config.Name}
+	if p.service == "" {
+		p.service = defaultMicropubName
+	}
+	if preset, ok := micropubPresets[config.Preset]; ok {
+		p.service = preset.Service
+		if p.config.Endpoint == "" {
+			p.config.Endpoint = preset.Endpoint
+		}
+		if p.config.MediaEndpoint == "" {
+			if base, err := url.Parse(p.config.Endpoint); err == nil {
+				if mediaEndpoint, err := base.Parse(preset.MediaEndpoint); err == nil {
+					p.config.MediaEndpoint = mediaEndpoint.String()
+				}
+			}
+		}
+	}
+	p.endpoint, p.mediaEndpoint = p.config.Endpoint, p.config.MediaEndpoint
+	return p
+}
+
+func (p *MicropubPublisher) Name() string {
+	if p.config.Name == "" {
+		return defaultMicropubName
+	}
+	return p.config.Name
+}
+
+// destination takes a Message and determines which mp-destination to post it
+// to, if any. Test messages go to the test destination.
+func (p *MicropubPublisher) destination(message *Message) string {
+	if IsTestMessage(message) {
+		return p.config.TestDestination
+	}
+	return p.config.Destination
+}
+
+// Enabled is false for a test message with no TestDestination configured
+func (p *MicropubPublisher) Enabled(message *Message) bool {
+	return !IsTestMessage(message) || p.config.TestDestination != ""
+}
+
+// send makes an authorized request to the site, retrying per the retryPolicy
+// (only if it can't have been sent, if it creates a post), and returns the
+// (successful) response, whose body the caller must close
+func (p *MicropubPublisher) send(ctx context.Context, what string, creates bool, method string, endpoint string, contentType string, body []byte) (*http.Response, error) {
+	do := retryPolicy.Do
+	if creates {
+		do = retryPolicy.DoOnce
+	}
+	var resp *http.Response
+	err := do(ctx, what, func() error {
+		request, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return Permanent(err)
+		}
+		request.Header.Set("Authorization", "Bearer "+p.config.Token)
+		request.Header.Set("Accept", "application/json")
+		if contentType != "" {
+			request.Header.Set("Content-Type", contentType)
+		}
+
+		resp, err = http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		if err = checkStatus(p.service, resp); err != nil {
+			resp.Body.Close()
+			return err
+		}
+		return nil
+	})
+	return resp, err
+}
+
+// micropubEndpoint returns the Micropub endpoint, discovering it from the
+// site's Link header or <link> tag if it isn't configured
+func (p *MicropubPublisher) micropubEndpoint(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.endpoint != "" {
+		return p.endpoint, nil
+	}
+	if p.config.Site == "" {
+		return "", Permanent(fmt.Errorf("no Micropub endpoint or site configured for %s", p.Name()))
+	}
+	endpoint, err := p.discoverEndpoint(ctx)
+	if err != nil {
+		return "", err
+	}
+	p.endpoint = endpoint
+	return endpoint, nil
+}
+
+// mediaEndpointURL returns the media endpoint, asking the Micropub endpoint
+// for it if it isn't configured; it's "" if the site doesn't have one
+func (p *MicropubPublisher) mediaEndpointURL(ctx context.Context) (string, error) {
+	endpoint, err := p.micropubEndpoint(ctx)
+	if err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mediaEndpoint == "" && !p.mediaQueried {
+		mediaEndpoint, err := p.queryMediaEndpoint(ctx, endpoint)
+		if err != nil {
+			return "", err
+		}
+		p.mediaEndpoint, p.mediaQueried = mediaEndpoint, true
+	}
+	return p.mediaEndpoint, nil
+}
+
+var linkTagPattern = regexp.MustCompile(`(?is)<link\s[^>]*>`)
+var attributePattern = regexp.MustCompile(`(?is)(rel|href)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+
+// discoverEndpoint finds the site's Micropub endpoint, per the spec: from an
+// HTTP Link header with rel="micropub", or failing that, an HTML <link> tag
+func (p *MicropubPublisher) discoverEndpoint(ctx context.Context) (string, error) {
+	var endpoint string
+	err := retryPolicy.Do(ctx, "discovering "+p.config.Site+"'s Micropub endpoint", func() error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.config.Site, nil)
+		if err != nil {
+			return Permanent(err)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err = checkStatus(p.service, resp); err != nil {
+			return err
+		}
+
+		href := linkHeaderRel(resp.Header.Values("Link"), "micropub")
+		if href == "" {
+			page, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+			if err != nil {
+				return err
+			}
+			href = linkTagRel(string(page), "micropub")
+		}
+		if href == "" {
+			return Permanent(fmt.Errorf("no Micropub endpoint advertised by %s", p.config.Site))
+		}
+
+		// relative to the page's final URL, after any redirects
+		resolved, err := resp.Request.URL.Parse(href)
+		if err != nil {
+			return Permanent(err)
+		}
+		endpoint = resolved.String()
+		return nil
+	})
+	if err == nil {
+		log.Printf("discovered Micropub endpoint %s for %s", endpoint, p.config.Site)
+	}
+	return endpoint, err
+}
+
+// linkHeaderRel returns the URL of the first link in the Link header values
+// with the given rel, e.g. `<https://example.com/micropub>; rel="micropub"`
+func linkHeaderRel(headers []string, rel string) string {
+	for _, header := range headers {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			href := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(href, "<") || !strings.HasSuffix(href, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "rel") && hasRel(strings.Trim(value, `"`), rel) {
+					return strings.Trim(href, "<>")
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// linkTagRel returns the href of the first <link> tag in the HTML page with
+// the given rel
+func linkTagRel(page string, rel string) string {
+	for _, tag := range linkTagPattern.FindAllString(page, -1) {
+		var tagRel, href string
+		for _, attribute := range attributePattern.FindAllStringSubmatch(tag, -1) {
+			value := attribute[2] + attribute[3] + attribute[4]
+			if strings.EqualFold(attribute[1], "rel") {
+				tagRel = value
+			} else {
+				href = value
+			}
+		}
+		if hasRel(tagRel, rel) && href != "" {
+			return href
+		}
+	}
+	return ""
+}
+
+// hasRel reports whether the space-separated rel values include the given one
+func hasRel(rels string, rel string) bool {
+	for _, value := range strings.Fields(rels) {
+		if strings.EqualFold(value, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryMediaEndpoint asks the Micropub endpoint for its media endpoint
+func (p *MicropubPublisher) queryMediaEndpoint(ctx context.Context, endpoint string) (string, error) {
+	configURL, err := addQuery(endpoint, "q", "config")
+	if err != nil {
+		return "", Permanent(err)
+	}
+	resp, err := p.send(ctx, "querying "+p.service+"'s Micropub config", false, http.MethodGet, configURL, "", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var micropubConfig struct {
+		MediaEndpoint string `json:"media-endpoint"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&micropubConfig); err != nil {
+		return "", fmt.Errorf("error parsing %s's Micropub config: %w", p.service, err)
+	}
+	if micropubConfig.MediaEndpoint == "" {
+		return "", nil
+	}
+	mediaEndpoint, err := resp.Request.URL.Parse(micropubConfig.MediaEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("error parsing %s's media endpoint: %w", p.service, err)
+	}
+	return mediaEndpoint.String(), nil
+}
+
+// addQuery adds a parameter to the URL's query string, keeping any already
+// there (as some Micropub endpoints have)
+func addQuery(rawURL string, key string, value string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := parsed.Query()
+	query.Add(key, value)
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}
+
+// withDestination adds the mp-destination parameter to the endpoint, if any
+func withDestination(endpoint string, destination string) (string, error) {
+	if destination == "" {
+		return endpoint, nil
+	}
+	return addQuery(endpoint, "mp-destination", destination)
+}
+
+// micropubImageLimits is the pictures & videos Micropub sites are sent:
+// Micro.blog takes pictures up to 10MB, & other sites aren't sent anything
+// bigger, or anything bigger than a blog would show, & MP4 or MOV video up to
+// 100MB (far more than an MMS carries, but `txt2mary post` can send more)
+var micropubImageLimits = ImageLimits{
+	Types:         newMediaTypeSet("image/jpeg", "image/png", "image/gif", "image/webp", "video/mp4", "video/quicktime"),
+	MaxBytes:      10 << 20,
+	MaxSide:       4096,
+	MaxVideoBytes: 100 << 20,
+}
+
+// micropubProperty returns the h-entry property a file of the media type goes
+// in: video for a video, or else photo
+func micropubProperty(mediaType string) string {
+	if isVideo(mediaType) {
+		return "video"
+	}
+	return "photo"
+}
+
+// micropubMediaRef returns what UploadMedia returns for a file uploaded to
+// the URL: the URL itself for a picture, or "video " & the URL for a video,
+// since the URL might not say what it is
+func micropubMediaRef(fileURL string, mediaType string) string {
+	if property := micropubProperty(mediaType); property != "photo" {
+		return property + " " + fileURL
+	}
+	return fileURL
+}
+
+// micropubMedia splits the media references UploadMedia returned into each
+// file's URL & the h-entry property it goes in
+func micropubMedia(media []string) (fileURLs []string, properties []string) {
+	for _, ref := range media {
+		property, fileURL := "photo", ref
+		if rest, ok := strings.CutPrefix(ref, "video "); ok {
+			property, fileURL = "video", rest
+		}
+		fileURLs = append(fileURLs, fileURL)
+		properties = append(properties, property)
+	}
+	return fileURLs, properties
+}
+
+// uploadFile uploads the file to the media endpoint, returning its URL there
+func (p *MicropubPublisher) uploadFile(ctx context.Context, mediaEndpoint string, media MediaFile, destination string) (string, error) {
+	filename := media.Filename
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Printf("error opening file %q: %s", filename, err)
+		return "", err
+	}
+	defer file.Close()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	fw, err := createFormFile(writer, "file", media) // *must* be "file"
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(fw, file); err != nil {
+		log.Printf("error io-copying file %q: %s", filename, err)
+		return "", err
+	}
+	_ = writer.Close()
+
+	endpoint, err := withDestination(mediaEndpoint, destination)
+	if err != nil {
+		return "", Permanent(err)
+	}
+	resp, err := p.send(ctx, "uploading "+filename+" to "+p.service, false, http.MethodPost, endpoint, writer.FormDataContentType(), body.Bytes())
+	if err != nil {
+		log.Printf("error posting file %q to %s: %s", filename, p.service, err)
+		return "", err
+	}
+	resp.Body.Close()
+
+	// the media endpoint returns the file's URL in the Location header
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("no Location returned for %q by %s", filename, p.service)
+	}
+	return location, nil
+}
+
+// UploadMedia uploads each of the Message's pictures & videos to the site's
+// media endpoint, returning their URLs there (see micropubMediaRef). Pictures
+// are converted or shrunk if need be, & files of other types skipped.
+func (p *MicropubPublisher) UploadMedia(ctx context.Context, message *Message) ([]string, error) {
+	files, remove := message.prepareMedia(p.service, micropubImageLimits)
+	defer remove()
+	if len(files) == 0 {
+		return nil, nil
+	}
+	mediaEndpoint, err := p.mediaEndpointURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if mediaEndpoint == "" {
+		return nil, Permanent(fmt.Errorf("%s has no Micropub media endpoint, so images can't be posted", p.service))
+	}
+
+	var imageURLs []string
+	destination := p.destination(message)
+	for _, file := range files {
+		imageURL, err := p.uploadFile(ctx, mediaEndpoint, file, destination)
+		if err != nil {
+			return imageURLs, err
+		}
+		imageURLs = append(imageURLs, micropubMediaRef(imageURL, file.Type))
+		log.Printf("uploaded %s %q to %s\n", file.Type, file.Filename, p.service)
+	}
+	return imageURLs, nil
+}
+
+// entryBody encodes a new h-entry, either form-encoded or as JSON, with each
+// uploaded file in its property: pictures as photos & videos as videos
+func (p *MicropubPublisher) entryBody(message *Message, imageURLs []string, properties []string) (string, []byte, error) {
+	content, err := p.template.or(markdownPostTemplate).Format(message)
+	if err != nil {
+		return "", nil, err
+	}
+	if !p.config.JSON {
+		data := url.Values{}
+		data.Set("h", "entry")
+		data.Set("content", content)
+		data.Set("category", "txt")
+		for i, imageURL := range imageURLs {
+			data.Add(properties[i]+"[]", imageURL)
+		}
+		return "application/x-www-form-urlencoded", []byte(data.Encode()), nil
+	}
+
+	entry := map[string][]string{
+		"content":  {content},
+		"category": {"txt"},
+	}
+	for i, imageURL := range imageURLs {
+		entry[properties[i]] = append(entry[properties[i]], imageURL)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"type":       []string{"h-entry"},
+		"properties": entry,
+	})
+	return "application/json", body, err
+}
+
+// Publish creates a post with the text of the given Message & the
+// already-uploaded images, returning the URL of the resultant post.
+func (p *MicropubPublisher) Publish(ctx context.Context, message *Message, media []string) (string, error) {
+	imageURLs, properties := micropubMedia(media)
+	micropubEndpoint, err := p.micropubEndpoint(ctx)
+	if err != nil {
+		return "", err
+	}
+	endpoint, err := withDestination(micropubEndpoint, p.destination(message))
+	if err != nil {
+		return "", Permanent(err)
+	}
+	contentType, body, err := p.entryBody(message, imageURLs, properties)
+	if err != nil {
+		return "", Permanent(err)
+	}
+
+	resp, err := p.send(ctx, "posting the message to "+p.service, true, http.MethodPost, endpoint, contentType, body)
+	if err != nil {
+		log.Printf("error posting to %s: %s", p.service, err)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	postURL, err := micropubPostURL(resp)
+	if err != nil {
+		log.Printf("error reading response from %s: %s", p.service, err)
+		return "", err
+	}
+	log.Printf("posted message to %s\n", p.service)
+	return postURL, nil
+}
+
+// micropubPostURL gets the new post's URL from the response: the spec puts
+// it in the Location header, but Micro.blog returns it as JSON
+func micropubPostURL(resp *http.Response) (string, error) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var created struct {
+		Url string
+	}
+	if json.Unmarshal(body, &created) == nil && created.Url != "" {
+		return created.Url, nil
+	}
+	if location := resp.Header.Get("Location"); location != "" {
+		return location, nil
+	}
+	return "", errors.New("no URL returned for the new post")
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMicropubSite is an IndieWeb site advertising its Micropub endpoint
+type fakeMicropubSite struct {
+	*httptest.Server
+	mu            sync.Mutex
+	pageRequests  int
+	mediaEndpoint string // returned by q=config
+	entries       []*http.Request
+	bodies        []map[string]interface{}
+	uploadTypes   []string
+}
+
+func newFakeMicropubSite(t *testing.T, linkHeader bool) *fakeMicropubSite {
+	site := &fakeMicropubSite{mediaEndpoint: "/media"}
+	site.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		site.mu.Lock()
+		defer site.mu.Unlock()
+		if r.URL.Path != "/" && r.Header.Get("Authorization") != "Bearer site-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/":
+			site.pageRequests++
+			if linkHeader {
+				w.Header().Add("Link", `<https://example.com/webmention>; rel="webmention", </micropub?site=1>; rel="micropub"`)
+				return
+			}
+			_, _ = w.Write([]byte(`<html><head><link rel="stylesheet" href="/style.css">
+				<LINK href='/micropub?site=1' REL="micropub"></head></html>`))
+		case r.URL.Path == "/micropub" && r.URL.Query().Get("q") == "config":
+			_, _ = fmt.Fprintf(w, `{"media-endpoint": %q}`, site.mediaEndpoint)
+		case r.URL.Path == "/micropub":
+			body := map[string]interface{}{}
+			if r.Header.Get("Content-Type") == "application/json" {
+				_ = json.NewDecoder(r.Body).Decode(&body)
+			} else {
+				_ = r.ParseForm()
+				for key, values := range r.PostForm {
+					body[key] = values
+				}
+			}
+			site.entries = append(site.entries, r)
+			site.bodies = append(site.bodies, body)
+			w.Header().Set("Location", fmt.Sprintf("%s/posts/%d", site.URL, len(site.entries)))
+			w.WriteHeader(http.StatusCreated)
+		case r.URL.Path == "/media":
+			mediaType := "image/jpeg"
+			if _, header, err := r.FormFile("file"); err == nil && header.Header.Get("Content-Type") != "" {
+				mediaType = header.Header.Get("Content-Type")
+			}
+			site.uploadTypes = append(site.uploadTypes, mediaType)
+			// which doesn't say what it is
+			w.Header().Set("Location", fmt.Sprintf("%s/media/%d", site.URL, len(site.uploadTypes)))
+			w.WriteHeader(http.StatusCreated)
+		default:
+			t.Errorf("unexpected Micropub request to %s", r.URL)
+		}
+	}))
+	t.Cleanup(site.Close)
+	return site
+}
+
+func TestMicropubDiscoversEndpoints(t *testing.T) {
+	site := newFakeMicropubSite(t, false)
+	publisher := NewMicropubPublisher(MicropubConfig{Name: "blog", Site: site.URL, Token: "site-token", JSON: true})
+
+	message := Message{From: "Gon", Text: "hi", ImageFilenames: writeTestImages(t, 10)}
+	result := publish(context.Background(), publisher, &message, defaultPublishTimeout)
+	if result.Err != nil {
+		t.Fatalf("expected no error, got %q", result.Err)
+	}
+	if result.URL != site.URL+"/posts/1" {
+		t.Errorf("expected the Location as the post URL, got %q", result.URL)
+	}
+	if len(result.Media) != 1 || result.Media[0] != site.URL+"/media/1" {
+		t.Errorf("unexpected media %v", result.Media)
+	}
+
+	entry, body := site.entries[0], site.bodies[0]
+	if entry.URL.Query().Get("site") != "1" {
+		t.Errorf("expected the discovered endpoint's query string kept, got %q", entry.URL)
+	}
+	properties := body["properties"].(map[string]interface{})
+	if content := properties["content"].([]interface{})[0]; content != "> hi\n\n&ndash; Gon" {
+		t.Errorf("unexpected content %q", content)
+	}
+	if photos := properties["photo"].([]interface{}); len(photos) != 1 || photos[0] != site.URL+"/media/1" {
+		t.Errorf("unexpected photos %v", photos)
+	}
+
+	// the endpoints are only discovered once
+	if result = publish(context.Background(), publisher, &Message{From: "Gon", Text: "again"}, defaultPublishTimeout); result.Err != nil {
+		t.Errorf("expected no error, got %q", result.Err)
+	}
+	if site.pageRequests != 1 {
+		t.Errorf("expected the site fetched once, got %d", site.pageRequests)
+	}
+}
+
+func TestMicropubWithoutMediaEndpoint(t *testing.T) {
+	site := newFakeMicropubSite(t, true)
+	site.mediaEndpoint = ""
+	publisher := NewMicropubPublisher(MicropubConfig{Site: site.URL, Token: "site-token", Destination: "https://other.example.com/"})
+	if publisher.Name() != "micropub" {
+		t.Errorf("expected the default name, got %q", publisher.Name())
+	}
+
+	// text still posts, form-encoded, to the destination
+	result := publish(context.Background(), publisher, &Message{From: "Gon", Text: "hi"}, defaultPublishTimeout)
+	if result.Err != nil {
+		t.Fatalf("expected no error, got %q", result.Err)
+	}
+	if destination := site.entries[0].URL.Query().Get("mp-destination"); destination != "https://other.example.com/" {
+		t.Errorf("expected mp-destination, got %q", destination)
+	}
+	if content := site.bodies[0]["content"].([]string); content[0] != "> hi\n\n&ndash; Gon" {
+		t.Errorf("unexpected content %q", content)
+	}
+
+	// but images can't be
+	message := Message{From: "Gon", Text: "pic", ImageFilenames: writeTestImages(t, 10)}
+	result = publish(context.Background(), publisher, &message, defaultPublishTimeout)
+	if result.Err == nil || !strings.Contains(result.Err.Error(), "no Micropub media endpoint") {
+		t.Errorf("expected a missing media endpoint error, got %v", result.Err)
+	}
+}
+
+func TestMicroBlogPreset(t *testing.T) {
+	publisher := NewMicropubPublisher(MicroBlogConfig{Token: "t", Destination: "https://foo.micro.blog/"}.micropubConfig())
+	if publisher.endpoint != "https://micro.blog/micropub" || publisher.mediaEndpoint != "https://micro.blog/micropub/media" {
+		t.Errorf("unexpected Micro.blog endpoints %q & %q", publisher.endpoint, publisher.mediaEndpoint)
+	}
+	if publisher.Name() != "microblog" || publisher.service != "Micro.blog" {
+		t.Errorf("unexpected Micro.blog names %q & %q", publisher.Name(), publisher.service)
+	}
+
+	publisher = NewMicropubPublisher(MicropubConfig{Preset: "microblog", Endpoint: "http://localhost:8080/micropub"})
+	if publisher.mediaEndpoint != "http://localhost:8080/micropub/media" {
+		t.Errorf("expected the media endpoint to follow the endpoint, got %q", publisher.mediaEndpoint)
+	}
+}
+
+func TestLinkRels(t *testing.T) {
+	var headerTests = []struct {
+		headers  []string
+		expected string
+	}{
+		{headers: []string{`<https://a.example/mp>; rel="micropub"`}, expected: "https://a.example/mp"},
+		{headers: []string{`<https://a.example/auth>; rel="authorization_endpoint"`, `</mp>; rel="me micropub"`}, expected: "/mp"},
+		{headers: []string{`<https://a.example/mp>; rel="micropub-ish"`}, expected: ""},
+		{headers: nil, expected: ""},
+	}
+	for _, test := range headerTests {
+		if actual := linkHeaderRel(test.headers, "micropub"); actual != test.expected {
+			t.Errorf("linkHeaderRel(%q) != %q (%q)", test.headers, test.expected, actual)
+		}
+	}
+
+	var tagTests = []struct {
+		page     string
+		expected string
+	}{
+		{page: `<link rel="micropub" href="https://a.example/mp">`, expected: "https://a.example/mp"},
+		{page: `<link href=/mp rel=micropub />`, expected: "/mp"},
+		{page: `<link rel="stylesheet" href="/a.css"><link rel='micropub' href='/mp'>`, expected: "/mp"},
+		{page: `<a rel="micropub" href="/nope">`, expected: ""},
+	}
+	for _, test := range tagTests {
+		if actual := linkTagRel(test.page, "micropub"); actual != test.expected {
+			t.Errorf("linkTagRel(%q) != %q (%q)", test.page, test.expected, actual)
+		}
+	}
+}
+
+func TestMultipleMicropubSites(t *testing.T) {
+	TestMode = true
+	testConfig := LoadConfig()
+	testConfig.Micropub = []MicropubConfig{
+		{Name: "blog", Site: "https://blog.example.com", Token: "a"},
+		{Name: "notes", Endpoint: "https://notes.example.com/micropub", Token: "b"},
+	}
+
+	var names []string
+	for _, publisher := range ConfiguredPublishers(testConfig) {
+		names = append(names, publisher.Name())
+	}
+	if strings.Join(names, " ") != "microblog blog notes twitter" {
+		t.Errorf("expected publishers [microblog blog notes twitter], got %v", names)
+	}
+
+	// results are listed in the same order
+	message := Message{Results: map[string]PublishResult{
+		"twitter": {URL: "https://twitter.com/1"},
+		"notes":   {URL: "https://notes.example.com/1"},
+		"blog":    {URL: "https://blog.example.com/1"},
+	}}
+	if succeeded := message.Succeeded(); strings.Join(succeeded, " ") != "blog notes twitter" {
+		t.Errorf("expected results in priority order, got %v", succeeded)
+	}
+	if message.PostURL() != "https://blog.example.com/1" {
+		t.Errorf("expected the first site's URL, got %q", message.PostURL())
+	}
+
+	testConfig.Micropub = append(testConfig.Micropub,
+		MicropubConfig{Name: "blog", Endpoint: "https://blog2.example.com/micropub"},
+		MicropubConfig{Preset: "wordpress", Token: "c"})
+	problems, _ := CheckConfig(testConfig)
+	expected := []string{
+		`Micropub site "blog" has no Token`,
+		`Micropub site #4 has unknown Preset "wordpress"`,
+		`more than one destination is named "blog"`,
+	}
+	for _, problem := range expected {
+		if !strings.Contains(strings.Join(problems, "\n"), problem) {
+			t.Errorf("expected problem %q, got %q", problem, problems)
+		}
+	}
+}
+
+// the form-encoded & JSON bodies describe the same entry
+func TestMicropubEntryBody(t *testing.T) {
+	message := &Message{From: "Gon", Text: "hi"}
+	images := []string{"https://a.example/1", "https://a.example/2", "https://a.example/3"}
+	properties := []string{"photo", "photo", "video"}
+
+	contentType, body, _ := (&MicropubPublisher{}).entryBody(message, images, properties)
+	form, _ := url.ParseQuery(string(body))
+	if contentType != "application/x-www-form-urlencoded" || form.Get("h") != "entry" || len(form["photo[]"]) != 2 || len(form["video[]"]) != 1 {
+		t.Errorf("unexpected form entry %s %q", contentType, body)
+	}
+
+	contentType, body, _ = (&MicropubPublisher{config: MicropubConfig{JSON: true}}).entryBody(message, images, properties)
+	var entry struct {
+		Type       []string
+		Properties map[string][]string
+	}
+	_ = json.Unmarshal(body, &entry)
+	if contentType != "application/json" || entry.Type[0] != "h-entry" || len(entry.Properties["photo"]) != 2 || len(entry.Properties["video"]) != 1 || entry.Properties["category"][0] != "txt" {
+		t.Errorf("unexpected JSON entry %s %q", contentType, body)
+	}
+}
+
+func TestMicropubPostsVideo(t *testing.T) {
+	site := newFakeMicropubSite(t, true)
+	publisher := NewMicropubPublisher(MicropubConfig{Name: "blog", Site: site.URL, Token: "site-token"})
+
+	message := Message{
+		From:           "Gon",
+		Text:           "look",
+		ImageFilenames: append(writeTestImages(t, 10), writeTestMedia(t, "mp4", "3gp")...),
+		MediaTypes:     []string{"image/jpeg", "video/mp4", "video/3gpp"},
+	}
+	result := publish(context.Background(), publisher, &message, defaultPublishTimeout)
+	if result.Err != nil {
+		t.Fatalf("expected no error, got %q", result.Err)
+	}
+	// 3GP isn't something a blog can show
+	if strings.Join(site.uploadTypes, " ") != "image/jpeg video/mp4" {
+		t.Errorf("expected a picture & an MP4 uploaded as such, got %v", site.uploadTypes)
+	}
+	body := site.bodies[0]
+	if photos := body["photo[]"].([]string); len(photos) != 1 || photos[0] != site.URL+"/media/1" {
+		t.Errorf("unexpected photos %v", photos)
+	}
+	if videos, _ := body["video[]"].([]string); len(videos) != 1 || videos[0] != site.URL+"/media/2" {
+		t.Errorf("expected the video as a video, got %v", body)
+	}
+	if strings.Join(result.Media, " ") != site.URL+"/media/1 video "+site.URL+"/media/2" {
+		t.Errorf("expected the video's URL to say it's a video, got %v", result.Media)
+	}
+
+	// a bare URL, as saved before videos were marked, is a photo
+	fileURLs, properties := micropubMedia([]string{site.URL + "/media/1", "video " + site.URL + "/media/2"})
+	if strings.Join(fileURLs, " ") != site.URL+"/media/1 "+site.URL+"/media/2" || strings.Join(properties, " ") != "photo video" {
+		t.Errorf("unexpected media %v %v", fileURLs, properties)
+	}
+}
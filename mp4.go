@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// mp4Box is a box (or, in QuickTime's words, an atom) of an MP4, MOV, 3GP or
+// HEIC file, from its size to the end of its contents
+type mp4Box struct {
+	kind             string
+	start, data, end int64
+}
+
+// mp4MetadataBoxes is the boxes, in the file & its movie & tracks, that hold
+// metadata: user data (where Android & 3GPP put where a video was taken),
+// QuickTime's metadata (where iPhones do), & XMP
+var mp4MetadataBoxes = map[string]bool{"udta": true, "meta": true, "uuid": true}
+
+// mp4Boxes returns the boxes in the file between start & end, which they
+// have to fill exactly
+func mp4Boxes(file io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	header := make([]byte, 16)
+	for offset := start; offset < end; {
+		if _, err := file.ReadAt(header[:8], offset); err != nil {
+			return nil, err
+		}
+		box := mp4Box{kind: string(header[4:8]), start: offset, data: offset + 8}
+		switch size := int64(binary.BigEndian.Uint32(header)); size {
+		case 0: // the rest of the file
+			box.end = end
+		case 1: // a 64-bit size follows
+			if _, err := file.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, err
+			}
+			box.data += 8
+			box.end = offset + int64(binary.BigEndian.Uint64(header[8:16]))
+		default:
+			box.end = offset + size
+		}
+		if box.end < box.data || box.end > end {
+			return nil, errors.New("the boxes don't fit the file; it's truncated, or not an MP4")
+		}
+		boxes = append(boxes, box)
+		offset = box.end
+	}
+	return boxes, nil
+}
+
+// stripMP4Metadata removes the metadata boxes of an MP4, MOV or 3GP video in
+// place, without reading the video itself: each is turned into a free box of
+// zeroes, so nothing after it moves & the video's offsets stay right
+func stripMP4Metadata(filename string) error {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	boxes, err := mp4Boxes(file, 0, info.Size())
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(boxes); i++ {
+		box := boxes[i]
+		switch {
+		case box.kind == "moov" || box.kind == "trak":
+			children, err := mp4Boxes(file, box.data, box.end)
+			if err != nil {
+				return err
+			}
+			boxes = append(boxes, children...)
+		case mp4MetadataBoxes[box.kind]:
+			if err = freeMP4Box(file, box); err != nil {
+				return err
+			}
+		}
+	}
+	return file.Sync()
+}
+
+// freeMP4Box overwrites the box with a free box of the same size, its
+// contents zeroed
+func freeMP4Box(file *os.File, box mp4Box) error {
+	if _, err := file.WriteAt([]byte("free"), box.start+4); err != nil {
+		return err
+	}
+	return zeroFile(file, box.data, box.end)
+}
+
+// zeroFile overwrites the file from start to end with zeroes
+func zeroFile(file *os.File, start, end int64) error {
+	zeroes := make([]byte, min(end-start, 32<<10))
+	for offset := start; offset < end; offset += int64(len(zeroes)) {
+		if _, err := file.WriteAt(zeroes[:min(int64(len(zeroes)), end-offset)], offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mp4Fields reads the fields of a box's contents in order, noting if they
+// run out
+type mp4Fields struct {
+	data  []byte
+	pos   int
+	short bool
+}
+
+// uint reads a big-endian number of the given size in bytes, from 0 to 8
+func (f *mp4Fields) uint(size int) uint64 {
+	if f.pos+size > len(f.data) {
+		f.short = true
+		return 0
+	}
+	var value uint64
+	for _, b := range f.data[f.pos : f.pos+size] {
+		value = value<<8 | uint64(b)
+	}
+	f.pos += size
+	return value
+}
+
+// kind reads a box's or item's four-character type
+func (f *mp4Fields) kind() string {
+	return string(binary.BigEndian.AppendUint32(nil, uint32(f.uint(4))))
+}
+
+// string reads a string ended by a zero byte
+func (f *mp4Fields) string() string {
+	end := bytes.IndexByte(f.data[min(f.pos, len(f.data)):], 0)
+	if end < 0 {
+		f.short = true
+		return ""
+	}
+	value := string(f.data[f.pos : f.pos+end])
+	f.pos += end + 1
+	return value
+}
+
+// readMP4Box returns the box's contents, after its header
+func readMP4Box(file io.ReaderAt, box mp4Box) ([]byte, error) {
+	data := make([]byte, box.end-box.data)
+	_, err := file.ReadAt(data, box.data)
+	return data, err
+}
+
+// heicMetadataItems returns the IDs of the items in a HEIC's item info
+// (iinf) box that are metadata: EXIF, & XMP
+func heicMetadataItems(iinf []byte) (map[uint64]bool, error) {
+	fields := &mp4Fields{data: iinf}
+	countSize := 4
+	if fields.uint(4)>>24 == 0 { // the version
+		countSize = 2
+	}
+	fields.uint(countSize)
+	if fields.short {
+		return nil, errors.New("the HEIC's item info is truncated")
+	}
+	infos, err := mp4Boxes(bytes.NewReader(iinf), int64(fields.pos), int64(len(iinf)))
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(map[uint64]bool)
+	for _, info := range infos {
+		if info.kind != "infe" {
+			continue
+		}
+		infe := &mp4Fields{data: iinf[info.data:info.end]}
+		version := infe.uint(4) >> 24
+		if version < 2 {
+			continue // too old to be HEIC's
+		}
+		idSize := 2
+		if version >= 3 {
+			idSize = 4
+		}
+		id := infe.uint(idSize)
+		infe.uint(2) // its protection
+		kind := infe.kind()
+		infe.string() // its name
+		switch {
+		case kind == "Exif":
+			items[id] = true
+		case kind == "mime" && infe.string() == "application/rdf+xml": // XMP
+			items[id] = true
+		}
+		if infe.short {
+			return nil, errors.New("the HEIC's item info is truncated")
+		}
+	}
+	return items, nil
+}
+
+// mp4Extent is where in the file part of an item is
+type mp4Extent struct {
+	offset, length int64
+}
+
+// heicItemExtents returns where in the file the given items of a HEIC are,
+// from its item location (iloc) box, & where its item data (idat) box's
+// contents start, for items kept there
+func heicItemExtents(iloc []byte, items map[uint64]bool, idat int64) ([]mp4Extent, error) {
+	fields := &mp4Fields{data: iloc}
+	version := fields.uint(4) >> 24
+	sizes := fields.uint(2)
+	offsetSize, lengthSize, baseOffsetSize := int(sizes>>12), int(sizes>>8&0xF), int(sizes>>4&0xF)
+	indexSize, idSize := 0, 2
+	if version >= 1 {
+		indexSize = int(sizes & 0xF)
+	}
+	if version >= 2 {
+		idSize = 4
+	}
+	count := fields.uint(idSize)
+
+	var extents []mp4Extent
+	for i := uint64(0); i < count && !fields.short; i++ {
+		id := fields.uint(idSize)
+		method := uint64(0) // the item's in the file
+		if version >= 1 {
+			method = fields.uint(2) & 0xF
+		}
+		fields.uint(2) // its data reference
+		base := int64(fields.uint(baseOffsetSize))
+		extentCount := fields.uint(2)
+		for j := uint64(0); j < extentCount && !fields.short; j++ {
+			fields.uint(indexSize)
+			extent := mp4Extent{offset: base + int64(fields.uint(offsetSize)), length: int64(fields.uint(lengthSize))}
+			if !items[id] {
+				continue
+			}
+			switch {
+			case method == 1 && idat >= 0: // in the item data box
+				extent.offset += idat
+			case method != 0:
+				return nil, errors.New("the HEIC's metadata is in another item")
+			}
+			if extent.length <= 0 {
+				return nil, errors.New("the HEIC's metadata runs to the end of the file")
+			}
+			extents = append(extents, extent)
+		}
+	}
+	if fields.short {
+		return nil, errors.New("the HEIC's item locations are truncated")
+	}
+	return extents, nil
+}
+
+// stripHEICMetadata removes the EXIF & XMP items of a HEIC picture in place,
+// for when it can't be converted: their contents are zeroed, so nothing
+// moves & the picture's offsets stay right
+func stripHEICMetadata(filename string) error {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	boxes, err := mp4Boxes(file, 0, info.Size())
+	if err != nil {
+		return err
+	}
+	var meta *mp4Box
+	for i := range boxes {
+		if boxes[i].kind == "meta" {
+			meta = &boxes[i]
+		}
+	}
+	if meta == nil || meta.end-meta.data < 4 {
+		return errors.New("the HEIC has no items")
+	}
+	children, err := mp4Boxes(file, meta.data+4, meta.end) // after its version
+	if err != nil {
+		return err
+	}
+	var iinf, iloc []byte
+	idat := int64(-1)
+	for _, child := range children {
+		switch child.kind {
+		case "iinf":
+			iinf, err = readMP4Box(file, child)
+		case "iloc":
+			iloc, err = readMP4Box(file, child)
+		case "idat":
+			idat = child.data
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if iinf == nil || iloc == nil {
+		return errors.New("the HEIC has no items")
+	}
+
+	items, err := heicMetadataItems(iinf)
+	if err != nil || len(items) == 0 {
+		return err
+	}
+	extents, err := heicItemExtents(iloc, items, idat)
+	if err != nil {
+		return err
+	}
+	for _, extent := range extents {
+		if extent.offset < 0 || extent.offset+extent.length > info.Size() {
+			return errors.New("the HEIC's metadata is outside it")
+		}
+	}
+	for _, extent := range extents {
+		if err = zeroFile(file, extent.offset, extent.offset+extent.length); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testLocation is where the test video & HEIC say they were taken, as
+// phones write it
+const testLocation = "+30.2672-097.7431/"
+
+// mp4TestBox returns a box of the given kind, holding the contents
+func mp4TestBox(kind string, contents ...string) string {
+	body := strings.Join(contents, "")
+	size := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return string(size) + kind + body
+}
+
+// writeTestVideo writes an MP4 that says where it was taken, in each of the
+// places phones put it, returning its name & contents
+func writeTestVideo(t *testing.T) (string, []byte) {
+	location := mp4TestBox("\xa9xyz", "\x00\x12\x15\xc7"+testLocation)
+	frames := "the video's frames"
+	video := mp4TestBox("ftyp", "mp42\x00\x00\x00\x00mp42isom") +
+		mp4TestBox("moov",
+			mp4TestBox("mvhd", strings.Repeat("\x01", 100)),
+			mp4TestBox("trak", mp4TestBox("tkhd", strings.Repeat("\x02", 84)), mp4TestBox("udta", location)),
+			mp4TestBox("udta", location),
+			mp4TestBox("meta", "\x00\x00\x00\x00", mp4TestBox("hdlr", strings.Repeat("\x00", 8)+"mdta"), mp4TestBox("ilst", testLocation)),
+		) +
+		mp4TestBox("uuid", "\xbe\x7a\xcf\xcb\x97\xa9\x42\xe8\x9c\x71\x99\x94\x91\xe3\xaf\xac", "<x:xmpmeta>"+testLocation) +
+		// a 64-bit size, like a long video's
+		"\x00\x00\x00\x01mdat" + string(binary.BigEndian.AppendUint64(nil, uint64(16+len(frames)))) + frames
+
+	filename := filepath.Join(t.TempDir(), "ME_temp-1.mp4")
+	if err := os.WriteFile(filename, []byte(video), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename, []byte(video)
+}
+
+func TestStripMP4Metadata(t *testing.T) {
+	filename, original := writeTestVideo(t)
+	if err := stripMP4Metadata(filename); err != nil {
+		t.Fatal(err)
+	}
+	stripped := mustReadFile(t, filename)
+	if bytes.Contains(stripped, []byte(testLocation)) {
+		t.Errorf("expected the location removed, got %q", stripped)
+	}
+	if len(stripped) != len(original) {
+		t.Errorf("expected nothing moved, got %d bytes from %d", len(stripped), len(original))
+	}
+	for _, kept := range []string{"ftypmp42", "mvhd" + strings.Repeat("\x01", 100), "tkhd" + strings.Repeat("\x02", 84), "the video's frames"} {
+		if !bytes.Contains(stripped, []byte(kept)) {
+			t.Errorf("expected %q kept", kept)
+		}
+	}
+	if count := bytes.Count(stripped, []byte("free")); count != 4 {
+		t.Errorf("expected 4 free boxes, got %d", count)
+	}
+	if _, err := mp4Boxes(bytes.NewReader(stripped), 0, int64(len(stripped))); err != nil {
+		t.Errorf("expected a valid MP4, got %s", err)
+	}
+
+	// what isn't an MP4 is refused, & left alone
+	for name, contents := range map[string][]byte{"truncated": original[:len(original)-4], "JPEG": []byte(testMedia["jpeg"])} {
+		if err := os.WriteFile(filename, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := stripMP4Metadata(filename); err == nil {
+			t.Errorf("expected the %s refused", name)
+		}
+		if !bytes.Equal(mustReadFile(t, filename), contents) {
+			t.Errorf("expected the %s unchanged", name)
+		}
+	}
+}
+
+// writeTestHEIC writes a HEIC with EXIF saying where it was taken, in its
+// media data, & XMP saying so in its item data, returning its name
+func writeTestHEIC(t *testing.T) string {
+	exif := "\x00\x00\x00\x06Exif\x00\x00MM\x00*" + testLocation
+	xmp := "<x:xmpmeta>" + testLocation + "</x:xmpmeta>"
+	tiles := "the picture's tiles"
+	u16 := func(n int) string { return string(binary.BigEndian.AppendUint16(nil, uint16(n))) }
+	u32 := func(n int) string { return string(binary.BigEndian.AppendUint32(nil, uint32(n))) }
+	infe := func(id int, kind string, rest string) string {
+		return mp4TestBox("infe", "\x02\x00\x00\x00", u16(id), "\x00\x00", kind, "\x00", rest)
+	}
+	// each item's ID, how it's stored (0 in the file, 1 in idat), no data
+	// reference, & one extent
+	item := func(id, method, offset, length int) string {
+		return u16(id) + u16(method) + "\x00\x00" + u16(1) + u32(offset) + u32(length)
+	}
+	build := func(tilesOffset, exifOffset int) string {
+		return mp4TestBox("ftyp", "heic\x00\x00\x00\x00mif1heic") +
+			mp4TestBox("meta", "\x00\x00\x00\x00",
+				mp4TestBox("hdlr", "\x00\x00\x00\x00\x00\x00\x00\x00pict", strings.Repeat("\x00", 13)),
+				mp4TestBox("pitm", "\x00\x00\x00\x00", u16(1)),
+				mp4TestBox("iloc", "\x01\x00\x00\x00\x44\x00", u16(3),
+					item(1, 0, tilesOffset, len(tiles)), item(2, 0, exifOffset, len(exif)), item(3, 1, 0, len(xmp))),
+				mp4TestBox("iinf", "\x00\x00\x00\x00", u16(3),
+					infe(1, "hvc1", ""), infe(2, "Exif", ""), infe(3, "mime", "application/rdf+xml\x00")),
+				mp4TestBox("idat", xmp),
+			) +
+			mp4TestBox("mdat", tiles, exif)
+	}
+	heic := build(0, 0)
+	heic = build(strings.Index(heic, tiles), strings.Index(heic, exif))
+
+	filename := filepath.Join(t.TempDir(), "ME_temp-1.heic")
+	if err := os.WriteFile(filename, []byte(heic), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestStripHEICMetadata(t *testing.T) {
+	filename := writeTestHEIC(t)
+	original := mustReadFile(t, filename)
+	if detectMediaType(original) != "image/heic" {
+		t.Fatalf("expected the test HEIC to be one, got %s", detectMediaType(original))
+	}
+	if err := stripHEICMetadata(filename); err != nil {
+		t.Fatal(err)
+	}
+	stripped := mustReadFile(t, filename)
+	if bytes.Contains(stripped, []byte(testLocation)) {
+		t.Errorf("expected the location removed, got %q", stripped)
+	}
+	if len(stripped) != len(original) || !bytes.Contains(stripped, []byte("the picture's tiles")) {
+		t.Errorf("expected the picture itself left alone, got %q", stripped)
+	}
+
+	// one with no metadata is left alone
+	picture := copyFixtureImage(t, "picture.heic")
+	if err := stripHEICMetadata(picture); err != nil {
+		t.Errorf("expected picture.heic read, got %s", err)
+	}
+	if !bytes.Equal(mustReadFile(t, picture), mustReadFile(t, "fixtures/images/picture.heic")) {
+		t.Errorf("expected picture.heic unchanged")
+	}
+
+	// & one that can't be read is refused
+	for name, contents := range map[string][]byte{"no items": []byte(testMedia["heic"]), "truncated": original[:len(original)-4]} {
+		if err := os.WriteFile(filename, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := stripHEICMetadata(filename); err == nil {
+			t.Errorf("expected the %s HEIC refused", name)
+		}
+	}
+}
+
+func TestStripMetadataHEICUnsupported(t *testing.T) {
+	if heicSupported {
+		t.Skip("HEICs are converted")
+	}
+	// without -tags heic, a HEIC's kept as it is, less its metadata
+	filename := writeTestHEIC(t)
+	stripped, mediaType, err := stripMetadata(filename, "image/heic")
+	if err != nil || stripped != filename || mediaType != "image/heic" {
+		t.Errorf("expected the HEIC kept, got %s (%s) %v", stripped, mediaType, err)
+	}
+	if bytes.Contains(mustReadFile(t, filename), []byte(testLocation)) {
+		t.Errorf("expected the location removed")
+	}
+
+	if _, _, err = stripMetadata(writeTestMedia(t, "heic")[0], "image/heic"); !errors.Is(err, errMetadataKept) {
+		t.Errorf("expected one that can't be read withheld, got %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Publisher is a destination that messages get posted to, like Micro.blog or
+// Twitter. A destination registers a PublisherFactory (see RegisterPublisher)
+// so post() never needs to know which ones exist.
+type Publisher interface {
+	// Name identifies the destination in logs, config & a Message's Results
+	Name() string
+	// Enabled reports whether the given message should be posted here, e.g.
+	// whether there's somewhere configured for test messages
+	Enabled(message *Message) bool
+	// UploadMedia uploads the message's downloaded images, returning whatever
+	// the destination uses to refer to each one (a URL, a media ID, etc.).
+	// Requests should be abandoned when ctx is done.
+	UploadMedia(ctx context.Context, message *Message) ([]string, error)
+	// Publish posts the message, along with the media references returned by
+	// UploadMedia, and returns the URL of the new post
+	Publish(ctx context.Context, message *Message, media []string) (string, error)
+}
+
+// PublishResult is the outcome of posting a message to one destination.
+type PublishResult struct {
+	URL   string
+	Media []string
+	Err   error
+}
+
+// publishResultJSON is how a PublishResult is saved, with the error as text
+type publishResultJSON struct {
+	URL   string
+	Media []string `json:",omitempty"`
+	Error string   `json:",omitempty"`
+}
+
+func (r PublishResult) MarshalJSON() ([]byte, error) {
+	saved := publishResultJSON{URL: r.URL, Media: r.Media}
+	if r.Err != nil {
+		saved.Error = r.Err.Error()
+	}
+	return json.Marshal(saved)
+}
+
+func (r *PublishResult) UnmarshalJSON(data []byte) error {
+	var saved publishResultJSON
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	*r = PublishResult{URL: saved.URL, Media: saved.Media}
+	if saved.Error != "" {
+		r.Err = errors.New(saved.Error)
+	}
+	return nil
+}
+
+// PublisherFactory builds a destination's Publisher from the config, returning
+// nil if that destination isn't configured.
+type PublisherFactory func(config Config) Publisher
+
+// PublishersFactory is like a PublisherFactory, for a destination that can be
+// configured more than once (like Micropub sites), with a Publisher for each.
+type PublishersFactory func(config Config) []Publisher
+
+type registeredPublisher struct {
+	name     string
+	priority int
+	factory  PublishersFactory
+}
+
+var publisherRegistry []registeredPublisher
+
+// configuredNames is the Publisher names from the last ConfiguredPublishers,
+// in order, which may differ from the registered names (see publisherNames)
+var (
+	configuredNamesMu sync.Mutex
+	configuredNames   []string
+)
+
+// RegisterPublisher adds a destination, and is best called from an init() in
+// the destination's own file. Destinations are listed in priority order,
+// lowest first, and the first one posted to gives the URL in the reply to the
+// sender; init() order depends on file names, so it can't be relied on.
+func RegisterPublisher(name string, priority int, factory PublisherFactory) {
+	RegisterPublishers(name, priority, func(config Config) []Publisher {
+		if publisher := factory(config); publisher != nil {
+			return []Publisher{publisher}
+		}
+		return nil
+	})
+}
+
+// RegisterPublishers adds a destination that can be configured more than once,
+// like RegisterPublisher. Its Publishers each need a different Name.
+func RegisterPublishers(name string, priority int, factory PublishersFactory) {
+	publisherRegistry = append(publisherRegistry, registeredPublisher{name: name, priority: priority, factory: factory})
+	sort.SliceStable(publisherRegistry, func(i, j int) bool {
+		return publisherRegistry[i].priority < publisherRegistry[j].priority
+	})
+}
+
+// ConfiguredPublishers returns a Publisher for each registered destination that
+// has configuration.
+func ConfiguredPublishers(config Config) []Publisher {
+	var publishers []Publisher
+	var names []string
+	for _, registered := range publisherRegistry {
+		configured := registered.factory(config)
+		if len(configured) == 0 {
+			log.Printf("no configuration for %s - skipping", registered.name)
+			continue
+		}
+		for _, publisher := range configured {
+			publishers = append(publishers, publisher)
+			names = append(names, publisher.Name())
+		}
+	}
+
+	configuredNamesMu.Lock()
+	configuredNames = names
+	configuredNamesMu.Unlock()
+	return publishers
+}
+
+// publisherNames returns the destination names in priority order: those of
+// the configured Publishers, followed by the registered names
+func publisherNames() []string {
+	configuredNamesMu.Lock()
+	names := append([]string(nil), configuredNames...)
+	configuredNamesMu.Unlock()
+	for _, registered := range publisherRegistry {
+		names = append(names, registered.name)
+	}
+	return names
+}
+
+// duplicateNames describes the publishers that share a name, which they
+// can't, since each one's result is kept under its name
+func duplicateNames(publishers []Publisher) []string {
+	var problems []string
+	seen := make(map[string]bool)
+	for _, publisher := range publishers {
+		if seen[publisher.Name()] {
+			problems = append(problems, fmt.Sprintf("more than one destination is named %q; give each Micropub site a different Name", publisher.Name()))
+		}
+		seen[publisher.Name()] = true
+	}
+	return problems
+}
+
+// publish uploads the message's media to the given destination, then posts it,
+// giving up on both once the timeout has passed.
+func publish(ctx context.Context, publisher Publisher, message *Message, timeout time.Duration) (result PublishResult) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result.Media, result.Err = publisher.UploadMedia(ctx, message)
+	if result.Err != nil {
+		return
+	}
+	result.URL, result.Err = publisher.Publish(ctx, message, result.Media)
+	return
+}
+
+// publishAll posts the message to every enabled destination at once, waiting
+// for all of them & recording each one's result in message.Results.
+func publishAll(ctx context.Context, publishers []Publisher, message *Message, timeout time.Duration) {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make(map[string]PublishResult)
+	)
+	// a message with no Received time gets one now, so every destination, &
+	// its upload & post both, go by the same one (e.g. for where it's put)
+	message.Received = message.ReceivedTime()
+	for _, publisher := range publishers {
+		if !publisher.Enabled(message) {
+			log.Printf("no %s destination configured for this message type - skipping", publisher.Name())
+			continue
+		}
+		wg.Add(1)
+		go func(publisher Publisher) {
+			defer wg.Done()
+			result := publish(ctx, publisher, message, timeout)
+			if result.Err != nil {
+				log.Printf("error posting message to %s: %s", publisher.Name(), result.Err)
+			}
+			mu.Lock()
+			results[publisher.Name()] = result
+			mu.Unlock()
+		}(publisher)
+	}
+	wg.Wait()
+	message.Results = results
+}
+
+// Succeeded returns the names of the destinations the message was posted to,
+// in priority order.
+func (m *Message) Succeeded() []string {
+	return m.resultNames(func(result PublishResult) bool { return result.Err == nil })
+}
+
+// Failed returns the names of the destinations posting the message failed for,
+// in priority order.
+func (m *Message) Failed() []string {
+	return m.resultNames(func(result PublishResult) bool { return result.Err != nil })
+}
+
+func (m *Message) resultNames(include func(PublishResult) bool) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range publisherNames() {
+		if result, ok := m.Results[name]; ok && !seen[name] && include(result) {
+			names = append(names, name)
+		}
+		seen[name] = true
+	}
+
+	// any others, e.g. in a dead letter from before the config changed
+	var others []string
+	for name, result := range m.Results {
+		if !seen[name] && include(result) {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
+// PublishError combines the errors from any destinations that failed,
+// noting which ones succeeded, or returns nil if none failed.
+func (m *Message) PublishError() error {
+	failed := m.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	var errs []error
+	for _, name := range failed {
+		errs = append(errs, fmt.Errorf("%s: %w", name, m.Results[name].Err))
+	}
+	return fmt.Errorf("failed posting to %s (succeeded: %s): %w",
+		strings.Join(failed, ", "), listOrNone(m.Succeeded()), errors.Join(errs...))
+}
+
+func listOrNone(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePublisher records what it was asked to post, and fails if told to
+type fakePublisher struct {
+	name    string
+	enabled bool
+	err     error
+	block   bool // wait for the context to be done, like a hung server
+	mu      sync.Mutex
+	posted  []string
+	media   []string // the media posted with the last message
+}
+
+func (p *fakePublisher) Name() string                  { return p.name }
+func (p *fakePublisher) Enabled(message *Message) bool { return p.enabled }
+
+func (p *fakePublisher) UploadMedia(ctx context.Context, message *Message) ([]string, error) {
+	var media []string
+	for _, filename := range message.ImageFilenames {
+		media = append(media, p.name+"/"+filename)
+	}
+	return media, nil
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, message *Message, media []string) (string, error) {
+	if p.block {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	if p.err != nil {
+		return "", p.err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.posted = append(p.posted, message.Text)
+	p.media = media
+	return "https://" + p.name + ".example.com/1", nil
+}
+
+func TestConfiguredPublishers(t *testing.T) {
+	TestMode = true
+	testConfig := LoadConfig()
+
+	var names []string
+	for _, publisher := range ConfiguredPublishers(testConfig) {
+		names = append(names, publisher.Name())
+	}
+	if len(names) != 2 || names[0] != "microblog" || names[1] != "twitter" {
+		t.Errorf("expected publishers [microblog twitter], got %v", names)
+	}
+
+	testConfig.Twitter = TwitterConfig{}
+	if len(ConfiguredPublishers(testConfig)) != 1 {
+		t.Errorf("expected unconfigured Twitter to be skipped")
+	}
+}
+
+func TestPostCollectsResults(t *testing.T) {
+	first := &fakePublisher{name: "microblog", enabled: true}
+	disabled := &fakePublisher{name: "disabled", enabled: false}
+
+	image := writeTestImages(t, 10)[0]
+	message := Message{Text: "hi", ImageFilenames: []string{image}}
+	if err := post(context.Background(), &message, []Publisher{first, disabled}); err != nil {
+		t.Errorf("expected no error, got %q", err)
+	}
+
+	if len(message.Results) != 1 {
+		t.Errorf("expected 1 result, got %d", len(message.Results))
+	}
+	result := message.Results["microblog"]
+	if result.URL != "https://microblog.example.com/1" {
+		t.Errorf("expected microblog URL, got %q", result.URL)
+	}
+	if len(result.Media) != 1 || result.Media[0] != "microblog/"+image {
+		t.Errorf("expected microblog media, got %v", result.Media)
+	}
+	if message.PostURL() != "https://microblog.example.com/1" {
+		t.Errorf("expected PostURL to be the microblog URL, got %q", message.PostURL())
+	}
+	if len(disabled.posted) != 0 {
+		t.Errorf("expected nothing posted to disabled publisher")
+	}
+}
+
+func TestPostReturnsError(t *testing.T) {
+	failing := &fakePublisher{name: "microblog", enabled: true, err: errors.New("boom")}
+	other := &fakePublisher{name: "twitter", enabled: true}
+	message := Message{Text: "hi"}
+	err := post(context.Background(), &message, []Publisher{failing, other})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "failed posting to microblog (succeeded: twitter)") {
+		t.Errorf("expected error to say which destinations failed & succeeded, got %q", err)
+	}
+	if message.Results["microblog"].Err == nil {
+		t.Errorf("expected the error to be recorded in the result")
+	}
+	// a failure doesn't stop the other destinations
+	if len(other.posted) != 1 {
+		t.Errorf("expected message posted to twitter despite microblog failing")
+	}
+	if message.PostURL() != "https://twitter.example.com/1" {
+		t.Errorf("expected PostURL to be the twitter URL, got %q", message.PostURL())
+	}
+}
+
+func TestPublishAllTimeout(t *testing.T) {
+	hung := &fakePublisher{name: "microblog", enabled: true, block: true}
+	other := &fakePublisher{name: "twitter", enabled: true}
+
+	message := Message{Text: "hi"}
+	start := time.Now()
+	publishAll(context.Background(), []Publisher{hung, other}, &message, 50*time.Millisecond)
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("expected publishAll to give up on the hung destination")
+	}
+
+	if !errors.Is(message.Results["microblog"].Err, context.DeadlineExceeded) {
+		t.Errorf("expected microblog to time out, got %v", message.Results["microblog"].Err)
+	}
+	if message.Results["twitter"].Err != nil {
+		t.Errorf("expected twitter to succeed, got %v", message.Results["twitter"].Err)
+	}
+}
+
+func TestReplyText(t *testing.T) {
+	ok := PublishResult{URL: "https://foo.micro.blog/1"}
+	failed := PublishResult{Err: errors.New("boom")}
+
+	var tests = []struct {
+		results  map[string]PublishResult
+		expected string
+	}{
+		{results: map[string]PublishResult{"microblog": ok}, expected: "message posted https://foo.micro.blog/1"},
+		{results: map[string]PublishResult{"microblog": ok, "twitter": failed}, expected: "message posted https://foo.micro.blog/1 (but failed: twitter)"},
+		{results: map[string]PublishResult{"microblog": failed, "twitter": failed}, expected: "sorry, your message could not be posted (failed: microblog, twitter)"},
+	}
+
+	for _, test := range tests {
+		message := Message{Results: test.results}
+		actual := replyText(&message)
+		if actual != test.expected {
+			t.Errorf("replyText(%v) != %q (%q)", test.results, test.expected, actual)
+		}
+	}
+	// files no destination could post are mentioned
+	message := Message{Results: map[string]PublishResult{"microblog": ok}, MediaTypes: []string{"image/jpeg", "image/heic"}, Withheld: []string{"video/webm"}}
+	expected := "message posted https://foo.micro.blog/1 - 2 of its files couldn't be posted anywhere (video/webm, image/heic)"
+	if heicSupported {
+		expected = "message posted https://foo.micro.blog/1 - 1 of its files couldn't be posted anywhere (video/webm)"
+	}
+	if actual := replyText(&message); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestDuplicateNames(t *testing.T) {
+	configured := ConfiguredPublishers(Config{Micropub: []MicropubConfig{
+		{Name: "blog", Endpoint: "https://a.example/micropub"},
+		{Name: "blog", Endpoint: "https://b.example/micropub"},
+	}})
+	if problems := duplicateNames(configured); len(problems) != 1 || !strings.Contains(problems[0], `"blog"`) {
+		t.Errorf("expected the duplicate name reported, got %v", problems)
+	}
+	configured[1].(*MicropubPublisher).config.Name = "photos"
+	if problems := duplicateNames(configured); len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+}
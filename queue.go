@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxJobAttempts is how many times a job's processing can start without
+// finishing, e.g. when the server's killed while posting it, before it's
+// given up on, rather than crashing every restart
+const maxJobAttempts = 3
+
+// Job is a received message waiting to be posted. Each one is saved as a JSON
+// file in the queue directory until it's been processed, so anything in there
+// after a crash or restart is picked up again.
+type Job struct {
+	ID       string
+	Received time.Time
+	Attempts int // times processing has started, including any interrupted
+	Message  Message
+}
+
+// Queue is a durable, on-disk queue of Jobs, worked by a pool of goroutines.
+type Queue struct {
+	dir     string
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []string
+	closed  bool
+	waiters map[string][]chan Message
+}
+
+// OpenQueue opens (creating, if need be) the queue in the given directory.
+// Jobs left over from a previous run are queued to be processed again.
+func OpenQueue(dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	q := &Queue{dir: dir, waiters: make(map[string][]chan Message)}
+	q.cond = sync.NewCond(&q.mu)
+
+	jobs, err := q.Jobs()
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		log.Printf("resuming unfinished job %s from %s (%d previous attempts)", job.ID, job.Message.From, job.Attempts)
+		q.pending = append(q.pending, job.ID)
+	}
+	return q, nil
+}
+
+func (q *Queue) path(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+func newJobID() string {
+	random := make([]byte, 4)
+	_, _ = rand.Read(random)
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(random))
+}
+
+// save writes the job to disk, atomically replacing any earlier version
+func (q *Queue) save(job *Job) error {
+	contents, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(q.path(job.ID), contents)
+}
+
+// Load reads the job with the given ID from disk
+func (q *Queue) Load(id string) (*Job, error) {
+	contents, err := os.ReadFile(q.path(id))
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err = json.Unmarshal(contents, &job); err != nil {
+		return nil, fmt.Errorf("error parsing job %s: %w", id, err)
+	}
+	return &job, nil
+}
+
+// Jobs returns every unfinished job on disk, oldest first.
+func (q *Queue) Jobs() ([]*Job, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*Job
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		job, err := q.Load(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			log.Printf("skipping unreadable job file %q: %s", name, err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Received.Before(jobs[j].Received) })
+	return jobs, nil
+}
+
+// Has reports whether the job with the given ID is still unfinished
+func (q *Queue) Has(id string) bool {
+	_, err := os.Stat(q.path(id))
+	return err == nil
+}
+
+// Enqueue saves the message to disk as a new job and queues it for the
+// workers. Once it returns without error, the message won't be lost. The job
+// ID is the message's Twilio MessageSid, when it has one.
+func (q *Queue) Enqueue(message Message) (*Job, error) {
+	id := message.MessageSid
+	if !IsMessageSid(id) {
+		id = newJobID()
+	}
+	job := &Job{ID: id, Received: time.Now(), Message: message}
+	if err := q.save(job); err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	q.pending = append(q.pending, job.ID)
+	q.mu.Unlock()
+	q.cond.Signal()
+	return job, nil
+}
+
+// Wait returns the processed message for the given job, or false if it
+// isn't finished within the timeout.
+func (q *Queue) Wait(id string, timeout time.Duration) (Message, bool) {
+	done := make(chan Message, 1)
+	q.mu.Lock()
+	if !q.Has(id) {
+		q.mu.Unlock()
+		return Message{}, false // already finished, but the result is gone
+	}
+	q.waiters[id] = append(q.waiters[id], done)
+	q.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case message := <-done:
+		return message, true
+	case <-timer.C:
+		return Message{}, false
+	}
+}
+
+// next blocks until there's a job to work on, returning false once closed
+func (q *Queue) next() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return "", false
+	}
+	id := q.pending[0]
+	q.pending = q.pending[1:]
+	return id, true
+}
+
+// finish removes a processed job from disk & hands its message to any waiters
+func (q *Queue) finish(job *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := os.Remove(q.path(job.ID)); err != nil {
+		log.Printf("error removing finished job %s: %s", job.ID, err)
+	}
+	for _, waiter := range q.waiters[job.ID] {
+		waiter <- job.Message
+	}
+	delete(q.waiters, job.ID)
+}
+
+// Run starts the given number of workers, each calling process for one job
+// at a time until the queue is closed. A job is only removed from disk after
+// process returns, so one interrupted by a crash is tried again on restart,
+// up to maxJobAttempts times. A job that panics, or that's been started that
+// many times, is handed to giveUp (if it isn't nil) & finished instead.
+func (q *Queue) Run(ctx context.Context, workers int, process func(ctx context.Context, message *Message), giveUp func(message *Message, err error)) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				id, ok := q.next()
+				if !ok {
+					return
+				}
+				job, err := q.Load(id)
+				if err != nil {
+					log.Printf("error loading job %s: %s", id, err)
+					continue
+				}
+				if job.Attempts >= maxJobAttempts {
+					err = fmt.Errorf("job %s was started %d times without finishing", job.ID, job.Attempts)
+				} else {
+					job.Attempts++
+					if err = q.save(job); err != nil {
+						log.Printf("error saving job %s: %s", id, err)
+					}
+					err = q.process(ctx, job, process)
+				}
+				if err != nil {
+					log.Printf("giving up on job %s: %s", job.ID, err)
+					if giveUp != nil {
+						giveUp(&job.Message, err)
+					}
+				}
+				q.finish(job)
+			}
+		}()
+	}
+}
+
+// process calls process for the job, returning an error if it panics
+func (q *Queue) process(ctx context.Context, job *Job, process func(ctx context.Context, message *Message)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic processing job %s: %v\n%s", job.ID, r, debug.Stack())
+			err = fmt.Errorf("job %s panicked: %v", job.ID, r)
+		}
+	}()
+	process(ctx, &job.Message)
+	return nil
+}
+
+// Close stops the workers once they finish their current jobs. Jobs still
+// waiting stay on disk for next time.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueEnqueue(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenQueue(dir)
+	if err != nil {
+		t.Fatalf("error opening queue: %s", err)
+	}
+
+	job, err := q.Enqueue(Message{From: "Gon", Text: "hi", TwilioImageURLs: []string{"https://example.com/ME456"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %q", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, job.ID+".json")); err != nil {
+		t.Errorf("expected job file to be written: %s", err)
+	}
+
+	jobs, err := q.Jobs()
+	if err != nil {
+		t.Fatalf("expected no error, got %q", err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("expected 1 job, got %d", len(jobs))
+	}
+	if jobs[0].Message.From != "Gon" || jobs[0].Message.TwilioImageURLs[0] != "https://example.com/ME456" {
+		t.Errorf("expected the saved job to hold the message, got %+v", jobs[0].Message)
+	}
+}
+
+func TestQueueResumesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	q, _ := OpenQueue(dir)
+	first, _ := q.Enqueue(Message{From: "Gon", Text: "first"})
+	second, _ := q.Enqueue(Message{From: "Killua", Text: "second"})
+	q.Close() // "crash" before any workers ran
+
+	q, err := OpenQueue(dir)
+	if err != nil {
+		t.Fatalf("error reopening queue: %s", err)
+	}
+	defer q.Close()
+
+	var (
+		mu        sync.Mutex
+		processed []string
+	)
+	q.Run(context.Background(), 1, func(ctx context.Context, message *Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, message.Text)
+	}, nil)
+
+	if _, ok := q.Wait(second.ID, 5*time.Second); !ok {
+		// may already be finished; the file being gone is what matters
+		if _, err := os.Stat(filepath.Join(dir, second.ID+".json")); err == nil {
+			t.Fatalf("expected resumed job to be processed")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(processed) != 2 || processed[0] != "first" || processed[1] != "second" {
+		t.Errorf("expected both jobs processed in order, got %v", processed)
+	}
+	for _, id := range []string{first.ID, second.ID} {
+		if _, err := os.Stat(filepath.Join(dir, id+".json")); !os.IsNotExist(err) {
+			t.Errorf("expected job %s to be removed once processed", id)
+		}
+	}
+}
+
+func TestQueueWait(t *testing.T) {
+	q, _ := OpenQueue(t.TempDir())
+	defer q.Close()
+
+	release := make(chan struct{})
+	q.Run(context.Background(), 1, func(ctx context.Context, message *Message) {
+		<-release
+		message.Results = map[string]PublishResult{"microblog": {URL: "https://foo.micro.blog/1"}}
+	}, nil)
+
+	job, _ := q.Enqueue(Message{From: "Gon", Text: "hi"})
+	if _, ok := q.Wait(job.ID, 10*time.Millisecond); ok {
+		t.Errorf("expected Wait to time out while the job is still running")
+	}
+
+	close(release)
+	message, ok := q.Wait(job.ID, 5*time.Second)
+	if !ok {
+		t.Fatalf("expected Wait to return the processed message")
+	}
+	if message.PostURL() != "https://foo.micro.blog/1" {
+		t.Errorf("expected processed message's results, got %v", message.Results)
+	}
+}
+
+func TestQueueCountsAttempts(t *testing.T) {
+	dir := t.TempDir()
+	q, _ := OpenQueue(dir)
+	job, _ := q.Enqueue(Message{From: "Gon", Text: "hi"})
+
+	started := make(chan struct{})
+	q.Run(context.Background(), 1, func(ctx context.Context, message *Message) {
+		close(started)
+		select {} // never finishes, like a crash mid-post
+	}, nil)
+	<-started
+	q.Close()
+
+	saved, err := q.Load(job.ID)
+	if err != nil {
+		t.Fatalf("expected interrupted job to still be on disk: %s", err)
+	}
+	if saved.Attempts != 1 {
+		t.Errorf("expected 1 attempt recorded, got %d", saved.Attempts)
+	}
+}
+
+func TestQueueRecoversPanics(t *testing.T) {
+	dir := t.TempDir()
+	q, _ := OpenQueue(dir)
+	defer q.Close()
+
+	gaveUp := make(chan error, 2)
+	q.Run(context.Background(), 1, func(ctx context.Context, message *Message) {
+		if message.Text == "bad" {
+			panic("a bad picture")
+		}
+	}, func(message *Message, err error) {
+		gaveUp <- err
+	})
+
+	bad, _ := q.Enqueue(Message{From: "Gon", Text: "bad"})
+	good, _ := q.Enqueue(Message{From: "Gon", Text: "good"})
+	if _, ok := q.Wait(good.ID, 5*time.Second); !ok && q.Has(good.ID) {
+		t.Fatalf("expected the worker to keep going after a panic")
+	}
+	if err := <-gaveUp; err == nil || !strings.Contains(err.Error(), "a bad picture") {
+		t.Errorf("expected the panicking job given up on, got %v", err)
+	}
+	if len(gaveUp) != 0 {
+		t.Errorf("expected only the panicking job given up on")
+	}
+	if q.Has(bad.ID) {
+		t.Errorf("expected the panicking job finished, not resumed")
+	}
+}
+
+func TestQueueGivesUpAfterAttempts(t *testing.T) {
+	dir := t.TempDir()
+	q, _ := OpenQueue(dir)
+	job, _ := q.Enqueue(Message{From: "Gon", Text: "crashes the server"})
+	job.Attempts = maxJobAttempts
+	if err := q.save(job); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	// restarted after it crashed the server every time it was started
+	q, _ = OpenQueue(dir)
+	defer q.Close()
+	processed := false
+	gaveUp := make(chan *Message, 1)
+	q.Run(context.Background(), 1, func(ctx context.Context, message *Message) {
+		processed = true
+	}, func(message *Message, err error) {
+		gaveUp <- message
+	})
+
+	select {
+	case message := <-gaveUp:
+		if message.Text != "crashes the server" {
+			t.Errorf("expected the job given up on, got %+v", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the job given up on")
+	}
+	if _, ok := q.Wait(job.ID, time.Second); !ok && q.Has(job.ID) {
+		t.Errorf("expected the job finished")
+	}
+	if processed {
+		t.Errorf("expected the job not started again")
+	}
+}
+
+func TestPublishResultJSON(t *testing.T) {
+	q, _ := OpenQueue(t.TempDir())
+	message := Message{
+		From: "Gon",
+		Results: map[string]PublishResult{
+			"microblog": {URL: "https://foo.micro.blog/1", Media: []string{"https://foo.micro.blog/1.jpg"}},
+			"twitter":   {Err: errors.New("boom")},
+		},
+	}
+	job, _ := q.Enqueue(message)
+
+	saved, err := q.Load(job.ID)
+	if err != nil {
+		t.Fatalf("expected no error, got %q", err)
+	}
+	if saved.Message.Results["microblog"].URL != "https://foo.micro.blog/1" {
+		t.Errorf("expected microblog URL to be saved, got %+v", saved.Message.Results["microblog"])
+	}
+	if err := saved.Message.Results["twitter"].Err; err == nil || err.Error() != "boom" {
+		t.Errorf("expected twitter error to be saved, got %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// replay implements `txt2mary replay`, which posts a dead-lettered message
+// again, returning the exit code.
+func replay(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	only := flags.String("only", "", "comma-separated destinations to post to, e.g. \"twitter\" (default: any not already posted to)")
+	dryRun := flags.Bool("dry-run", false, "show what would be posted, without posting anything")
+	flags.Usage = func() {
+		fmt.Fprintf(stdout, "usage: txt2mary replay [--only destinations] [--dry-run] <MessageSid or dead letter file>\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	letter, err := LoadDeadLetter(config.deadLetterDir(), flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return 1
+	}
+	message := letter.Message
+
+	chosen, err := replayPublishers(publishers, &message, *only)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return 1
+	}
+	if len(chosen) == 0 {
+		fmt.Fprintf(stdout, "nothing to post: message %s has already been posted everywhere\n", letter.ID)
+		return 0
+	}
+
+	if *dryRun {
+		fmt.Fprintf(stdout, "would post message %s from %s, with %d images: %q\n", letter.ID, message.From, len(message.ImageFilenames), message.Text)
+		for _, filename := range message.ImageFilenames {
+			fmt.Fprintf(stdout, "  image: %s\n", filename)
+		}
+		for _, publisher := range chosen {
+			fmt.Fprintf(stdout, "  to: %s\n", publisher.Name())
+		}
+		return 0
+	}
+
+	previous := message.Results
+	err = post(context.Background(), &message, chosen)
+	printResults(stdout, chosen, &message)
+
+	// keep what was already posted, along with what's posted now
+	for name, result := range previous {
+		if _, ok := message.Results[name]; !ok {
+			message.Results[name] = result
+		}
+	}
+
+	recordInArchive(stdout, &message)
+
+	// its pictures may have been downloaded, or converted or withheld while
+	// their metadata was removed
+	letter.Message.NumImages, letter.Message.TwilioImageURLs = message.NumImages, message.TwilioImageURLs
+	letter.Message.ImageFilenames, letter.Message.MediaTypes = message.ImageFilenames, message.MediaTypes
+	letter.Message.Withheld = message.Withheld
+	if err != nil {
+		letter.Message.Results = message.Results
+		letter.Error = err.Error()
+		letter.Failed = time.Now()
+		if saveErr := letter.Save(); saveErr != nil {
+			fmt.Fprintf(stdout, "error updating dead letter: %s\n", saveErr)
+		}
+		return 1
+	}
+	if err = letter.Remove(); err != nil {
+		fmt.Fprintf(stdout, "error removing dead letter: %s\n", err)
+	}
+	return 0
+}
+
+// replayPublishers picks the destinations to replay a message to: those
+// named, or else the ones it wasn't successfully posted to before
+func replayPublishers(publishers []Publisher, message *Message, only string) ([]Publisher, error) {
+	if only != "" {
+		return namedPublishers(publishers, only)
+	}
+
+	var chosen []Publisher
+	for _, publisher := range publishers {
+		if result, ok := message.Results[publisher.Name()]; ok && result.Err == nil {
+			continue
+		}
+		chosen = append(chosen, publisher)
+	}
+	return chosen, nil
+}
+
+// namedPublishers returns the destinations in a comma-separated list
+func namedPublishers(publishers []Publisher, names string) ([]Publisher, error) {
+	var chosen []Publisher
+	for _, name := range strings.Split(names, ",") {
+		publisher := findPublisher(publishers, strings.TrimSpace(name))
+		if publisher == nil {
+			return nil, fmt.Errorf("no configured destination named %q", name)
+		}
+		chosen = append(chosen, publisher)
+	}
+	return chosen, nil
+}
+
+func findPublisher(publishers []Publisher, name string) Publisher {
+	for _, publisher := range publishers {
+		if publisher.Name() == name {
+			return publisher
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupReplayTest saves a dead letter that was posted to microblog but not
+// twitter, with one image, and configures fake publishers for both
+func setupReplayTest(t *testing.T) (*fakePublisher, *fakePublisher, string) {
+	dir := t.TempDir()
+	config = Config{DeadLetterDir: dir, ArchiveFile: filepath.Join(t.TempDir(), "archive.db"), ArchiveImageDir: t.TempDir()}
+	microblog := &fakePublisher{name: "microblog", enabled: true}
+	twitter := &fakePublisher{name: "twitter", enabled: true}
+	publishers = []Publisher{microblog, twitter}
+	t.Cleanup(func() {
+		config = Config{}
+		publishers = nil
+	})
+
+	image := filepath.Join(t.TempDir(), "ME456_temp.jpg")
+	_ = os.WriteFile(image, []byte("jpeg"), 0600)
+	message := Message{
+		MessageSid:      "SM0123",
+		From:            "Gon",
+		Text:            "again",
+		NumImages:       1,
+		TwilioImageURLs: []string{"https://api.twilio.com/gone"},
+		ImageFilenames:  []string{image},
+		Results: map[string]PublishResult{
+			"microblog": {URL: "https://foo.micro.blog/1"},
+			"twitter":   {Err: errors.New("boom")},
+		},
+	}
+	filename, err := WriteDeadLetter(dir, message, errors.New("failed posting to twitter"))
+	if err != nil {
+		t.Fatalf("error writing dead letter: %s", err)
+	}
+	return microblog, twitter, filename
+}
+
+func TestReplayFailedDestinations(t *testing.T) {
+	microblog, twitter, filename := setupReplayTest(t)
+
+	var stdout bytes.Buffer
+	if code := replay([]string{"SM0123"}, &stdout); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stdout.String())
+	}
+
+	if len(microblog.posted) != 0 {
+		t.Errorf("expected microblog, already posted to, to be skipped")
+	}
+	if len(twitter.posted) != 1 {
+		t.Errorf("expected message replayed to twitter")
+	}
+	if stdout.String() != "twitter: https://twitter.example.com/1\n" {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("expected dead letter to be removed once replayed")
+	}
+}
+
+func TestReplayOnlyAndFilePath(t *testing.T) {
+	microblog, twitter, filename := setupReplayTest(t)
+
+	var stdout bytes.Buffer
+	if code := replay([]string{"--only", "microblog", filename}, &stdout); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stdout.String())
+	}
+	if len(microblog.posted) != 1 || len(twitter.posted) != 0 {
+		t.Errorf("expected only microblog to be posted to")
+	}
+	// the saved image is used, not downloaded again
+	if !strings.Contains(stdout.String(), "microblog: https://microblog.example.com/1") {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+
+	if code := replay([]string{"--only", "myspace", "SM0123"}, &stdout); code != 1 {
+		t.Errorf("expected an unknown destination to fail, got exit code %d", code)
+	}
+}
+
+func TestReplayDryRun(t *testing.T) {
+	microblog, twitter, filename := setupReplayTest(t)
+
+	var stdout bytes.Buffer
+	if code := replay([]string{"--dry-run", "SM0123"}, &stdout); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	if len(microblog.posted) != 0 || len(twitter.posted) != 0 {
+		t.Errorf("expected nothing posted on a dry run")
+	}
+	output := stdout.String()
+	if !strings.Contains(output, `would post message SM0123 from Gon, with 1 images: "again"`) || !strings.Contains(output, "to: twitter") {
+		t.Errorf("unexpected output %q", output)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("expected dead letter to be kept after a dry run")
+	}
+}
+
+func TestReplayFailureUpdatesDeadLetter(t *testing.T) {
+	_, twitter, filename := setupReplayTest(t)
+	twitter.err = errors.New("still down")
+
+	var stdout bytes.Buffer
+	if code := replay([]string{"SM0123"}, &stdout); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+
+	letter, err := LoadDeadLetter(config.DeadLetterDir, "SM0123")
+	if err != nil {
+		t.Fatalf("expected dead letter to be kept: %s", err)
+	}
+	if letter.filename != filename || !strings.Contains(letter.Error, "still down") {
+		t.Errorf("expected dead letter updated with the new error, got %+v", letter)
+	}
+	if letter.Message.Results["microblog"].URL != "https://foo.micro.blog/1" {
+		t.Errorf("expected earlier results to be kept, got %+v", letter.Message.Results)
+	}
+}
+
+func TestReplayPartialDownload(t *testing.T) {
+	_, twitter, _ := setupReplayTest(t)
+	useTestMediaDir(t)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte(testMedia["png"]))
+	}))
+	defer server.Close()
+
+	// the second picture failed to download, so only the first was saved
+	letter, err := LoadDeadLetter(config.DeadLetterDir, "SM0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	letter.Message.NumImages = 2
+	letter.Message.TwilioImageURLs = append(letter.Message.TwilioImageURLs, server.URL+"/ME789")
+	letter.Message.MediaTypes = []string{"image/jpeg", "image/png"}
+	if err = letter.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	if code := replay([]string{"--only", "twitter", "SM0123"}, &stdout); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stdout.String())
+	}
+	if requests != 1 {
+		t.Errorf("expected just the missing picture downloaded, got %d requests", requests)
+	}
+	if len(twitter.media) != 2 || !strings.Contains(twitter.media[0], "SM0123-0-ME456_temp.jpg") || !strings.Contains(twitter.media[1], "ME789_temp-") {
+		t.Errorf("expected both pictures posted, got %v", twitter.media)
+	}
+}
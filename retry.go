@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// StatusError is an unexpected HTTP status from one of the services we call.
+type StatusError struct {
+	Service    string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("got status code %d from %s", e.StatusCode, e.Service)
+}
+
+// checkStatus returns a StatusError unless the response status is 2xx
+func checkStatus(service string, resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{Service: service, StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error as one that retrying won't fix
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsRetryable reports whether a failed call might succeed if tried again:
+// timeouts, rate limits, server errors & network trouble are worth retrying,
+// while other 4xx statuses (bad token, bad request) are not.
+func IsRetryable(err error) bool {
+	var permanent *permanentError
+	if errors.As(err, &permanent) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		code := statusErr.StatusCode
+		return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+	}
+	return true
+}
+
+// mightHaveBeenSent reports whether a failed request might have reached the
+// server, & been acted on: anything but not being able to connect, or being
+// turned away by a rate limit
+func mightHaveBeenSent(err error) bool {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	if errors.As(err, &dnsErr) || errors.As(err, &opErr) && opErr.Op == "dial" {
+		return false
+	}
+	var statusErr *StatusError
+	return !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusTooManyRequests
+}
+
+// RetryPolicy says how many times to try a call, and how long to wait between
+// tries: the delay doubles each time, up to MaxDelay, with random jitter so
+// retries from concurrent messages don't all land at once.
+type RetryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+var defaultRetryPolicy = RetryPolicy{Attempts: 4, BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+
+// retryPolicy is used for every call to Twilio, Micro.blog, Twitter, etc.
+var retryPolicy = defaultRetryPolicy
+
+// backoff returns the delay before the given retry (1 for the first), which
+// is somewhere between half and all of the exponential delay
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Do calls fn until it succeeds, returns an error that isn't retryable, runs
+// out of attempts, or ctx is done.
+func (p RetryPolicy) Do(ctx context.Context, what string, fn func() error) error {
+	attempts := p.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if !IsRetryable(err) {
+			return fmt.Errorf("%s: %w", what, err)
+		}
+		if attempt == attempts {
+			break
+		}
+
+		delay := p.backoff(attempt)
+		log.Printf("try #%d of %s failed (retrying in %s): %s", attempt, what, delay.Round(time.Millisecond), err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%s: %w (after %d tries, last error: %s)", what, ctx.Err(), attempt, err)
+		case <-timer.C:
+		}
+	}
+	return fmt.Errorf("%s failed after %d tries: %w", what, attempts, err)
+}
+
+// DoOnce is Do for a call that creates something, like a post, that isn't
+// safe to repeat: it's only tried again if it can't have been sent (see
+// mightHaveBeenSent), since one that timed out or got a 5xx might have been
+// posted anyway, & trying again would post it twice
+func (p RetryPolicy) DoOnce(ctx context.Context, what string, fn func() error) error {
+	return p.Do(ctx, what, func() error {
+		err := fn()
+		if err != nil && mightHaveBeenSent(err) {
+			return Permanent(err)
+		}
+		return err
+	})
+}
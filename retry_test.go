@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+var fastRetries = RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+func TestIsRetryable(t *testing.T) {
+	var tests = []struct {
+		err      error
+		expected bool
+	}{
+		{err: &StatusError{Service: "Micro.blog", StatusCode: 500}, expected: true},
+		{err: &StatusError{Service: "Micro.blog", StatusCode: 503}, expected: true},
+		{err: &StatusError{Service: "Twitter", StatusCode: 429}, expected: true},
+		{err: &StatusError{Service: "Twitter", StatusCode: 408}, expected: true},
+		{err: fmt.Errorf("wrapped: %w", &StatusError{Service: "Twitter", StatusCode: 502}), expected: true},
+		{err: &StatusError{Service: "Micro.blog", StatusCode: 400}, expected: false},
+		{err: &StatusError{Service: "Micro.blog", StatusCode: 401}, expected: false},
+		{err: &StatusError{Service: "Twilio", StatusCode: 404}, expected: false},
+		{err: Permanent(errors.New("bad file")), expected: false},
+		{err: context.DeadlineExceeded, expected: false},
+		{err: errors.New("connection reset by peer"), expected: true},
+	}
+
+	for _, test := range tests {
+		if IsRetryable(test.err) != test.expected {
+			t.Errorf("IsRetryable(%v) != %v", test.err, test.expected)
+		}
+	}
+}
+
+func TestRetryPolicyDoOnce(t *testing.T) {
+	_, refused := http.Get("http://127.0.0.1:1/")
+	if refused == nil {
+		t.Skip("something's listening on port 1")
+	}
+	var tests = []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		// it might have been posted, so it isn't again
+		{name: "a 500", err: &StatusError{Service: "Micro.blog", StatusCode: 500}, expected: 1},
+		{name: "a timeout", err: fmt.Errorf("Post: %w", errors.New("i/o timeout")), expected: 1},
+		// it can't have been
+		{name: "a 429", err: &StatusError{Service: "Twitter", StatusCode: 429}, expected: 3},
+		{name: "no connection", err: refused, expected: 3},
+	}
+	for _, test := range tests {
+		tries := 0
+		err := fastRetries.DoOnce(context.Background(), "posting", func() error {
+			tries++
+			return test.err
+		})
+		if tries != test.expected || err == nil {
+			t.Errorf("expected a post that failed with %s tried %d times, got %d (%v)", test.name, test.expected, tries, err)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{Attempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	var tests = []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{retry: 1, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{retry: 2, min: 100 * time.Millisecond, max: 200 * time.Millisecond},
+		{retry: 3, min: 200 * time.Millisecond, max: 400 * time.Millisecond},
+		{retry: 8, min: 500 * time.Millisecond, max: time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			delay := policy.backoff(test.retry)
+			if delay < test.min || delay > test.max {
+				t.Errorf("backoff(%d) = %s, expected between %s & %s", test.retry, delay, test.min, test.max)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	var tests = []struct {
+		errs          []error // returned by each call, in order; nil once they run out
+		expectedCalls int
+		expectErr     bool
+	}{
+		{errs: nil, expectedCalls: 1, expectErr: false},
+		{errs: []error{&StatusError{StatusCode: 503}, &StatusError{StatusCode: 429}}, expectedCalls: 3, expectErr: false},
+		{errs: []error{&StatusError{StatusCode: 500}, &StatusError{StatusCode: 500}, &StatusError{StatusCode: 500}}, expectedCalls: 3, expectErr: true},
+		{errs: []error{&StatusError{StatusCode: 401}}, expectedCalls: 1, expectErr: true},
+		{errs: []error{errors.New("timeout"), Permanent(errors.New("no such file"))}, expectedCalls: 2, expectErr: true},
+	}
+
+	for _, test := range tests {
+		calls := 0
+		err := fastRetries.Do(context.Background(), "testing", func() error {
+			calls++
+			if calls <= len(test.errs) {
+				return test.errs[calls-1]
+			}
+			return nil
+		})
+		if calls != test.expectedCalls {
+			t.Errorf("expected %d calls for %v, got %d", test.expectedCalls, test.errs, calls)
+		}
+		if (err != nil) != test.expectErr {
+			t.Errorf("expected error %v for %v, got %v", test.expectErr, test.errs, err)
+		}
+	}
+}
+
+func TestRetryPolicyDoStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{Attempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+
+	calls := 0
+	err := policy.Do(ctx, "testing", func() error {
+		calls++
+		cancel()
+		return errors.New("try again")
+	})
+	if calls != 1 {
+		t.Errorf("expected 1 call, got %d", calls)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled error, got %v", err)
+	}
+}
+
+func TestGetTwilioImageRetries(t *testing.T) {
+	dir := useTestMediaDir(t)
+	retryPolicy = fastRetries
+	defer func() { retryPolicy = defaultRetryPolicy }()
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte("\n"))
+	}))
+	defer server.Close()
+
+	filename, _, err := GetTwilioImage(context.Background(), server.URL+testUrl, "image/jpeg")
+	if err != nil {
+		t.Errorf("expected download to succeed on retry, got %q", err)
+	}
+	defer cleanupDownload(filename)
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected just the one download, got %v", entries)
+	}
+}
+
+func TestGetTwilioImageCanceled(t *testing.T) {
+	dir := useTestMediaDir(t)
+	retryPolicy = RetryPolicy{Attempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	defer func() { retryPolicy = defaultRetryPolicy }()
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	// shutting down while it waits to try again gives up, rather than waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := GetTwilioImage(ctx, server.URL+testUrl, "image/jpeg"); err == nil {
+		t.Errorf("expected the download to give up")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected it to give up when canceled, took %s", elapsed)
+	}
+	if requests != 1 {
+		t.Errorf("expected 1 request, got %d", requests)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected nothing downloaded, got %v", entries)
+	}
+}
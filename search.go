@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SearchQuery is a full-text search of the archive: for messages containing
+// all the words in Terms (in their text or sender's name), optionally only
+// those received within a range of dates, or from one sender.
+type SearchQuery struct {
+	Terms  string
+	Sender string
+	Since  time.Time // inclusive; zero for no limit
+	Until  time.Time // exclusive; zero for no limit
+	Limit  int       // 0 for no limit
+	Offset int
+}
+
+// SearchResult is an archived message matching a search, with a snippet of
+// its text, in which the matching words are between highlightStart &
+// highlightEnd.
+type SearchResult struct {
+	ArchivedMessage
+	Snippet string
+}
+
+// the snippet's highlighting markers, which can't be in a text message & are
+// replaced for display
+const (
+	highlightStart = "\x02"
+	highlightEnd   = "\x03"
+)
+
+// ftsQuery turns what someone typed into an FTS5 query matching every word,
+// with each quoted so punctuation can't be taken for query syntax. A word
+// ending in "*" matches as a prefix.
+func ftsQuery(terms string) string {
+	var words []string
+	for _, word := range strings.Fields(terms) {
+		prefix := strings.HasSuffix(word, "*")
+		word = strings.TrimRight(word, "*")
+		if word == "" {
+			continue
+		}
+		quoted := `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+		if prefix {
+			quoted += "*"
+		}
+		words = append(words, quoted)
+	}
+	return strings.Join(words, " ")
+}
+
+// Search returns the messages matching the query, best matches first
+func (a *Archive) Search(query SearchQuery) ([]SearchResult, error) {
+	match := ftsQuery(query.Terms)
+	if match == "" {
+		return nil, fmt.Errorf("nothing to search for")
+	}
+	var since, until string
+	if !query.Since.IsZero() {
+		since = archiveTime(query.Since)
+	}
+	if !query.Until.IsZero() {
+		until = archiveTime(query.Until)
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	rows, err := a.db.Query(`SELECT m.id, coalesce(m.message_sid, ''), m.phone, m.sender, m.text, m.received_at, coalesce(m.processed_at, ''),
+			snippet(messages_fts, 0, ?, ?, '…', 16)
+		FROM messages_fts JOIN messages m ON m.id = messages_fts.rowid
+		WHERE messages_fts MATCH ?
+			AND (? = '' OR m.sender = ?)
+			AND (? = '' OR m.received_at >= ?)
+			AND (? = '' OR m.received_at < ?)
+		ORDER BY rank, m.received_at DESC
+		LIMIT ? OFFSET ?`,
+		highlightStart, highlightEnd, match, query.Sender, query.Sender, since, since, until, until, limit, query.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("error searching the archive: %w", err)
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var result SearchResult
+		var received, processed string
+		err = rows.Scan(&result.ID, &result.MessageSid, &result.Phone, &result.Sender, &result.Text, &received, &processed, &result.Snippet)
+		if err != nil {
+			return nil, err
+		}
+		result.Received, result.Processed = parseArchiveTime(received), parseArchiveTime(processed)
+		results = append(results, result)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	messages := make([]ArchivedMessage, len(results))
+	for i := range results {
+		messages[i] = results[i].ArchivedMessage
+	}
+	if err = a.loadDetails(messages); err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].ArchivedMessage = messages[i]
+	}
+	return results, nil
+}
+
+// highlight replaces the snippet's markers with the given strings
+func highlight(snippet string, start string, end string) string {
+	return strings.NewReplacer(highlightStart, start, highlightEnd, end).Replace(snippet)
+}
+
+// parseDateRange parses the since & until dates (YYYY-MM-DD, in local time,
+// either of which may be ""), returning the start of since & the end of until
+func parseDateRange(since string, until string) (time.Time, time.Time, error) {
+	var start, end time.Time
+	var err error
+	if since != "" {
+		if start, err = time.ParseInLocation("2006-01-02", since, time.Local); err != nil {
+			return start, end, fmt.Errorf("since %q isn't a date like 2023-11-27", since)
+		}
+	}
+	if until != "" {
+		if end, err = time.ParseInLocation("2006-01-02", until, time.Local); err != nil {
+			return start, end, fmt.Errorf("until %q isn't a date like 2023-11-27", until)
+		}
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end, nil
+}
+
+// searchCommand implements `txt2mary search`
+func searchCommand(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("search", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	since := flags.String("since", "", "only messages received on or after this date, e.g. 2023-11-27")
+	until := flags.String("until", "", "only messages received on or before this date")
+	sender := flags.String("sender", "", "only messages from this user")
+	limit := flags.Int("limit", 20, "the most messages to show (0 for all)")
+	asJSON := flags.Bool("json", false, "print the results as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(stdout, "usage: txt2mary search [--since date] [--until date] [--sender name] [--limit n] [--json] <words>...\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	start, end, err := parseDateRange(*since, *until)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return 2
+	}
+	commandArchive, err := openArchive(config)
+	if err == nil && commandArchive == nil {
+		err = fmt.Errorf("there's no archive to search (ArchiveFile is %q)", config.ArchiveFile)
+	}
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return 1
+	}
+	defer commandArchive.Close()
+
+	results, err := commandArchive.Search(SearchQuery{
+		Terms:  strings.Join(flags.Args(), " "),
+		Sender: *sender,
+		Since:  start,
+		Until:  end,
+		Limit:  *limit,
+	})
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		return writeSearchJSON(stdout, results)
+	}
+	if len(results) == 0 {
+		fmt.Fprintf(stdout, "no messages found\n")
+		return 0
+	}
+	for _, result := range results {
+		fmt.Fprintf(stdout, "%s  %s: %s\n", result.Received.Local().Format("2006-01-02 15:04"), result.Sender, highlight(result.Snippet, "[", "]"))
+		for _, posted := range result.Results {
+			if posted.URL != "" {
+				fmt.Fprintf(stdout, "    %s: %s\n", posted.Destination, posted.URL)
+			}
+		}
+	}
+	return 0
+}
+
+// searchResultJSON is how a SearchResult is shown by the JSON endpoint & the
+// search command's --json
+type searchResultJSON struct {
+	ID         int64             `json:"id"`
+	MessageSid string            `json:"messageSid,omitempty"`
+	Sender     string            `json:"sender"`
+	Text       string            `json:"text"`
+	Received   time.Time         `json:"received"`
+	Snippet    string            `json:"snippet"` // HTML, with matches in <mark>
+	Posts      map[string]string `json:"posts"`   // destination: URL
+}
+
+func writeSearchJSON(w io.Writer, results []SearchResult) int {
+	found := []searchResultJSON{}
+	for _, result := range results {
+		posts := make(map[string]string)
+		for _, posted := range result.Results {
+			if posted.URL != "" {
+				posts[posted.Destination] = posted.URL
+			}
+		}
+		found = append(found, searchResultJSON{
+			ID:         result.ID,
+			MessageSid: result.MessageSid,
+			Sender:     result.Sender,
+			Text:       result.Text,
+			Received:   result.Received,
+			Snippet:    highlight(html.EscapeString(result.Snippet), "<mark>", "</mark>"),
+			Posts:      posts,
+		})
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(map[string]interface{}{"results": found}); err != nil {
+		log.Printf("error writing search results: %s", err)
+		return 1
+	}
+	return 0
+}
+
+// searchHandler serves search results as JSON, for the parameters q (the
+// words to search for), & optionally since, until, sender, & limit
+func searchHandler(archive *Archive) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, end, err := parseDateRange(r.FormValue("since"), r.FormValue("until"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit := archivePageSize
+		if n, err := strconv.Atoi(r.FormValue("limit")); err == nil && n > 0 && n < limit {
+			limit = n
+		}
+		if ftsQuery(r.FormValue("q")) == "" {
+			http.Error(w, "nothing to search for", http.StatusBadRequest)
+			return
+		}
+
+		results, err := archive.Search(SearchQuery{
+			Terms:  r.FormValue("q"),
+			Sender: r.FormValue("sender"),
+			Since:  start,
+			Until:  end,
+			Limit:  limit,
+		})
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, "error searching the archive", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		writeSearchJSON(w, results)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupSearchTest archives a few messages from Gon & Killua, over 3 days
+func setupSearchTest(t *testing.T, archive *Archive) {
+	received := time.Date(2023, 11, 27, 14, 0, 0, 0, time.Local)
+	messages := []Message{
+		{MessageSid: "SM1", From: "Gon", Text: "went fishing at the lake, caught nothing", Received: received,
+			Results: map[string]PublishResult{"microblog": {URL: "https://foo.micro.blog/1"}}},
+		{MessageSid: "SM2", From: "Killua", Text: "Fishing again! <b>Café</b> after", Received: received.AddDate(0, 0, 1)},
+		{MessageSid: "SM3", From: "Gon", Text: "fisherman's breakfast", Received: received.AddDate(0, 0, 2)},
+	}
+	for _, message := range messages {
+		if _, err := archive.Record(&message); err != nil {
+			t.Fatalf("error archiving: %s", err)
+		}
+	}
+}
+
+func searchSids(results []SearchResult) string {
+	var sids []string
+	for _, result := range results {
+		sids = append(sids, result.MessageSid)
+	}
+	return strings.Join(sids, ",")
+}
+
+func TestArchiveSearch(t *testing.T) {
+	archive := openTestArchive(t, "")
+	setupSearchTest(t, archive)
+	day := func(d int) time.Time { return time.Date(2023, 11, d, 0, 0, 0, 0, time.Local) }
+
+	var tests = []struct {
+		query    SearchQuery
+		expected string
+	}{
+		{query: SearchQuery{Terms: "fishing"}, expected: "SM1,SM2"},
+		{query: SearchQuery{Terms: "FISHING lake"}, expected: "SM1"},
+		{query: SearchQuery{Terms: "fish*"}, expected: "SM1,SM2,SM3"},
+		{query: SearchQuery{Terms: "cafe"}, expected: "SM2"}, // without the accent
+		{query: SearchQuery{Terms: "killua"}, expected: "SM2"},
+		{query: SearchQuery{Terms: "fish* gon"}, expected: "SM1,SM3"},
+		{query: SearchQuery{Terms: `"fishing" AND OR (`}, expected: ""}, // not query syntax
+		{query: SearchQuery{Terms: "fish*", Sender: "Gon"}, expected: "SM1,SM3"},
+		{query: SearchQuery{Terms: "fish*", Since: day(28)}, expected: "SM2,SM3"},
+		{query: SearchQuery{Terms: "fish*", Until: day(29)}, expected: "SM1,SM2"},
+		{query: SearchQuery{Terms: "fish*", Since: day(28), Until: day(29)}, expected: "SM2"},
+		{query: SearchQuery{Terms: "fish*", Limit: 1, Offset: 1}, expected: "SM2"},
+	}
+	for _, test := range tests {
+		results, err := archive.Search(test.query)
+		if err != nil {
+			t.Errorf("error searching for %+v: %s", test.query, err)
+			continue
+		}
+		// sorted, as the rank of equally good matches isn't the point
+		if test.query.Limit == 0 {
+			results = sortedBySid(results)
+		}
+		if actual := searchSids(results); actual != test.expected {
+			t.Errorf("search for %+v found %q, not %q", test.query, actual, test.expected)
+		}
+	}
+
+	if _, err := archive.Search(SearchQuery{Terms: " * "}); err == nil {
+		t.Errorf("expected an error searching for nothing")
+	}
+}
+
+func sortedBySid(results []SearchResult) []SearchResult {
+	sort.Slice(results, func(i, j int) bool { return results[i].MessageSid < results[j].MessageSid })
+	return results
+}
+
+func TestArchiveSearchSnippets(t *testing.T) {
+	archive := openTestArchive(t, "")
+	setupSearchTest(t, archive)
+
+	results, err := archive.Search(SearchQuery{Terms: "lake"})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d (%v)", len(results), err)
+	}
+	if actual := highlight(results[0].Snippet, "[", "]"); actual != "went fishing at the [lake], caught nothing" {
+		t.Errorf("unexpected snippet %q", actual)
+	}
+	if len(results[0].Results) != 1 || results[0].Results[0].URL != "https://foo.micro.blog/1" {
+		t.Errorf("expected the message's results, got %+v", results[0].Results)
+	}
+}
+
+// an archive from before there was a search index is indexed when opened
+func TestArchiveSearchIndexesOldArchive(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "archive.db")
+	archive, err := OpenArchive(filename, "")
+	if err != nil {
+		t.Fatalf("error opening archive: %s", err)
+	}
+	setupSearchTest(t, archive)
+	_, err = archive.db.Exec(`DROP TABLE messages_fts;
+		DROP TRIGGER messages_fts_insert; DROP TRIGGER messages_fts_delete; DROP TRIGGER messages_fts_update`)
+	archive.Close()
+	if err != nil {
+		t.Fatalf("error dropping the index: %s", err)
+	}
+
+	archive = openTestArchiveFile(t, filename)
+	results, err := archive.Search(SearchQuery{Terms: "fishing"})
+	if err != nil || len(results) != 2 {
+		t.Errorf("expected the old messages indexed, got %d (%v)", len(results), err)
+	}
+}
+
+func openTestArchiveFile(t *testing.T, filename string) *Archive {
+	archive, err := OpenArchive(filename, "")
+	if err != nil {
+		t.Fatalf("error opening archive: %s", err)
+	}
+	t.Cleanup(func() { archive.Close() })
+	return archive
+}
+
+func TestSearchCommand(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "archive.db")
+	setupSearchTest(t, openTestArchiveFile(t, filename))
+	config = Config{ArchiveFile: filename}
+	defer func() { config = Config{} }()
+
+	var stdout bytes.Buffer
+	if code := searchCommand([]string{"--since", "2023-11-27", "--until", "2023-11-27", "fishing"}, &stdout); code != 0 {
+		t.Fatalf("expected success, got %d: %s", code, stdout.String())
+	}
+	expected := "2023-11-27 14:00  Gon: went [fishing] at the lake, caught nothing\n    microblog: https://foo.micro.blog/1\n"
+	if stdout.String() != expected {
+		t.Errorf("expected %q, got %q", expected, stdout.String())
+	}
+
+	stdout.Reset()
+	if code := searchCommand([]string{"--json", "--sender", "Killua", "fishing"}, &stdout); code != 0 {
+		t.Fatalf("expected success, got %d: %s", code, stdout.String())
+	}
+	var found struct{ Results []searchResultJSON }
+	if err := json.Unmarshal(stdout.Bytes(), &found); err != nil || len(found.Results) != 1 {
+		t.Fatalf("expected 1 result as JSON, got %s (%v)", stdout.String(), err)
+	}
+	if found.Results[0].Snippet != "<mark>Fishing</mark> again! &lt;b&gt;Café&lt;/b&gt; after" {
+		t.Errorf("expected an escaped, highlighted snippet, got %q", found.Results[0].Snippet)
+	}
+
+	for _, args := range [][]string{{}, {"--since", "yesterday", "fishing"}} {
+		stdout.Reset()
+		if code := searchCommand(args, &stdout); code != 2 {
+			t.Errorf("expected %q to be a usage error, got %d", args, code)
+		}
+	}
+	stdout.Reset()
+	if code := searchCommand([]string{"hunting"}, &stdout); code != 0 || stdout.String() != "no messages found\n" {
+		t.Errorf("expected nothing found, got %d %q", code, stdout.String())
+	}
+}
+
+func TestSearchWeb(t *testing.T) {
+	archive := openTestArchive(t, "")
+	setupSearchTest(t, archive)
+	handler := ArchiveWebHandler(archive, WebConfig{Username: "mary", Password: "secret"}, "")
+
+	if w := getArchivePage(handler, "/archive/search.json?q=fishing", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected search to need the password, got %d", w.Code)
+	}
+
+	w := getArchivePage(handler, "/archive/search.json?q=fish*&since=2023-11-28&limit=1", "secret")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected JSON, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var found struct{ Results []searchResultJSON }
+	if err := json.Unmarshal(w.Body.Bytes(), &found); err != nil || len(found.Results) != 1 {
+		t.Fatalf("expected 1 result, got %s (%v)", w.Body.String(), err)
+	}
+	if sid := found.Results[0].MessageSid; sid != "SM2" && sid != "SM3" {
+		t.Errorf("expected a message since the 28th, got %s", sid)
+	}
+
+	for _, target := range []string{"/archive/search.json", "/archive/search.json?q=fishing&until=soon"} {
+		if w = getArchivePage(handler, target, "secret"); w.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be a bad request, got %d", target, w.Code)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+func init() {
+	RegisterPublisher("static", 17, func(config Config) Publisher {
+		if config.StaticSite.ContentDir == "" {
+			return nil
+		}
+		return &StaticSitePublisher{config: config.StaticSite, template: config.postTemplate("static", textPostTemplate)}
+	})
+}
+
+// StaticSitePublisher writes each message as a Markdown post, with front
+// matter Hugo & Jekyll both understand, into a static site's source, then
+// optionally rebuilds the site.
+type StaticSitePublisher struct {
+	config   StaticSiteConfig
+	mu       sync.Mutex // one build at a time
+	template *PostTemplate
+}
+
+func (p *StaticSitePublisher) Name() string {
+	return "static"
+}
+
+// Enabled only writes test messages to a test site (& real messages to the
+// real site), like Twitter
+func (p *StaticSitePublisher) Enabled(message *Message) bool {
+	return IsTestMessage(message) == p.config.TestSite
+}
+
+var slugUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+const slugWords = 6
+
+// postSlug names the message's post: its date, its first few words, & a bit
+// of its MessageSid (or time) so two posts the same day can't collide. It's
+// the same every time for the same message, so a replay overwrites the post.
+func postSlug(message *Message) string {
+	received := message.ReceivedTime()
+	words := strings.Fields(strings.Trim(slugUnsafe.ReplaceAllString(strings.ToLower(message.Text), " "), " "))
+	if len(words) > slugWords {
+		words = words[:slugWords]
+	}
+	if len(words) == 0 {
+		words = []string{"txt"}
+	}
+
+	unique := received.Format("150405")
+	if IsMessageSid(message.MessageSid) && len(message.MessageSid) >= 6 {
+		unique = strings.ToLower(message.MessageSid[len(message.MessageSid)-6:])
+	}
+	return received.Format("2006-01-02") + "-" + strings.Join(words, "-") + "-" + unique
+}
+
+// staticSiteImageLimits is the pictures copied into a static site, which shows
+// them with <img>, so they're converted to JPEG if need be, & turned upright
+var staticSiteImageLimits = ImageLimits{Types: webImageTypes}
+
+// UploadMedia copies the Message's images into the site's assets directory,
+// returning the URL path of each. Pictures browsers can't show are converted,
+// & files of other types skipped.
+func (p *StaticSitePublisher) UploadMedia(ctx context.Context, message *Message) ([]string, error) {
+	files, remove := message.prepareMedia("the static site", staticSiteImageLimits)
+	defer remove()
+	if len(files) == 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(p.config.AssetsDir, 0755); err != nil {
+		return nil, err
+	}
+
+	slug := postSlug(message)
+	var imageURLs []string
+	for i, file := range files {
+		filename := file.Filename
+		name := fmt.Sprintf("%s-%d%s", slug, i+1, mediaExtension(file.Type))
+		if err := copyFile(filename, filepath.Join(p.config.AssetsDir, name)); err != nil {
+			log.Printf("error copying %q into the static site: %s", filename, err)
+			return imageURLs, err
+		}
+		imageURLs = append(imageURLs, path.Join("/", p.config.AssetsURL, name))
+	}
+	return imageURLs, nil
+}
+
+// yamlString quotes s for front matter; a JSON string is a valid YAML one
+func yamlString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+// postTitle is the start of the message's first line
+func postTitle(text string) string {
+	title, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	if runes := []rune(title); len(runes) > 60 {
+		title = strings.TrimSpace(string(runes[:59])) + "…"
+	}
+	return title
+}
+
+// markdownPost renders the Message as Markdown with YAML front matter, &
+// the body as formatted by the destination's template
+func markdownPost(message *Message, body string, imageURLs []string) []byte {
+	var post bytes.Buffer
+	post.WriteString("---\n")
+	fmt.Fprintf(&post, "title: %s\n", yamlString(postTitle(message.Text)))
+	fmt.Fprintf(&post, "date: %s\n", message.ReceivedTime().Format("2006-01-02T15:04:05-07:00"))
+	fmt.Fprintf(&post, "author: %s\n", yamlString(message.From))
+	post.WriteString("categories:\n  - txt\n")
+	if len(imageURLs) > 0 {
+		post.WriteString("images:\n")
+		for _, imageURL := range imageURLs {
+			fmt.Fprintf(&post, "  - %s\n", yamlString(imageURL))
+		}
+	}
+	post.WriteString("---\n\n")
+
+	post.WriteString(strings.TrimSpace(body) + "\n")
+	for i, imageURL := range imageURLs {
+		fmt.Fprintf(&post, "\n![picture %d of %d texted by %s](%s)\n", i+1, len(imageURLs), message.From, imageURL)
+	}
+	return post.Bytes()
+}
+
+// build runs the configured build command, if any
+func (p *StaticSitePublisher) build(ctx context.Context) error {
+	if len(p.config.BuildCommand) == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cmd := exec.CommandContext(ctx, p.config.BuildCommand[0], p.config.BuildCommand[1:]...)
+	cmd.Dir = p.config.BuildDir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error building the static site with %q: %w\n%s", p.config.BuildCommand, err, output)
+	}
+	log.Printf("built the static site with %q", p.config.BuildCommand)
+	return nil
+}
+
+// permalink fills in the post's slug & date in the configured Permalink,
+// e.g. "https://mary.example.com/{year}/{month}/{slug}/"
+func (p *StaticSitePublisher) permalink(message *Message, slug string) string {
+	received := message.ReceivedTime()
+	return strings.NewReplacer(
+		"{slug}", slug,
+		"{year}", received.Format("2006"),
+		"{month}", received.Format("01"),
+		"{day}", received.Format("02"),
+	).Replace(p.config.Permalink)
+}
+
+// Publish writes the Markdown post into the content directory & rebuilds the
+// site, returning the post's permalink (if one's configured).
+func (p *StaticSitePublisher) Publish(ctx context.Context, message *Message, imageURLs []string) (string, error) {
+	if err := os.MkdirAll(p.config.ContentDir, 0755); err != nil {
+		return "", err
+	}
+	body, err := p.template.or(textPostTemplate).Format(message)
+	if err != nil {
+		return "", Permanent(err)
+	}
+	slug := postSlug(message)
+	filename := filepath.Join(p.config.ContentDir, slug+".md")
+	if err := writeFileAtomic(filename, markdownPost(message, body, imageURLs)); err != nil {
+		log.Printf("error writing post %q: %s", filename, err)
+		return "", err
+	}
+	_ = os.Chmod(filename, 0644) // the temp file it was written as is private
+	log.Printf("wrote message to static site post %q\n", filename)
+
+	if err := p.build(ctx); err != nil {
+		log.Printf("%s", err)
+		return "", err
+	}
+	return p.permalink(message, slug), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStaticSite(t *testing.T) *StaticSitePublisher {
+	dir := t.TempDir()
+	return &StaticSitePublisher{config: StaticSiteConfig{
+		ContentDir: filepath.Join(dir, "content", "posts"),
+		AssetsDir:  filepath.Join(dir, "static", "images"),
+		AssetsURL:  "/images",
+		Permalink:  "https://mary.example.com/{year}/{month}/{slug}/",
+		BuildDir:   dir,
+	}}
+}
+
+func TestStaticSitePublisher(t *testing.T) {
+	publisher := newTestStaticSite(t)
+	received := time.Date(2023, 11, 27, 14, 32, 5, 0, time.FixedZone("CST", -6*60*60))
+	message := Message{
+		MessageSid:     "SM0123456789ABCDEF",
+		From:           "Gon",
+		Text:           "just a \"couple\" bros\nat the lake",
+		Received:       received,
+		ImageFilenames: writeTestImages(t, 10, 10),
+	}
+
+	result := publish(context.Background(), publisher, &message, defaultPublishTimeout)
+	if result.Err != nil {
+		t.Fatalf("expected no error, got %q", result.Err)
+	}
+	slug := "2023-11-27-just-a-couple-bros-at-the-abcdef"
+	if result.URL != "https://mary.example.com/2023/11/"+slug+"/" {
+		t.Errorf("unexpected permalink %q", result.URL)
+	}
+
+	for i, name := range []string{slug + "-1.jpg", slug + "-2.jpg"} {
+		if _, err := os.Stat(filepath.Join(publisher.config.AssetsDir, name)); err != nil {
+			t.Errorf("expected image %d copied to %s: %s", i+1, name, err)
+		}
+	}
+
+	post, err := os.ReadFile(filepath.Join(publisher.config.ContentDir, slug+".md"))
+	if err != nil {
+		t.Fatalf("expected the post written: %s", err)
+	}
+	expected := `---
+title: "just a \"couple\" bros"
+date: 2023-11-27T14:32:05-06:00
+author: "Gon"
+categories:
+  - txt
+images:
+  - "/images/` + slug + `-1.jpg"
+  - "/images/` + slug + `-2.jpg"
+---
+
+just a "couple" bros
+at the lake
+
+![picture 1 of 2 texted by Gon](/images/` + slug + `-1.jpg)
+
+![picture 2 of 2 texted by Gon](/images/` + slug + `-2.jpg)
+`
+	if string(post) != expected {
+		t.Errorf("unexpected post:\n%s\nexpected:\n%s", post, expected)
+	}
+}
+
+func TestStaticSitePostTemplate(t *testing.T) {
+	publisher := newTestStaticSite(t)
+	publisher.template = mustParsePostTemplate("static", "{{.Text}}\n\n({{.From}}, {{.Date.Format \"Jan 2\"}})")
+	message := Message{MessageSid: "SM0123456789ABCDEF", From: "Gon", Text: "hello", Received: time.Date(2023, 11, 27, 14, 32, 5, 0, time.UTC)}
+
+	if result := publish(context.Background(), publisher, &message, defaultPublishTimeout); result.Err != nil {
+		t.Fatalf("expected no error, got %q", result.Err)
+	}
+	post, _ := os.ReadFile(filepath.Join(publisher.config.ContentDir, postSlug(&message)+".md"))
+	if !strings.HasSuffix(string(post), "---\n\nhello\n\n(Gon, Nov 27)\n") {
+		t.Errorf("expected the body from the template, got:\n%s", post)
+	}
+}
+
+func TestStaticSiteBuild(t *testing.T) {
+	publisher := newTestStaticSite(t)
+	publisher.config.BuildCommand = []string{"touch", "built"}
+	message := Message{From: "Gon", Text: "hi"}
+
+	if result := publish(context.Background(), publisher, &message, defaultPublishTimeout); result.Err != nil {
+		t.Fatalf("expected no error, got %q", result.Err)
+	}
+	if _, err := os.Stat(filepath.Join(publisher.config.BuildDir, "built")); err != nil {
+		t.Errorf("expected the build command run in BuildDir: %s", err)
+	}
+
+	publisher.config.BuildCommand = []string{"false"}
+	result := publish(context.Background(), publisher, &message, defaultPublishTimeout)
+	if result.Err == nil || !strings.Contains(result.Err.Error(), "error building the static site") {
+		t.Errorf("expected a build error, got %v", result.Err)
+	}
+}
+
+func TestPostSlug(t *testing.T) {
+	received := time.Date(2023, 11, 27, 9, 5, 0, 0, time.UTC)
+	var tests = []struct {
+		message  Message
+		expected string
+	}{
+		{message: Message{Text: "Hello, World!", MessageSid: "SM00000000000000000000000000ABC123"}, expected: "2023-11-27-hello-world-abc123"},
+		{message: Message{Text: "one two three four five six seven eight"}, expected: "2023-11-27-one-two-three-four-five-six-090500"},
+		{message: Message{Text: "✨✨"}, expected: "2023-11-27-txt-090500"},
+	}
+	for _, test := range tests {
+		test.message.Received = received
+		if actual := postSlug(&test.message); actual != test.expected {
+			t.Errorf("postSlug(%q) != %q (%q)", test.message.Text, test.expected, actual)
+		}
+	}
+}
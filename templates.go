@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// The default post templates: a Markdown quote for blogs & the feeds, which
+// render it, plain text in quotes for the social networks, which don't, &
+// just the text for the static site & git archive, whose posts say who it's
+// from in their front matter. An empty message is quoted as a non-breaking
+// space, so the quote is kept.
+const (
+	defaultMarkdownTemplate = "> {{if .Text}}{{.Text}}{{else}}&nbsp;{{end}}\n\n&ndash; {{.From}}"
+	defaultPlainTemplate    = "\"{{.Text}}\"\n\n– {{.From}}"
+	defaultTextTemplate     = "{{.Text}}"
+)
+
+// unknownSender is who a message is from when the sender isn't known, which
+// shouldn't happen, but just in case
+const unknownSender = "(unknown sender)"
+
+// feedTemplateName is the Templates entry for the feeds, which aren't a
+// destination but show messages as one would
+const feedTemplateName = "feed"
+
+// PostData is what a post template has to work with, e.g. {{.From}} or
+// {{.Date.Format "Jan 2"}}
+type PostData struct {
+	From   string // the sender's name
+	Text   string
+	Date   time.Time // when the message was received
+	Images int       // how many pictures it has
+	Test   bool      // whether it's a test message
+}
+
+func newPostData(message *Message) PostData {
+	images := len(message.ImageFilenames)
+	if message.NumImages > images {
+		images = message.NumImages
+	}
+	from := message.From
+	if from == "" {
+		from = unknownSender
+	}
+	return PostData{
+		From:   from,
+		Text:   message.Text,
+		Date:   message.ReceivedTime(),
+		Images: images,
+		Test:   IsTestMessage(message),
+	}
+}
+
+// PostTemplate formats messages for a destination
+type PostTemplate struct {
+	template *template.Template
+}
+
+// parsePostTemplate parses a post template, checking it by formatting a
+// sample message, so a mistake like {{.Sender}} is caught up front
+func parsePostTemplate(name string, text string) (*PostTemplate, error) {
+	parsed, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	postTemplate := &PostTemplate{template: parsed}
+	sample := &Message{From: "Gon", Text: "just a couple bros", Received: time.Now(), NumImages: 1}
+	if _, err = postTemplate.Format(sample); err != nil {
+		return nil, err
+	}
+	return postTemplate, nil
+}
+
+func mustParsePostTemplate(name string, text string) *PostTemplate {
+	postTemplate, err := parsePostTemplate(name, text)
+	if err != nil {
+		panic(err)
+	}
+	return postTemplate
+}
+
+var (
+	markdownPostTemplate = mustParsePostTemplate("markdown", defaultMarkdownTemplate)
+	plainPostTemplate    = mustParsePostTemplate("plain", defaultPlainTemplate)
+	textPostTemplate     = mustParsePostTemplate("text", defaultTextTemplate)
+)
+
+// Format formats the message for posting
+func (t *PostTemplate) Format(message *Message) (string, error) {
+	var text strings.Builder
+	if err := t.template.Execute(&text, newPostData(message)); err != nil {
+		return "", err
+	}
+	return text.String(), nil
+}
+
+// or returns the template, or the fallback if there isn't one (as for a
+// publisher that wasn't made by its factory)
+func (t *PostTemplate) or(fallback *PostTemplate) *PostTemplate {
+	if t == nil {
+		return fallback
+	}
+	return t
+}
+
+// postTemplate returns the configured template for the destination, or the
+// fallback. A mistake in the configured one means using the fallback, but
+// setup refuses to start with one, so that's only for the tests.
+func (c Config) postTemplate(name string, fallback *PostTemplate) *PostTemplate {
+	text, ok := c.Templates[name]
+	if !ok {
+		return fallback
+	}
+	postTemplate, err := parsePostTemplate(name, text)
+	if err != nil {
+		log.Printf("error in the %s template, so using the default: %s", name, err)
+		return fallback
+	}
+	return postTemplate
+}
+
+// templateProblems checks the configured templates, returning any mistakes
+// in them, & warnings about templates for destinations that aren't
+// configured (so they're probably misnamed)
+func templateProblems(c Config) (problems []string, warnings []string) {
+	names := map[string]bool{feedTemplateName: true}
+	for _, publisher := range ConfiguredPublishers(c) {
+		names[publisher.Name()] = true
+	}
+	var configured []string
+	for name := range c.Templates {
+		configured = append(configured, name)
+	}
+	sort.Strings(configured)
+
+	for _, name := range configured {
+		if _, err := parsePostTemplate(name, c.Templates[name]); err != nil {
+			problems = append(problems, fmt.Sprintf("the %s template has a mistake: %s", name, err))
+		}
+		if !names[name] {
+			warnings = append(warnings, fmt.Sprintf("there's a template for %q, but no destination by that name", name))
+		}
+	}
+	return problems, warnings
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultPostTemplates(t *testing.T) {
+	var tests = []struct {
+		template *PostTemplate
+		message  Message
+		expected string
+	}{
+		{template: markdownPostTemplate, message: Message{From: "Gon", Text: "Thinking of you!"}, expected: "> Thinking of you!\n\n&ndash; Gon"},
+		{template: markdownPostTemplate, message: Message{From: "Killua"}, expected: "> &nbsp;\n\n&ndash; Killua"},
+		{template: plainPostTemplate, message: Message{From: "Gon", Text: "hello"}, expected: "\"hello\"\n\n– Gon"},
+		{template: textPostTemplate, message: Message{From: "Gon", Text: "hello"}, expected: "hello"},
+		// shouldn't happen, but just in case
+		{template: markdownPostTemplate, message: Message{Text: "Hello"}, expected: "> Hello\n\n&ndash; (unknown sender)"},
+		{template: plainPostTemplate, message: Message{Text: "Hello"}, expected: "\"Hello\"\n\n– (unknown sender)"},
+	}
+	for _, test := range tests {
+		actual, err := test.template.Format(&test.message)
+		if err != nil || actual != test.expected {
+			t.Errorf("Format(%+v) = %q (%v); expected %q", test.message, actual, err, test.expected)
+		}
+	}
+}
+
+func TestCustomPostTemplate(t *testing.T) {
+	c := Config{Templates: map[string]string{
+		"mastodon": `{{.Text}} ({{.From}}, {{.Date.Format "Jan 2"}}{{if .Images}}, {{.Images}} pictures{{end}}){{if .Test}} #test{{end}}`,
+	}}
+	postTemplate := c.postTemplate("mastodon", plainPostTemplate)
+	message := Message{From: "Gon", Text: "TEST: fish", Received: time.Date(2023, 11, 27, 14, 0, 0, 0, time.UTC), NumImages: 2}
+	if text, err := postTemplate.Format(&message); err != nil || text != "TEST: fish (Gon, Nov 27, 2 pictures) #test" {
+		t.Errorf("unexpected post %q (%v)", text, err)
+	}
+	if c.postTemplate("twitter", plainPostTemplate) != plainPostTemplate {
+		t.Errorf("expected the default for a destination without a template")
+	}
+
+	fake := newFakeMastodon(t)
+	publisher := &MastodonPublisher{config: MastodonConfig{Server: fake.URL + "/", AccessToken: "token123"}, template: postTemplate}
+	message.Text = "hello"
+	if result := publish(context.Background(), publisher, &message, defaultPublishTimeout); result.Err != nil {
+		t.Fatalf("expected no error, got %q", result.Err)
+	}
+	if status := fake.statuses[0].PostForm.Get("status"); status != "hello (Gon, Nov 27, 2 pictures)" {
+		t.Errorf("expected the status from the template, got %q", status)
+	}
+}
+
+func TestTemplateProblems(t *testing.T) {
+	c := Config{
+		Mastodon: MastodonConfig{Server: "https://mastodon.social", AccessToken: "token"},
+		Templates: map[string]string{
+			"mastodon": "{{.Sender}} said {{.Text}}",
+			"feed":     "{{.Text",
+			"mastodom": "{{.Text}}",
+		},
+	}
+	problems, warnings := templateProblems(c)
+	if len(problems) != 2 || !strings.HasPrefix(problems[0], "the feed template has a mistake") ||
+		!strings.HasPrefix(problems[1], "the mastodon template has a mistake") || !strings.Contains(problems[1], "Sender") {
+		t.Errorf("expected the feed & mastodon templates' mistakes, got %q", problems)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `"mastodom"`) {
+		t.Errorf("expected a warning about the misnamed template, got %q", warnings)
+	}
+
+	problems, _ = CheckConfig(c)
+	if !strings.Contains(strings.Join(problems, "\n"), "the mastodon template has a mistake") {
+		t.Errorf("expected CheckConfig to report the template's mistake, got %q", problems)
+	}
+	if c.postTemplate("mastodon", plainPostTemplate) != plainPostTemplate {
+		t.Errorf("expected the default in place of a template with a mistake")
+	}
+}
+
+// the static site & git archive use their templates for the post's body
+func TestStaticPostTemplates(t *testing.T) {
+	c := Config{
+		StaticSite: StaticSiteConfig{ContentDir: t.TempDir(), AssetsDir: t.TempDir()},
+		GitArchive: GitArchiveConfig{Dir: t.TempDir()},
+		Templates:  map[string]string{"static": "{{.Text}} #static", "git": "{{.Text}} #git"},
+	}
+	message := &Message{From: "Gon", Text: "hello"}
+	for _, publisher := range ConfiguredPublishers(c) {
+		var postTemplate *PostTemplate
+		switch p := publisher.(type) {
+		case *StaticSitePublisher:
+			postTemplate = p.template
+		case *GitArchivePublisher:
+			postTemplate = p.template
+		default:
+			continue
+		}
+		if text, _ := postTemplate.or(textPostTemplate).Format(message); text != "hello #"+publisher.Name() {
+			t.Errorf("expected %s's template used, got %q", publisher.Name(), text)
+		}
+	}
+	if _, warnings := templateProblems(c); len(warnings) != 0 {
+		t.Errorf("expected no warnings, got %v", warnings)
+	}
+}
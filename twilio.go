@@ -1,14 +1,23 @@
 package main
 
 import (
-	"errors"
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type TwilioPayload struct {
@@ -27,12 +36,86 @@ type TwilioPayload struct {
 	MediaUrl9 string
 }
 
+// TwilioSignature computes the value Twilio sends in the X-Twilio-Signature
+// header: a base64 HMAC-SHA1, keyed by the account's auth token, of the full
+// request URL followed by each POST parameter's name & value, sorted by name.
+func TwilioSignature(authToken string, fullUrl string, params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var builder strings.Builder
+	builder.WriteString(fullUrl)
+	for _, key := range keys {
+		values := append([]string(nil), params[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			builder.WriteString(key)
+			builder.WriteString(value)
+		}
+	}
+
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(builder.String()))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ValidTwilioSignature reports whether signature matches the one expected for
+// the given URL & POST parameters.
+func ValidTwilioSignature(authToken string, fullUrl string, params url.Values, signature string) bool {
+	if signature == "" {
+		return false
+	}
+	expected := TwilioSignature(authToken, fullUrl, params)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// twilioRequestURL reconstructs the URL Twilio used to call us. Behind a proxy
+// the URL seen here differs from the one Twilio signed, so a configured
+// PublicURL (e.g. "https://txt.example.com") replaces the scheme & host.
+func twilioRequestURL(r *http.Request) string {
+	if config.Twilio.PublicURL != "" {
+		return strings.TrimSuffix(config.Twilio.PublicURL, "/") + r.URL.RequestURI()
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+// ValidateTwilioRequest checks the X-Twilio-Signature header of a webhook
+// request, whose form must already be parsed. When no Twilio AuthToken is
+// configured there's nothing to check against, so every request is accepted.
+func ValidateTwilioRequest(r *http.Request) bool {
+	if config.Twilio.AuthToken == "" {
+		return true
+	}
+	return ValidTwilioSignature(config.Twilio.AuthToken, twilioRequestURL(r), r.PostForm, r.Header.Get("X-Twilio-Signature"))
+}
+
+var messageSidPattern = regexp.MustCompile(`^[A-Za-z0-9]{1,64}$`)
+
+// IsMessageSid reports whether s looks like a Twilio MessageSid, which is safe
+// to use in a filename
+func IsMessageSid(s string) bool {
+	return messageSidPattern.MatchString(s)
+}
+
 // ParseTwilioWebhook parses webhook post from Twilio,
-// returning a Message populated with From, Text, & TwilioImageURLs
+// returning a Message populated with Phone, From, Text, Received, MessageSid,
+// TwilioImageURLs, & their MediaTypes
 func ParseTwilioWebhook(formData map[string][]string) Message {
 	msg := Message{
-		From: LookupPhone(formData["From"][0]),
-		Text: formData["Body"][0],
+		Phone:    formData["From"][0],
+		From:     LookupPhone(formData["From"][0]),
+		Text:     formData["Body"][0],
+		Received: time.Now(),
+	}
+	if sid, ok := formData["MessageSid"]; ok {
+		msg.MessageSid = sid[0]
 	}
 
 	var err error
@@ -46,57 +129,98 @@ func ParseTwilioWebhook(formData map[string][]string) Message {
 		parameterName := fmt.Sprintf("MediaUrl%d", i)
 		mediaUrl := formData[parameterName][0]
 		msg.TwilioImageURLs = append(msg.TwilioImageURLs, mediaUrl)
+		var mediaType string
+		if values := formData[fmt.Sprintf("MediaContentType%d", i)]; len(values) > 0 {
+			mediaType = values[0]
+		}
+		msg.MediaTypes = append(msg.MediaTypes, mediaType)
 	}
 
 	log.Printf("received twilio post from %s, with %d images: %q", msg.From, msg.NumImages, msg.Text)
 	return msg
 }
 
-// GetTwilioImage downloads the image file at the given URL,
-// saves it to a filename based on the URL, and returns that filename.
-func GetTwilioImage(url string) (string, error) {
+// GetTwilioImage downloads the media file at the given URL, which the
+// webhook said is of the given type, & saves it in the media dir, with a
+// unique filename based on the URL & the extension for its type, e.g.
+// ME123_temp-456.jpg. It returns that filename & type, which is what the
+// file's contents say it is, if they do. It gives up if the context is done,
+// e.g. when the server's shutting down.
+func GetTwilioImage(ctx context.Context, url string, declaredType string) (string, string, error) {
 	// get last ID from URL for filename
 	pieces := strings.Split(url, "/")
-	filename := pieces[len(pieces)-1] + "_temp.jpg"
-
-	response, err := http.Get(url)
-	if err != nil {
-		return filename, err
-	}
-	defer response.Body.Close()
+	var filename, mediaType string
 
-	if response.StatusCode != 200 {
-		return filename, errors.New(fmt.Sprintf("Bad response code: %d", response.StatusCode))
+	dir := config.mediaDir()
+	if err := ensureMediaDir(dir); err != nil {
+		log.Printf("error with the media dir: %s", err)
+		return "", "", err
 	}
+	err := retryPolicy.Do(ctx, "downloading "+url+" from Twilio", func() error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return Permanent(err)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
 
-	file, err := os.Create(filename)
-	if err != nil {
-		return filename, err
-	}
-	defer file.Close()
+		if err = checkStatus("Twilio", response); err != nil {
+			return err
+		}
 
-	_, err = io.Copy(file, response.Body)
-	if err != nil {
-		return filename, err
-	}
+		body := bufio.NewReaderSize(response.Body, mediaSniffLength)
+		head, _ := body.Peek(mediaSniffLength) // a shorter file is fine
+		mediaType = detectMediaType(head, declaredType, response.Header.Get("Content-Type"))
 
-	return filename, nil
+		// unique, so the same media in messages posted at once can't collide
+		file, err := os.CreateTemp(dir, pieces[len(pieces)-1]+"_temp-*"+mediaExtension(mediaType))
+		if err != nil {
+			return Permanent(err)
+		}
+		_, err = io.Copy(file, body)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(file.Name()) // a partial download
+			return err
+		}
+		filename = file.Name()
+		return nil
+	})
+	return filename, mediaType, err
 }
 
-func DownloadTwilioImages(msg *Message) error {
-	for i := 0; i < msg.NumImages; i++ {
-		filename, err := GetTwilioImage(msg.TwilioImageURLs[i])
+// DownloadTwilioImages downloads the Message's media that isn't here yet: all
+// of it, or the rest of it, for a dead letter saved when downloading failed
+// partway, whose files are the ones that were downloaded
+func DownloadTwilioImages(ctx context.Context, msg *Message) error {
+	for i := len(msg.ImageFilenames); i < msg.NumImages && i < len(msg.TwilioImageURLs); i++ {
+		var declaredType string
+		if i < len(msg.MediaTypes) {
+			declaredType = msg.MediaTypes[i]
+		}
+		filename, mediaType, err := GetTwilioImage(ctx, msg.TwilioImageURLs[i], declaredType)
 		if err != nil {
 			log.Printf("error downloading %q", msg.TwilioImageURLs[i])
 			return err
 		}
 		msg.ImageFilenames = append(msg.ImageFilenames, filename)
-		log.Printf("downloaded image %q from Twilio\n", filename)
+		for len(msg.MediaTypes) <= i {
+			msg.MediaTypes = append(msg.MediaTypes, "")
+		}
+		msg.MediaTypes[i] = mediaType
+		log.Printf("downloaded %s %q from Twilio\n", mediaType, filename)
 	}
 	return nil
 }
 
-func RemoveTwilioImages(msg Message) {
+// RemoveTwilioImages deletes the message's downloaded files, once it's been
+// posted (or saved as a dead letter)
+func RemoveTwilioImages(msg *Message) {
 	for _, filename := range msg.ImageFilenames {
 		err := os.Remove(filename)
 		if err != nil {
@@ -106,3 +230,60 @@ func RemoveTwilioImages(msg Message) {
 		}
 	}
 }
+
+// staleMediaAge is how old a file in the media dir must be for the sweep to
+// remove it: older than any message takes to post
+const staleMediaAge = time.Hour
+
+// mediaFilePattern matches the names of the files txt2mary puts in the media
+// dir: downloads like ME123_temp-456.jpg, the copies converted from them, &
+// the temp files they're rewritten with. Nothing else is swept.
+var mediaFilePattern = regexp.MustCompile(`_temp-[0-9-]+(\.[a-z0-9]+)?(-[0-9]+)?$`)
+
+// ensureMediaDir creates the media dir, if need be, & makes sure it's private:
+// a real directory, not a symlink, that no one but its owner can use, since
+// texts' pictures are kept there
+func ensureMediaDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("media dir %q isn't a directory (or is a symlink)", dir)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("media dir %q can be used by other users (its mode is %s, not 0700)", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// sweepMediaDir removes the files left in the media dir by messages that
+// never finished, e.g. when the server crashed while posting them (dead
+// letters keep copies of theirs, & queued messages download theirs again)
+func sweepMediaDir(dir string, age time.Duration) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("error reading media dir %q: %s", dir, err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !mediaFilePattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < age {
+			continue
+		}
+		filename := filepath.Join(dir, entry.Name())
+		if err = os.Remove(filename); err != nil {
+			log.Printf("error removing file %q: %s\n", filename, err)
+		} else {
+			log.Printf("removed stale file %q\n", filename)
+		}
+	}
+}
@@ -1,40 +1,103 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 const testUrl = "/2010-04-01/Accounts/AC123/Messages/MM0123/Media/ME2fe37blahblah"
 
 const testTwilioMsg = "{ \"ToCountry\": \"US\", \"MediaContentType0\": \"image/jpeg\", \"ToState\": \"AL\", \"SmsMessageSid\": \"MM0123\", \"NumMedia\": \"1\", \"ToCity\": \"\", \"FromZip\": \"78765\", \"SmsSid\": \"MM0123\", \"FromState\": \"TX\", \"SmsStatus\": \"received\", \"FromCity\": \"AUSTIN\", \"Body\": \"Here is another pic\", \"FromCountry\": \"US\", \"To\": \"+12055551212\", \"ToZip\": \"\", \"NumSegments\": \"1\", \"MessageSid\": \"MM0123\", \"AccountSid\": \"AC123\", \"From\": \"+15125551212\", \"MediaUrl0\": \"https://api.twilio.com/2010-04-01/Accounts/AC123/Messages/MM0123/Media/ME456\", \"ApiVersion\": \"2010-04-01\" }"
 
+// useTestMediaDir has media downloaded to a private temp dir for the test,
+// returning it
+func useTestMediaDir(t *testing.T) string {
+	previous := config.MediaDir
+	config.MediaDir = t.TempDir()
+	if err := os.Chmod(config.MediaDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { config.MediaDir = previous })
+	return config.MediaDir
+}
+
+// isTestDownload reports whether the file was downloaded to the dir, named for
+// the media's ID, as the sweep expects
+func isTestDownload(dir string, filename string, id string, extension string) bool {
+	name := filepath.Base(filename)
+	return filepath.Dir(filename) == dir && strings.HasPrefix(name, id+"_temp-") && filepath.Ext(name) == extension && mediaFilePattern.MatchString(name)
+}
+
 func cleanupDownload(filename string) {
 	if err := os.Remove(filename); err != nil {
 		log.Fatal("error removing file: " + filename)
 	}
 }
 
-func TestGetTwilio(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "GET" {
-			t.Errorf("Expected method GET, got: %s", r.Method)
-		}
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("\n")) // just return a newline to be saved in the temp file
-	}))
-	defer server.Close()
+// testMedia is the start of a file of each type Twilio might pass on
+var testMedia = map[string]string{
+	"jpeg":  "\xff\xd8\xff\xe0\x00\x10JFIF\x00",
+	"png":   "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR",
+	"gif":   "GIF89a\x01\x00\x01\x00",
+	"heic":  "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic",
+	"mp4":   "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom",
+	"mov":   "\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00qt  ",
+	"3gp":   "\x00\x00\x00\x18ftyp3gp4\x00\x00\x00\x003gp4isom",
+	"vcard": "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Gon Freecss\r\nEND:VCARD\r\n",
+	"amr":   "#!AMR\n\x3c\x91",
+}
 
-	filename, _ := GetTwilioImage(server.URL + testUrl)
-	defer cleanupDownload(filename)
+func TestGetTwilio(t *testing.T) {
+	dir := useTestMediaDir(t)
+	var tests = []struct {
+		contents     string
+		declaredType string
+		servedType   string
+		extension    string
+		mediaType    string
+	}{
+		{contents: testMedia["jpeg"], declaredType: "image/jpeg", extension: ".jpg", mediaType: "image/jpeg"},
+		{contents: testMedia["png"], declaredType: "image/jpeg", extension: ".png", mediaType: "image/png"},
+		{contents: testMedia["gif"], extension: ".gif", mediaType: "image/gif"},
+		{contents: testMedia["heic"], declaredType: "image/heic", extension: ".heic", mediaType: "image/heic"},
+		{contents: testMedia["mp4"], declaredType: "video/mp4", extension: ".mp4", mediaType: "video/mp4"},
+		{contents: testMedia["mov"], declaredType: "video/quicktime", extension: ".mov", mediaType: "video/quicktime"},
+		{contents: testMedia["3gp"], declaredType: "video/3gpp", extension: ".3gp", mediaType: "video/3gpp"},
+		{contents: testMedia["vcard"], declaredType: "text/x-vcard", extension: ".vcf", mediaType: "text/vcard"},
+		{contents: testMedia["amr"], declaredType: "audio/amr", extension: ".amr", mediaType: "audio/amr"},
+		{contents: "\n", servedType: "image/png", extension: ".png", mediaType: "image/png"},
+		{contents: "\n", extension: ".bin", mediaType: "application/octet-stream"},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				t.Errorf("Expected method GET, got: %s", r.Method)
+			}
+			w.Header().Set("Content-Type", test.servedType)
+			_, _ = w.Write([]byte(test.contents))
+		}))
 
-	if filename != "ME2fe37blahblah_temp.jpg" {
-		t.Errorf("Expected 'ME2fe37blahblah_temp.jpg', got %s", filename)
+		filename, mediaType, err := GetTwilioImage(context.Background(), server.URL+testUrl, test.declaredType)
+		server.Close()
+		if err != nil {
+			t.Fatalf("expected no error, got %q", err)
+		}
+		if !isTestDownload(dir, filename, "ME2fe37blahblah", test.extension) || mediaType != test.mediaType {
+			t.Errorf("expected a %s (%s) in %s for %q, got %s (%s)", test.extension, test.mediaType, dir, test.contents, filename, mediaType)
+		}
+		if contents, _ := os.ReadFile(filename); string(contents) != test.contents {
+			t.Errorf("expected %s to be downloaded whole, got %q", filename, contents)
+		}
+		cleanupDownload(filename)
 	}
 }
 
@@ -62,12 +125,17 @@ func TestUnmarshalling(t *testing.T) {
 func TestParseTwilioWebhook(t *testing.T) {
 	TestMode = true
 	data := url.Values{}
+	data.Set("MessageSid", "MM0123")
 	data.Set("From", "+15125551212")
 	data.Set("Body", "Here is another pic")
 	data.Set("NumMedia", "1")
 	data.Add("MediaUrl0", "https://api.twilio.com/2010-04-01/Accounts/AC123/Messages/MM0123/Media/ME456")
+	data.Add("MediaContentType0", "image/png")
 	message := ParseTwilioWebhook(data)
 
+	if message.MessageSid != "MM0123" {
+		t.Errorf("expected Message.MessageSid of 'MM0123', got %q", message.MessageSid)
+	}
 	if message.From != "Gon" {
 		t.Errorf("expected Message.From of 'Gon', got %q", message.From)
 	}
@@ -84,9 +152,13 @@ func TestParseTwilioWebhook(t *testing.T) {
 	if message.TwilioImageURLs[0] != "https://api.twilio.com/2010-04-01/Accounts/AC123/Messages/MM0123/Media/ME456" {
 		t.Errorf("expected Message.TwilioImageURL to be set, got %q", message.TwilioImageURLs[0])
 	}
+	if len(message.MediaTypes) != 1 || message.MediaTypes[0] != "image/png" {
+		t.Errorf("expected Message.MediaTypes of [image/png], got %q", message.MediaTypes)
+	}
 }
 
 func TestDownloadTwilioImages(t *testing.T) {
+	dir := useTestMediaDir(t)
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("\n")) // just return a newline to be saved in the temp file
@@ -96,9 +168,10 @@ func TestDownloadTwilioImages(t *testing.T) {
 	message := Message{
 		NumImages:       1,
 		TwilioImageURLs: []string{server.URL + "/2010-04-01/Accounts/AC123/Messages/MM0123/Media/ME456"},
+		MediaTypes:      []string{"image/jpeg"},
 	}
 
-	err := DownloadTwilioImages(&message)
+	err := DownloadTwilioImages(context.Background(), &message)
 	if err != nil {
 		t.Errorf("expected no error, got %q", err)
 	}
@@ -106,9 +179,250 @@ func TestDownloadTwilioImages(t *testing.T) {
 	if len(message.ImageFilenames) != 1 {
 		t.Errorf("expected 1 ImageFilename, got %d", len(message.ImageFilenames))
 	}
-	if message.ImageFilenames[0] != "ME456_temp.jpg" {
-		t.Errorf("expected ImageFilename to be 'ME456_temp.jpg', got %q", message.ImageFilenames[0])
+	if !isTestDownload(dir, message.ImageFilenames[0], "ME456", ".jpg") {
+		t.Errorf("expected ImageFilename to be an ME456 JPEG in %s, got %q", dir, message.ImageFilenames[0])
+	}
+	if len(message.MediaTypes) != 1 || message.MediaTypes[0] != "image/jpeg" {
+		t.Errorf("expected the declared media type, got %q", message.MediaTypes)
 	}
 
 	cleanupDownload(message.ImageFilenames[0])
 }
+
+func TestGetTwilioImageRemovesPartialDownload(t *testing.T) {
+	dir := useTestMediaDir(t)
+	retryPolicy = fastRetries
+	defer func() { retryPolicy = defaultRetryPolicy }()
+
+	// the connection's dropped partway through
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		_, _ = w.Write([]byte(testMedia["jpeg"]))
+	}))
+	defer server.Close()
+
+	if _, _, err := GetTwilioImage(context.Background(), server.URL+testUrl, "image/jpeg"); err == nil {
+		t.Errorf("expected an error for a partial download")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected the partial downloads removed, got %v", entries)
+	}
+}
+
+func TestSweepMediaDir(t *testing.T) {
+	dir := t.TempDir()
+	stale, fresh := filepath.Join(dir, "ME1_temp-1.jpg"), filepath.Join(dir, "ME2_temp-2.jpg")
+	converted, other := filepath.Join(dir, "ME3_temp-3-4.jpg"), filepath.Join(dir, "notes.txt")
+	old := time.Now().Add(-2 * staleMediaAge)
+	for _, filename := range []string{stale, fresh, converted, other} {
+		if err := os.WriteFile(filename, []byte(testMedia["jpeg"]), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if filename != fresh {
+			if err := os.Chtimes(filename, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// a symlink's left alone, even named like a download
+	link := filepath.Join(dir, "ME5_temp-5.jpg")
+	if err := os.Symlink(other, link); err != nil {
+		t.Fatal(err)
+	}
+
+	sweepMediaDir(dir, staleMediaAge)
+	for _, filename := range []string{stale, converted} {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("expected the stale file %s removed", filepath.Base(filename))
+		}
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("expected the file still being posted kept, got %s", err)
+	}
+	for _, filename := range []string{other, link} {
+		if _, err := os.Lstat(filename); err != nil {
+			t.Errorf("expected %s, which txt2mary didn't download, kept, got %s", filepath.Base(filename), err)
+		}
+	}
+
+	// there's nothing to sweep before anything's been downloaded
+	sweepMediaDir(filepath.Join(dir, "nothing"), staleMediaAge)
+}
+
+func TestEnsureMediaDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "media")
+	if err := ensureMediaDir(dir); err != nil {
+		t.Fatalf("expected the media dir created, got %s", err)
+	}
+	if info, _ := os.Stat(dir); !info.IsDir() || info.Mode().Perm() != 0700 {
+		t.Errorf("expected a private dir, got %s", info.Mode())
+	}
+
+	// one others could use, or that's really somewhere else, is refused
+	shared := filepath.Join(t.TempDir(), "shared")
+	if err := os.Mkdir(shared, 0700); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chmod(shared, 0777)
+	if err := ensureMediaDir(shared); err == nil || !strings.Contains(err.Error(), "other users") {
+		t.Errorf("expected a shared dir refused, got %v", err)
+	}
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureMediaDir(link); err == nil || !strings.Contains(err.Error(), "symlink") {
+		t.Errorf("expected a symlink refused, got %v", err)
+	}
+
+	// & nothing's downloaded there
+	previous := config.MediaDir
+	config.MediaDir = shared
+	defer func() { config.MediaDir = previous }()
+	if _, _, err := GetTwilioImage(context.Background(), "http://127.0.0.1:1"+testUrl, "image/jpeg"); err == nil {
+		t.Errorf("expected no download to a shared media dir")
+	}
+}
+
+func TestValidTwilioSignature(t *testing.T) {
+	// the first case is the example from Twilio's webhook security docs
+	docParams := url.Values{}
+	docParams.Set("CallSid", "CA1234567890ABCDE")
+	docParams.Set("Caller", "+12349013030")
+	docParams.Set("Digits", "1234")
+	docParams.Set("From", "+12349013030")
+	docParams.Set("To", "+18005551212")
+
+	smsParams := url.Values{}
+	smsParams.Set("From", "+15125551214")
+	smsParams.Set("Body", "Hello")
+	smsParams.Set("NumMedia", "0")
+	smsParams.Set("MessageSid", "MM0123")
+
+	var tests = []struct {
+		authToken string
+		fullUrl   string
+		params    url.Values
+		signature string
+		expected  bool
+	}{
+		{authToken: "12345", fullUrl: "https://mycompany.com/myapp.php?foo=1&bar=2", params: docParams, signature: "0/KCTR6DLpKmkAf8muzZqo1nDgQ=", expected: true},
+		{authToken: "12345", fullUrl: "https://txt.example.com/txt", params: smsParams, signature: "WTP3xA9XGfbv382vB7Iyupjur9w=", expected: true},
+		{authToken: "12345", fullUrl: "http://example.com/txt", params: smsParams, signature: "rnWj9q8Fbu98CMdMfGEhfFWdZhc=", expected: true},
+		{authToken: "12345", fullUrl: "http://example.com/txt", params: smsParams, signature: "WTP3xA9XGfbv382vB7Iyupjur9w=", expected: false},
+		{authToken: "54321", fullUrl: "https://txt.example.com/txt", params: smsParams, signature: "WTP3xA9XGfbv382vB7Iyupjur9w=", expected: false},
+		{authToken: "12345", fullUrl: "https://txt.example.com/txt", params: docParams, signature: "WTP3xA9XGfbv382vB7Iyupjur9w=", expected: false},
+		{authToken: "12345", fullUrl: "https://txt.example.com/txt", params: smsParams, signature: "", expected: false},
+	}
+
+	for _, test := range tests {
+		actual := ValidTwilioSignature(test.authToken, test.fullUrl, test.params, test.signature)
+		if actual != test.expected {
+			t.Errorf("ValidTwilioSignature(%q, %q, %v, %q) != %v", test.authToken, test.fullUrl, test.params, test.signature, test.expected)
+		}
+	}
+}
+
+func TestValidateTwilioRequest(t *testing.T) {
+	TestMode = true
+	config = LoadConfig()
+	defer func() { config = Config{} }()
+
+	data := url.Values{}
+	data.Set("From", "+15125551214")
+	data.Set("Body", "Hello")
+	data.Set("NumMedia", "0")
+	data.Set("MessageSid", "MM0123")
+
+	var tests = []struct {
+		publicUrl string
+		target    string
+		signature string
+		expected  bool
+	}{
+		// behind a proxy, Twilio signed the public URL, not the one we see
+		{publicUrl: "https://txt.example.com", target: "http://127.0.0.1:8088/txt", signature: "WTP3xA9XGfbv382vB7Iyupjur9w=", expected: true},
+		{publicUrl: "https://txt.example.com/", target: "http://127.0.0.1:8088/txt", signature: "WTP3xA9XGfbv382vB7Iyupjur9w=", expected: true},
+		{publicUrl: "https://txt.example.com", target: "http://127.0.0.1:8088/txt", signature: "rnWj9q8Fbu98CMdMfGEhfFWdZhc=", expected: false},
+		// without a PublicURL, the request's own host is used
+		{publicUrl: "", target: "http://example.com/txt", signature: "rnWj9q8Fbu98CMdMfGEhfFWdZhc=", expected: true},
+		{publicUrl: "", target: "http://example.com/txt", signature: "bogus", expected: false},
+		{publicUrl: "", target: "http://example.com/txt", signature: "", expected: false},
+	}
+
+	for _, test := range tests {
+		config.Twilio.PublicURL = test.publicUrl
+		r := httptest.NewRequest(http.MethodPost, test.target, strings.NewReader(data.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.signature != "" {
+			r.Header.Set("X-Twilio-Signature", test.signature)
+		}
+		_ = r.ParseForm()
+
+		actual := ValidateTwilioRequest(r)
+		if actual != test.expected {
+			t.Errorf("ValidateTwilioRequest(%s, PublicURL %q, signature %q) != %v", test.target, test.publicUrl, test.signature, test.expected)
+		}
+	}
+
+	// with no AuthToken configured, nothing is checked
+	config.Twilio.AuthToken = ""
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/txt", strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_ = r.ParseForm()
+	if !ValidateTwilioRequest(r) {
+		t.Errorf("expected unsigned request to be accepted without an AuthToken")
+	}
+}
+
+func TestHandlerSignature(t *testing.T) {
+	TestMode = true
+	config = LoadConfig()
+	defer func() { config = Config{} }()
+
+	data := url.Values{}
+	data.Set("From", "+15125551214") // unrecognized, so nothing gets posted
+	data.Set("Body", "Hello")
+	data.Set("NumMedia", "0")
+	data.Set("MessageSid", "MM0123")
+
+	var tests = []struct {
+		signature    string
+		expectedCode int
+	}{
+		{signature: "WTP3xA9XGfbv382vB7Iyupjur9w=", expectedCode: http.StatusOK},
+		{signature: "rnWj9q8Fbu98CMdMfGEhfFWdZhc=", expectedCode: http.StatusForbidden},
+		{signature: "", expectedCode: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "http://127.0.0.1:8088/txt", strings.NewReader(data.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Twilio-Signature", test.signature)
+		w := httptest.NewRecorder()
+
+		handler(w, r)
+		if w.Code != test.expectedCode {
+			t.Errorf("expected status %d for signature %q, got %d", test.expectedCode, test.signature, w.Code)
+		}
+	}
+}
+
+func TestIsMessageSid(t *testing.T) {
+	var tests = []struct {
+		sid      string
+		expected bool
+	}{
+		{sid: "SM0123456789abcdef0123456789abcdef", expected: true},
+		{sid: "MM0123", expected: true},
+		{sid: "", expected: false},
+		{sid: "../config", expected: false},
+		{sid: "MM0123.json", expected: false},
+	}
+
+	for _, test := range tests {
+		if IsMessageSid(test.sid) != test.expected {
+			t.Errorf("IsMessageSid(%q) != %v", test.sid, test.expected)
+		}
+	}
+}
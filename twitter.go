@@ -15,19 +15,104 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
 )
 
-func createTwitterClient() (client *twittergo.Client, err error) {
+func init() {
+	RegisterPublisher("twitter", 20, func(config Config) Publisher {
+		if config.Twitter == (TwitterConfig{}) {
+			return nil
+		}
+		return &TwitterPublisher{config: config.Twitter, template: config.postTemplate("twitter", plainPostTemplate)}
+	})
+}
+
+// twitterTransport, when set, replaces the HTTP transport used for every
+// Twitter API call; the tests use it to point both APIs at a local server.
+var twitterTransport http.RoundTripper
+
+// TwitterPublisher posts messages to a Twitter account, using the v1 API for
+// media and the v2 API for tweets.
+type TwitterPublisher struct {
+	config   TwitterConfig
+	template *PostTemplate
+}
+
+func (p *TwitterPublisher) Name() string {
+	return "twitter"
+}
+
+// Enabled only posts test messages to a test account (& real messages to the
+// real account)
+func (p *TwitterPublisher) Enabled(message *Message) bool {
+	return IsTestMessage(message) == p.config.TestAccount
+}
+
+// twitterError converts the errors from both Twitter libraries into a
+// StatusError, when there's an HTTP status to be had, so they can be retried
+func twitterError(err error) error {
+	var gotwiErr *gotwi.GotwiError
+	if errors.As(err, &gotwiErr) && gotwiErr.OnAPI {
+		return fmt.Errorf("%w: %s", &StatusError{Service: "Twitter", StatusCode: gotwiErr.StatusCode}, err)
+	}
+	switch e := err.(type) {
+	case twittergo.RateLimitError:
+		return fmt.Errorf("%w: %s", &StatusError{Service: "Twitter", StatusCode: http.StatusTooManyRequests}, err)
+	case twittergo.ResponseError:
+		return fmt.Errorf("%w: %s", &StatusError{Service: "Twitter", StatusCode: e.Code}, err)
+	case twittergo.Errors:
+		return Permanent(err) // only returned for 4xx statuses & 502
+	}
+	return err
+}
+
+func (p *TwitterPublisher) createTwitterClient() (client *twittergo.Client, err error) {
 	clientConfig := &oauth1a.ClientConfig{
-		ConsumerKey:    config.Twitter.ConsumerKey,
-		ConsumerSecret: config.Twitter.ConsumerSecret,
+		ConsumerKey:    p.config.ConsumerKey,
+		ConsumerSecret: p.config.ConsumerSecret,
 	}
-	user := oauth1a.NewAuthorizedConfig(config.Twitter.AccessToken, config.Twitter.AccessTokenSecret)
+	user := oauth1a.NewAuthorizedConfig(p.config.AccessToken, p.config.AccessTokenSecret)
 	client = twittergo.NewClient(clientConfig, user)
+	if twitterTransport != nil {
+		client.HttpClient = &http.Client{Transport: twitterTransport}
+	}
 	return
 }
 
-func sendMediaRequest(client *twittergo.Client, reqUrl string, params map[string]string, media []byte) (mediaResp twittergo.MediaResponse, err error) {
+// twitterUploadURL is the v1 API's media/upload, for pictures, GIFs, & video
+const twitterUploadURL = "https://upload.twitter.com/1.1/media/upload.json"
+
+// twitterChunkSize is how much of a video or GIF is sent in each APPEND; the
+// most Twitter takes is 5MB
+const twitterChunkSize = 4 << 20
+
+// twitterMinStatusWait is the least time between checks on how Twitter's
+// getting on with processing media, whatever check_after_secs it says
+var twitterMinStatusWait = time.Second
+
+// twitterMediaResponse is what media/upload returns for a picture, & for the
+// INIT, FINALIZE, & STATUS commands of a chunked upload
+type twitterMediaResponse struct {
+	MediaId        string                 `json:"media_id_string"`
+	ProcessingInfo *twitterProcessingInfo `json:"processing_info"`
+}
+
+// twitterProcessingInfo says how Twitter's getting on with a video or GIF it's
+// been sent, which it has to finish before it can be tweeted
+type twitterProcessingInfo struct {
+	State          string `json:"state"` // pending, in_progress, failed, or succeeded
+	CheckAfterSecs int    `json:"check_after_secs"`
+	Error          *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// sendMediaRequest posts the params & any media to Twitter's media/upload,
+// parsing the response into out, if it's not nil
+func sendMediaRequest(ctx context.Context, client *twittergo.Client, reqUrl string, params map[string]string, media []byte, out interface{}) (err error) {
 	var (
 		req         *http.Request
 		resp        *twittergo.APIResponse
@@ -48,58 +133,200 @@ func sendMediaRequest(client *twittergo.Client, reqUrl string, params map[string
 	}
 	contentType = fmt.Sprintf("multipart/form-data;boundary=%v", mp.Boundary())
 	mp.Close()
-	if req, err = http.NewRequest("POST", reqUrl, body); err != nil {
+	if req, err = http.NewRequestWithContext(ctx, "POST", reqUrl, body); err != nil {
 		return
 	}
 	req.Header.Set("Content-Type", contentType)
 	if resp, err = client.SendRequest(req); err != nil {
 		return
 	}
-	err = resp.Parse(&mediaResp)
+	if out == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		// APPEND returns nothing
+		resp.Body.Close()
+		return
+	}
+	err = resp.Parse(out)
 	return
 }
 
-func uploadImageToTwitter(filename string) (string, error) {
+// twitterMediaCategory is what Twitter's told a file is: an animated GIF or
+// a video, which are uploaded in chunks & then processed, or else a picture
+func twitterMediaCategory(file MediaFile) string {
+	switch {
+	case isVideo(file.Type):
+		return "tweet_video"
+	case file.Type == "image/gif":
+		if gif, err := os.Open(file.Filename); err == nil {
+			defer gif.Close()
+			if isAnimatedGIF(gif) {
+				return "tweet_gif"
+			}
+		}
+	}
+	return "tweet_image"
+}
+
+func (p *TwitterPublisher) uploadImageToTwitter(ctx context.Context, client *twittergo.Client, filename string) (string, error) {
 	var (
 		err        error
-		client     *twittergo.Client
-		mediaResp  twittergo.MediaResponse
-		mediaId    string
+		mediaResp  twitterMediaResponse
 		mediaBytes []byte
 	)
-	client, err = createTwitterClient()
+	if mediaBytes, err = ioutil.ReadFile(filename); err != nil {
+		log.Printf("error reading media: %s\n", err)
+		return "", err
+	}
+	err = retryPolicy.Do(ctx, "uploading "+filename+" to Twitter", func() error {
+		err = sendMediaRequest(
+			ctx,
+			client,
+			twitterUploadURL,
+			map[string]string{
+				"media_category": "tweet_image",
+			},
+			mediaBytes,
+			&mediaResp,
+		)
+		return twitterError(err)
+	})
 	if err != nil {
-		log.Printf("error creating Twitter (v1) client: %s\n", err)
+		log.Printf("error sending request to Twitter (v1): %s\n", err)
 		return "", err
 	}
-	if mediaBytes, err = ioutil.ReadFile(filename); err != nil {
+	// the string, since media IDs are too big to be JSON numbers
+	return mediaResp.MediaId, nil
+}
+
+// uploadChunksToTwitter uploads a video or animated GIF in chunks: INIT to
+// get a media ID, APPEND for each chunk, & FINALIZE, then waits for Twitter to
+// finish processing it
+func (p *TwitterPublisher) uploadChunksToTwitter(ctx context.Context, client *twittergo.Client, file MediaFile, category string) (string, error) {
+	media, err := os.Open(file.Filename)
+	if err != nil {
 		log.Printf("error reading media: %s\n", err)
 		return "", err
 	}
-	if mediaResp, err = sendMediaRequest(
-		client,
-		"https://upload.twitter.com/1.1/media/upload.json",
-		map[string]string{
-			"media_category": "tweet_image",
-		},
-		mediaBytes,
-	); err != nil {
-		log.Printf("error sending request to Twitter (v1): %s\n", err)
+	defer media.Close()
+	info, err := media.Stat()
+	if err != nil {
+		log.Printf("error reading media: %s\n", err)
+		return "", err
+	}
+
+	var initResp twitterMediaResponse
+	err = retryPolicy.Do(ctx, "starting to upload "+file.Filename+" to Twitter", func() error {
+		return twitterError(sendMediaRequest(ctx, client, twitterUploadURL, map[string]string{
+			"command":        "INIT",
+			"total_bytes":    strconv.FormatInt(info.Size(), 10),
+			"media_type":     file.Type,
+			"media_category": category,
+		}, nil, &initResp))
+	})
+	if err != nil {
+		log.Printf("error starting upload to Twitter (v1): %s\n", err)
 		return "", err
 	}
-	mediaId = fmt.Sprintf("%v", mediaResp.MediaId())
+	mediaId := initResp.MediaId
+	if mediaId == "" {
+		return "", fmt.Errorf("no media ID returned by Twitter for %q", file.Filename)
+	}
 
+	// it's read a chunk at a time, so a big video isn't all in memory
+	buffer := make([]byte, twitterChunkSize)
+	for segment := 0; ; segment++ {
+		n, err := io.ReadFull(media, buffer)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			log.Printf("error reading media: %s\n", err)
+			return "", err
+		}
+		chunk := buffer[:n]
+		err = retryPolicy.Do(ctx, fmt.Sprintf("uploading chunk %d of %s to Twitter", segment, file.Filename), func() error {
+			return twitterError(sendMediaRequest(ctx, client, twitterUploadURL, map[string]string{
+				"command":       "APPEND",
+				"media_id":      mediaId,
+				"segment_index": strconv.Itoa(segment),
+			}, chunk, nil))
+		})
+		if err != nil {
+			log.Printf("error uploading to Twitter (v1): %s\n", err)
+			return "", err
+		}
+	}
+
+	var finalizeResp twitterMediaResponse
+	err = retryPolicy.Do(ctx, "finishing uploading "+file.Filename+" to Twitter", func() error {
+		return twitterError(sendMediaRequest(ctx, client, twitterUploadURL, map[string]string{
+			"command":  "FINALIZE",
+			"media_id": mediaId,
+		}, nil, &finalizeResp))
+	})
+	if err != nil {
+		log.Printf("error finishing upload to Twitter (v1): %s\n", err)
+		return "", err
+	}
+	if err = p.awaitTwitterProcessing(ctx, client, mediaId, finalizeResp.ProcessingInfo); err != nil {
+		log.Printf("error processing %q on Twitter: %s\n", file.Filename, err)
+		return "", err
+	}
 	return mediaId, nil
 }
 
-func postMessageToTwitter(message *Message) (string, error) {
-	const maxRetries = 5
+// awaitTwitterProcessing checks the media's STATUS, as often as Twitter says
+// to (but no more than once a second), until it's been processed (or the
+// context is done)
+func (p *TwitterPublisher) awaitTwitterProcessing(ctx context.Context, client *twittergo.Client, mediaId string, info *twitterProcessingInfo) error {
+	for info != nil {
+		switch info.State {
+		case "succeeded":
+			return nil
+		case "failed":
+			message := "unknown error"
+			if info.Error != nil {
+				message = info.Error.Message
+			}
+			return Permanent(fmt.Errorf("Twitter couldn't process the media: %s", message))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(max(time.Duration(info.CheckAfterSecs)*time.Second, twitterMinStatusWait)):
+		}
+
+		var statusResp twitterMediaResponse
+		err := retryPolicy.Do(ctx, "checking on media "+mediaId+" on Twitter", func() error {
+			query := url.Values{"command": {"STATUS"}, "media_id": {mediaId}}
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, twitterUploadURL+"?"+query.Encode(), nil)
+			if err != nil {
+				return Permanent(err)
+			}
+			resp, err := client.SendRequest(req)
+			if err != nil {
+				return twitterError(err)
+			}
+			return twitterError(resp.Parse(&statusResp))
+		})
+		if err != nil {
+			return err
+		}
+		info = statusResp.ProcessingInfo
+	}
+	return nil
+}
+
+func (p *TwitterPublisher) postMessageToTwitter(ctx context.Context, message *Message, mediaIds []string) (string, error) {
 	// this library also needs the API key & secret set in environment
 	// variables $GOTWI_API_KEY & $GOTWI_API_KEY_SECRET
 	in := &gotwi.NewClientInput{
 		AuthenticationMethod: gotwi.AuthenMethodOAuth1UserContext,
-		OAuthToken:           config.Twitter.AccessToken,
-		OAuthTokenSecret:     config.Twitter.AccessTokenSecret,
+		OAuthToken:           p.config.AccessToken,
+		OAuthTokenSecret:     p.config.AccessTokenSecret,
+	}
+	if twitterTransport != nil {
+		in.HTTPClient = &http.Client{Transport: twitterTransport}
 	}
 
 	client, err := gotwi.NewClient(in)
@@ -108,58 +335,116 @@ func postMessageToTwitter(message *Message) (string, error) {
 		return "", err
 	}
 
-	text := fmt.Sprintf("\"%s\"\n\n– %s", message.Text, message.From)
+	text, err := p.template.or(plainPostTemplate).Format(message)
+	if err != nil {
+		return "", Permanent(err)
+	}
 	input := &types.CreateInput{
 		Text: gotwi.String(text),
 	}
 
-	if len(message.TwitterMediaIds) > 0 {
+	if len(mediaIds) > 0 {
 		input.Media = &types.CreateInputMedia{
-			MediaIDs: message.TwitterMediaIds,
+			MediaIDs: mediaIds,
 		}
 	}
 
 	var tweetId string
-	for numTries := 0; numTries < maxRetries; numTries++ {
-		log.Printf("try #%d: posting to Twitter (v2): Text: %q & MediaIDs: %v", numTries, *input.Text, message.TwitterMediaIds)
-		res, err := managetweet.Create(context.Background(), client, input)
+	err = retryPolicy.DoOnce(ctx, "posting to Twitter (v2)", func() error {
+		log.Printf("posting to Twitter (v2): Text: %q & MediaIDs: %v", *input.Text, mediaIds)
+		res, err := managetweet.Create(ctx, client, input)
 		if err != nil {
-			log.Printf("error posting to Twitter (v2): Text: %q & MediaIDs: %v: %s", *input.Text, message.TwitterMediaIds, err)
-		} else {
-			tweetId = gotwi.StringValue(res.Data.Text)
-			break
+			return twitterError(err)
 		}
+		tweetId = gotwi.StringValue(res.Data.ID)
+		return nil
+	})
+	if err != nil {
+		log.Printf("error posting to Twitter (v2): Text: %q & MediaIDs: %v: %s", *input.Text, mediaIds, err)
+		return "", err
 	}
 
-	if tweetId == "" {
-		return "", errors.New(fmt.Sprintf("unable to post to Twitter (v2) after %d tries\n", maxRetries))
-	}
+	return "https://twitter.com/i/web/status/" + tweetId, nil
+}
 
-	return tweetId, nil
+// twitterImageLimits is what Twitter's v1 media/upload takes: pictures, GIFs,
+// & MP4 or MOV video
+var twitterImageLimits = ImageLimits{
+	Types:         newMediaTypeSet("image/jpeg", "image/png", "image/gif", "image/webp", "video/mp4", "video/quicktime"),
+	MaxBytes:      5 << 20,
+	MaxSide:       4096,
+	MaxVideoBytes: 512 << 20,
 }
 
-func UploadMessageToTwitter(message *Message) error {
-	var err error
+// twitterMaxImages is the most pictures a tweet can have; a video or
+// animated GIF has to be on its own
+const twitterMaxImages = 4
 
-	// only post test messages to a test account (& real messages to real account)
-	if IsTestMessage(message) == config.Twitter.TestAccount {
-		for _, filename := range message.ImageFilenames {
-			mediaId, err := uploadImageToTwitter(filename)
-			if err != nil {
-				return err
+// twitterTweetMedia returns the files a tweet can have, logging the rest: the
+// video or animated GIF alone, if one comes first, or else up to
+// twitterMaxImages pictures
+func twitterTweetMedia(files []MediaFile) []MediaFile {
+	var chosen []MediaFile
+	for i, file := range files {
+		alone := twitterMediaCategory(file) != "tweet_image"
+		switch {
+		case i == 0 && alone:
+			for _, skipped := range files[1:] {
+				log.Printf("Twitter allows nothing else with a video or animated GIF; skipping %q\n", skipped.Filename)
 			}
-			log.Printf("uploaded image %q to Twitter, got mediaId %q\n", filename, mediaId)
-			message.TwitterMediaIds = append(message.TwitterMediaIds, mediaId)
+			return files[:1]
+		case alone:
+			log.Printf("Twitter allows no videos or animated GIFs with pictures; skipping %q\n", file.Filename)
+		case len(chosen) == twitterMaxImages:
+			log.Printf("Twitter allows only %d pictures per tweet; skipping %q\n", twitterMaxImages, file.Filename)
+		default:
+			chosen = append(chosen, file)
 		}
+	}
+	return chosen
+}
 
-		message.TwitterPostURL, err = postMessageToTwitter(message)
+// UploadMedia uploads the Message's pictures or video to Twitter, returning
+// their media IDs. Pictures are converted or shrunk for Twitter if need be,
+// videos & animated GIFs uploaded in chunks, & files of other types, or more
+// than a tweet can have (see twitterTweetMedia), skipped.
+func (p *TwitterPublisher) UploadMedia(ctx context.Context, message *Message) ([]string, error) {
+	var mediaIds []string
+	files, remove := message.prepareMedia("Twitter", twitterImageLimits)
+	defer remove()
+	files = twitterTweetMedia(files)
+	if len(files) == 0 {
+		return nil, nil
+	}
+	client, err := p.createTwitterClient()
+	if err != nil {
+		log.Printf("error creating Twitter (v1) client: %s\n", err)
+		return nil, err
+	}
+	for _, file := range files {
+		var mediaId string
+		category := twitterMediaCategory(file)
+		if category == "tweet_image" {
+			mediaId, err = p.uploadImageToTwitter(ctx, client, file.Filename)
+		} else {
+			mediaId, err = p.uploadChunksToTwitter(ctx, client, file, category)
+		}
 		if err != nil {
-			return err
+			return mediaIds, err
 		}
+		log.Printf("uploaded %s %q to Twitter, got mediaId %q\n", category, file.Filename, mediaId)
+		mediaIds = append(mediaIds, mediaId)
+	}
+	return mediaIds, nil
+}
 
-		log.Printf("posted message to Twitter\n")
-	} else {
-		log.Printf("no Twitter account configured for this message type\n")
+// Publish tweets the Message with its already-uploaded media, returning the
+// URL of the tweet.
+func (p *TwitterPublisher) Publish(ctx context.Context, message *Message, mediaIds []string) (string, error) {
+	tweetURL, err := p.postMessageToTwitter(ctx, message, mediaIds)
+	if err != nil {
+		return "", err
 	}
-	return nil
+	log.Printf("posted message to Twitter\n")
+	return tweetURL, nil
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTwitterUpload is Twitter's media/upload, recording the commands it's
+// sent & the chunks of each upload
+type fakeTwitterUpload struct {
+	mu         sync.Mutex
+	commands   []string
+	times      []time.Time // when each command was sent
+	categories []string
+	chunks     map[string][]byte
+	segments   map[string]int
+	statuses   []string // the processing states to go through, in order
+}
+
+func newFakeTwitterUpload(t *testing.T, statuses ...string) *fakeTwitterUpload {
+	upload := &fakeTwitterUpload{chunks: make(map[string][]byte), segments: make(map[string]int), statuses: statuses}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/1.1/media/upload.json" {
+			t.Errorf("unexpected Twitter request to %s", r.URL.Path)
+			return
+		}
+		upload.mu.Lock()
+		defer upload.mu.Unlock()
+		upload.times = append(upload.times, time.Now())
+		if r.Method == http.MethodGet {
+			upload.commands = append(upload.commands, r.URL.Query().Get("command"))
+			upload.writeProcessingInfo(w, r.URL.Query().Get("media_id"))
+			return
+		}
+
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			t.Errorf("expected a multipart upload, got %s", err)
+		}
+		command := r.FormValue("command")
+		if command == "" {
+			command = "upload" // in one go
+		}
+		upload.commands = append(upload.commands, command)
+		switch command {
+		case "INIT":
+			upload.categories = append(upload.categories, r.FormValue("media_category"))
+			fmt.Fprintf(w, `{"media_id": 1, "media_id_string": "video%d"}`, strings.Count(strings.Join(upload.commands, " "), "INIT"))
+		case "APPEND":
+			mediaId := r.FormValue("media_id")
+			if segment := r.FormValue("segment_index"); segment != fmt.Sprint(upload.segments[mediaId]) {
+				t.Errorf("expected segment %d of %s, got %s", upload.segments[mediaId], mediaId, segment)
+			}
+			upload.segments[mediaId]++
+			upload.chunks[mediaId] = append(upload.chunks[mediaId], r.FormValue("media")...)
+			w.WriteHeader(http.StatusNoContent)
+		case "FINALIZE":
+			upload.writeProcessingInfo(w, r.FormValue("media_id"))
+		default:
+			upload.categories = append(upload.categories, r.FormValue("media_category"))
+			_, _ = w.Write([]byte(`{"media_id": 710511363345354753, "media_id_string": "710511363345354753"}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	target, _ := url.Parse(server.URL)
+	twitterTransport = redirectTransport{target: target}
+	twitterMinStatusWait = 20 * time.Millisecond
+	t.Cleanup(func() { twitterTransport, twitterMinStatusWait = nil, time.Second })
+	return upload
+}
+
+// writeProcessingInfo responds with the next processing state, if there is one
+func (u *fakeTwitterUpload) writeProcessingInfo(w http.ResponseWriter, mediaId string) {
+	if len(u.statuses) == 0 {
+		fmt.Fprintf(w, `{"media_id_string": %q}`, mediaId)
+		return
+	}
+	state := u.statuses[0]
+	u.statuses = u.statuses[1:]
+	if state == "failed" {
+		fmt.Fprintf(w, `{"media_id_string": %q, "processing_info": {"state": "failed", "error": {"message": "InvalidMedia"}}}`, mediaId)
+		return
+	}
+	fmt.Fprintf(w, `{"media_id_string": %q, "processing_info": {"state": %q, "check_after_secs": 0}}`, mediaId, state)
+}
+
+func TestTwitterUploadsVideo(t *testing.T) {
+	upload := newFakeTwitterUpload(t, "pending", "in_progress", "succeeded")
+	publisher := &TwitterPublisher{config: TwitterConfig{ConsumerKey: "key", AccessToken: "token"}}
+
+	// big enough to go in 3 chunks
+	video := filepath.Join(t.TempDir(), "ME_temp.mp4")
+	contents := append([]byte(testMedia["mp4"]), bytes.Repeat([]byte{1}, 2*twitterChunkSize)...)
+	if err := os.WriteFile(video, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// a video's tweeted alone
+	message := Message{
+		ImageFilenames: append([]string{video}, writeTestImages(t, 10)...),
+		MediaTypes:     []string{"video/mp4", "image/jpeg"},
+	}
+	mediaIds, err := publisher.UploadMedia(context.Background(), &message)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if strings.Join(mediaIds, " ") != "video1" {
+		t.Errorf("unexpected media IDs %v", mediaIds)
+	}
+
+	// as is an animated GIF
+	message = Message{ImageFilenames: []string{copyFixtureImage(t, "animated.gif")}, MediaTypes: []string{"image/gif"}}
+	if mediaIds, err = publisher.UploadMedia(context.Background(), &message); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if strings.Join(mediaIds, " ") != "video2" {
+		t.Errorf("unexpected media IDs %v", mediaIds)
+	}
+
+	if strings.Join(upload.categories, " ") != "tweet_video tweet_gif" {
+		t.Errorf("unexpected media categories %v", upload.categories)
+	}
+	expected := "INIT APPEND APPEND APPEND FINALIZE STATUS STATUS INIT APPEND FINALIZE"
+	if strings.Join(upload.commands, " ") != expected {
+		t.Errorf("expected commands %q, got %q", expected, strings.Join(upload.commands, " "))
+	}
+	// Twitter says to check again after 0 seconds, but that's too soon
+	for i, command := range upload.commands {
+		if command == "STATUS" && upload.times[i].Sub(upload.times[i-1]) < twitterMinStatusWait {
+			t.Errorf("expected STATUS checked at most every %s, got %s", twitterMinStatusWait, upload.times[i].Sub(upload.times[i-1]))
+		}
+	}
+	if !bytes.Equal(upload.chunks["video1"], contents) {
+		t.Errorf("expected the video uploaded whole, got %d bytes of %d", len(upload.chunks["video1"]), len(contents))
+	}
+	if gif := mustReadFile(t, message.ImageFilenames[0]); !bytes.Equal(upload.chunks["video2"], gif) {
+		t.Errorf("expected the GIF uploaded whole, got %d bytes of %d", len(upload.chunks["video2"]), len(gif))
+	}
+}
+
+func TestTwitterVideoProcessingFails(t *testing.T) {
+	upload := newFakeTwitterUpload(t, "in_progress", "failed")
+	publisher := &TwitterPublisher{config: TwitterConfig{ConsumerKey: "key", AccessToken: "token"}}
+
+	message := Message{ImageFilenames: writeTestMedia(t, "mov"), MediaTypes: []string{"video/quicktime"}}
+	_, err := publisher.UploadMedia(context.Background(), &message)
+	if err == nil || !strings.Contains(err.Error(), "InvalidMedia") || IsRetryable(err) {
+		t.Errorf("expected a permanent error saying why, got %v", err)
+	}
+	if strings.Join(upload.commands, " ") != "INIT APPEND FINALIZE STATUS" {
+		t.Errorf("expected processing checked until it failed, got %v", upload.commands)
+	}
+
+	// video Twitter doesn't take isn't sent
+	upload.commands = nil
+	message = Message{ImageFilenames: writeTestMedia(t, "3gp"), MediaTypes: []string{"video/3gpp"}}
+	if mediaIds, err := publisher.UploadMedia(context.Background(), &message); err != nil || len(mediaIds) != 0 || len(upload.commands) != 0 {
+		t.Errorf("expected the 3GP skipped, got %v %v %v", mediaIds, err, upload.commands)
+	}
+}
+
+func TestTwitterTweetMedia(t *testing.T) {
+	pictures := writeTestImages(t, 10, 10, 10, 10, 10)
+	video := writeTestMedia(t, "mp4")[0]
+	files := func(filenames ...string) []MediaFile {
+		var files []MediaFile
+		for _, filename := range filenames {
+			files = append(files, MediaFile{Filename: filename, Type: fileMediaType(filename)})
+		}
+		return files
+	}
+	names := func(files []MediaFile) []string {
+		var names []string
+		for _, file := range files {
+			names = append(names, filepath.Base(file.Filename))
+		}
+		return names
+	}
+
+	var tests = []struct {
+		name     string
+		files    []MediaFile
+		expected []MediaFile
+	}{
+		{name: "5 pictures", files: files(pictures...), expected: files(pictures[:4]...)},
+		{name: "a video first", files: files(video, pictures[0]), expected: files(video)},
+		{name: "a video after a picture", files: files(pictures[0], video, pictures[1]), expected: files(pictures[0], pictures[1])},
+	}
+	for _, test := range tests {
+		if actual := twitterTweetMedia(test.files); fmt.Sprint(names(actual)) != fmt.Sprint(names(test.expected)) {
+			t.Errorf("expected a tweet with %s to have %v, got %v", test.name, names(test.expected), names(actual))
+		}
+	}
+}
@@ -5,18 +5,53 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 // TestMode defaults to false but is set in the tests to load test config
 var TestMode = false
 
 type MicroBlogConfig struct {
+	Endpoint        string // defaults to Micro.blog's own Micropub endpoint
 	Token           string
 	Destination     string
 	TestDestination string
 }
 
+// MicropubConfig is an IndieWeb site to post to via Micropub. Either the Site
+// (to discover the endpoints from) or the Endpoint is needed.
+type MicropubConfig struct {
+	Name            string // identifies the site in replies & logs; defaults to "micropub"
+	Preset          string // fills in a known service's endpoints, e.g. "microblog"
+	Site            string
+	Endpoint        string
+	MediaEndpoint   string // discovered from the Endpoint, if not set
+	Token           string
+	Destination     string // the mp-destination, for accounts with more than one blog
+	TestDestination string
+	JSON            bool // post JSON rather than form-encoded data
+}
+
+type StaticSiteConfig struct {
+	ContentDir   string   // where posts are written, e.g. "site/content/posts" or "site/_posts"
+	AssetsDir    string   // where images are copied, e.g. "site/static/images"
+	AssetsURL    string   // the URL path images are served from, e.g. "/images"
+	Permalink    string   // a post's URL, e.g. "https://mary.example.com/posts/{slug}/"
+	BuildCommand []string // optional, e.g. ["hugo", "--minify"]
+	BuildDir     string   // where to run the BuildCommand
+	TestSite     bool
+}
+
+type GitArchiveConfig struct {
+	Dir         string // the repository, which is created if need be
+	Remote      string // optional; pushed to after each commit, e.g. "origin"
+	Email       string // for commits; defaults to "txt2mary@localhost"
+	CommitURL   string // optional; a commit's URL, e.g. "https://github.com/me/mary/commit/{commit}"
+	TestArchive bool
+}
+
 type TwitterConfig struct {
 	ConsumerKey       string
 	ConsumerSecret    string
@@ -25,58 +60,303 @@ type TwitterConfig struct {
 	TestAccount       bool
 }
 
+type MastodonConfig struct {
+	Server      string // e.g. "https://mastodon.social"
+	AccessToken string
+	Visibility  string // "public" (the default), "unlisted", "private", or "direct"
+	TestAccount bool
+}
+
+type BlueskyConfig struct {
+	Service     string // the account's PDS; defaults to "https://bsky.social"
+	Handle      string // e.g. "mary.bsky.social"
+	AppPassword string
+	TestAccount bool
+}
+
+// WebConfig is for the web UI for browsing the archive, which is only served
+// if there's a Password
+type WebConfig struct {
+	Route    string // defaults to "/archive"
+	Username string // optional; any username is accepted without one
+	Password string
+}
+
+func (c WebConfig) route() string {
+	if c.Route == "" {
+		return defaultWebRoute
+	}
+	return strings.TrimSuffix(c.Route, "/")
+}
+
+// FeedConfig is for RSS, Atom & JSON feeds of recently posted messages,
+// which are only served if there's a URL
+type FeedConfig struct {
+	URL         string // the server's public URL, e.g. "https://txt.example.com", for links in the feeds
+	Title       string // defaults to "txt2mary"
+	Description string
+	RSSPath     string // defaults to "/feed.rss"; "-" for no RSS feed
+	AtomPath    string // defaults to "/feed.atom"; "-" for no Atom feed
+	JSONPath    string // defaults to "/feed.json"; "-" for no JSON Feed
+	Items       int    // how many messages are in the feeds; defaults to 20
+}
+
+// paths returns the path of each feed that's served, by format
+func (c FeedConfig) paths() map[string]string {
+	paths := make(map[string]string)
+	for format, configured := range map[string]string{"rss": c.RSSPath, "atom": c.AtomPath, "json": c.JSONPath} {
+		switch configured {
+		case "":
+			paths[format] = defaultFeedPaths[format]
+		case "-":
+		default:
+			paths[format] = configured
+		}
+	}
+	return paths
+}
+
+func (c FeedConfig) title() string {
+	if c.Title == "" {
+		return "txt2mary"
+	}
+	return c.Title
+}
+
+func (c FeedConfig) items() int {
+	if c.Items <= 0 {
+		return defaultFeedItems
+	}
+	return c.Items
+}
+
+type TwilioConfig struct {
+	AuthToken string
+	PublicURL string
+}
+
+type RetryConfig struct {
+	Attempts  int
+	BaseDelay float64 // seconds
+	MaxDelay  float64 // seconds
+}
+
 type Config struct {
 	Logfile           string
 	Server            string
 	ServerRoute       string
 	UsersFilename     string
 	HoneybadgerAPIKey string
+	PublishTimeout    int // seconds allowed for posting to each destination
+	QueueDir          string
+	Workers           int
+	ReplyWait         int // seconds to wait for a message to be posted before replying
+	DedupeFile        string
+	DedupeExpiry      int // hours to remember MessageSids for
+	DeadLetterDir     string
+	ArchiveFile       string // the SQLite database of every message; "-" for none
+	ArchiveImageDir   string // where the archive keeps images; "-" for nowhere
+	KeepImageMetadata bool   // post pictures' EXIF & XMP (GPS & all), rather than removing it
+	MediaDir          string // where texts' pictures & such are downloaded to, while they're posted
+	Web               WebConfig
+	Feed              FeedConfig
+	Templates         map[string]string // text/template post formats, by destination name
+	Retry             RetryConfig
+	Twilio            TwilioConfig
 	MicroBlog         MicroBlogConfig
+	Micropub          []MicropubConfig
+	StaticSite        StaticSiteConfig
+	GitArchive        GitArchiveConfig
 	Twitter           TwitterConfig
+	Mastodon          MastodonConfig
+	Bluesky           BlueskyConfig
+}
+
+const (
+	defaultPublishTimeout  = 60 * time.Second
+	defaultQueueDir        = "queue"
+	defaultWorkers         = 2
+	defaultReplyWait       = 10 * time.Second
+	defaultDedupeFile      = "dedupe.json"
+	defaultDedupeExpiry    = 72 * time.Hour
+	defaultDeadLetterDir   = "deadletter"
+	defaultArchiveFile     = "archive.db"
+	defaultArchiveImageDir = "archive-images"
+	defaultMediaDir        = "txt2mary-media" // in the user's cache dir
+)
+
+// publishTimeout returns how long posting to any one destination may take
+func (c Config) publishTimeout() time.Duration {
+	if c.PublishTimeout <= 0 {
+		return defaultPublishTimeout
+	}
+	return time.Duration(c.PublishTimeout) * time.Second
+}
+
+func (c Config) queueDir() string {
+	if c.QueueDir == "" {
+		return defaultQueueDir
+	}
+	return c.QueueDir
+}
+
+func (c Config) workers() int {
+	if c.Workers <= 0 {
+		return defaultWorkers
+	}
+	return c.Workers
+}
+
+// replyWait returns how long the webhook waits for a message to be posted so
+// it can reply with the URL. Negative means don't wait at all. Twilio gives up
+// after 15 seconds, so the default stays well short of that.
+func (c Config) replyWait() time.Duration {
+	if c.ReplyWait < 0 {
+		return 0
+	}
+	if c.ReplyWait == 0 {
+		return defaultReplyWait
+	}
+	return time.Duration(c.ReplyWait) * time.Second
+}
+
+func (c Config) dedupeFile() string {
+	if c.DedupeFile == "" {
+		return defaultDedupeFile
+	}
+	return c.DedupeFile
+}
+
+func (c Config) dedupeExpiry() time.Duration {
+	if c.DedupeExpiry <= 0 {
+		return defaultDedupeExpiry
+	}
+	return time.Duration(c.DedupeExpiry) * time.Hour
+}
+
+func (c Config) deadLetterDir() string {
+	if c.DeadLetterDir == "" {
+		return defaultDeadLetterDir
+	}
+	return c.DeadLetterDir
+}
+
+// archiveFile returns the archive database, or "" if it's turned off
+func (c Config) archiveFile() string {
+	switch c.ArchiveFile {
+	case "":
+		return defaultArchiveFile
+	case "-":
+		return ""
+	}
+	return c.ArchiveFile
+}
+
+// archiveImageDir returns where the archive keeps images, or "" if it
+// doesn't
+func (c Config) archiveImageDir() string {
+	switch c.ArchiveImageDir {
+	case "":
+		return defaultArchiveImageDir
+	case "-":
+		return ""
+	}
+	return c.ArchiveImageDir
+}
+
+// mediaDir returns where texts' media is downloaded to: a dir in the user's
+// cache dir (or the system's temp dir, if there's no home), unless it's
+// configured
+func (c Config) mediaDir() string {
+	if c.MediaDir != "" {
+		return c.MediaDir
+	}
+	if cache, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(cache, defaultMediaDir)
+	}
+	return filepath.Join(os.TempDir(), defaultMediaDir)
+}
+
+// retryPolicy returns the configured RetryPolicy, with defaults for anything
+// not set
+func (c Config) retryPolicy() RetryPolicy {
+	policy := defaultRetryPolicy
+	if c.Retry.Attempts > 0 {
+		policy.Attempts = c.Retry.Attempts
+	}
+	if c.Retry.BaseDelay > 0 {
+		policy.BaseDelay = time.Duration(c.Retry.BaseDelay * float64(time.Second))
+	}
+	if c.Retry.MaxDelay > 0 {
+		policy.MaxDelay = time.Duration(c.Retry.MaxDelay * float64(time.Second))
+	}
+	return policy
 }
 
 func IsTestMessage(message *Message) bool {
 	return strings.HasPrefix(message.Text, "TEST: ")
 }
 
-func LoadConfig() Config {
+// ConfigFilename is the config file LoadConfig reads; it's set by --config
+var ConfigFilename = "config.json"
+
+// ReadConfig reads & parses the given config file, checking that the users
+// file it names is present.
+func ReadConfig(filename string) (Config, error) {
 	var config Config
-	filename := "config.json"
-	if TestMode {
-		filename = "./fixtures/config_test.json"
-	}
 	contents, err := os.ReadFile(filename)
 	if err != nil {
-		log.Fatal(err)
+		return config, err
 	}
 
 	err = json.Unmarshal(contents, &config)
 	if err != nil {
-		log.Fatal(err)
+		return config, fmt.Errorf("error parsing config file %q: %w", filename, err)
 	}
 
 	// ensure the configured users file is present
 	_, err = os.Stat(config.UsersFilename)
 	if err != nil {
-		log.Fatalf("error checking users file: %s\n", err)
+		return config, fmt.Errorf("error checking users file: %w", err)
 	}
 
+	return config, nil
+}
+
+func LoadConfig() Config {
+	filename := ConfigFilename
+	if TestMode {
+		filename = "./fixtures/config_test.json"
+	}
+	config, err := ReadConfig(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
 	return config
 }
 
-func loadUsersFile() map[string]string {
-	config := LoadConfig()
-	contents, err := os.ReadFile(config.UsersFilename)
+// ReadUsersFile reads the mapping of phone numbers to names from the file
+func ReadUsersFile(filename string) (map[string]string, error) {
+	contents, err := os.ReadFile(filename)
 	if err != nil {
-		log.Fatalf("error loading users file %q: %s\n", config.UsersFilename, err)
+		return nil, fmt.Errorf("error loading users file %q: %w", filename, err)
 	}
 
 	var phoneMap map[string]string
 	err = json.Unmarshal(contents, &phoneMap)
 	if err != nil {
-		log.Fatalf("error parsing phone file %q: %s\n", config.UsersFilename, err)
+		return nil, fmt.Errorf("error parsing phone file %q: %w", filename, err)
 	}
 
+	return phoneMap, nil
+}
+
+func loadUsersFile() map[string]string {
+	config := LoadConfig()
+	phoneMap, err := ReadUsersFile(config.UsersFilename)
+	if err != nil {
+		log.Fatal(err)
+	}
 	return phoneMap
 }
 
@@ -85,16 +365,27 @@ func LookupPhone(phone string) string {
 	return phoneMap[phone]
 }
 
-func Format(msg string, fromPhone string) string {
-	if msg == "" {
-		msg = "&nbsp;"
-	}
-	from := LookupPhone(fromPhone)
-	if from == "" {
-		from = "(unknown sender)" // shouldn't happen, but just in case
+// writeFileAtomic writes the file via a synced temp file in the same
+// directory, so a crash leaves either the old contents or the new, never half
+func writeFileAtomic(filename string, contents []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+"-*")
+	if err != nil {
+		return err
 	}
+	defer os.Remove(temp.Name()) // fails harmlessly once renamed
 
-	return fmt.Sprintf("> %s\n\n&ndash; %s", msg, from)
+	if _, err = temp.Write(contents); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), filename)
 }
 
 func Twiml(msg string) string {
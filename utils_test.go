@@ -47,24 +47,3 @@ func TestLookup(t *testing.T) {
 		}
 	}
 }
-
-func TestFormat(t *testing.T) {
-	TestMode = true
-
-	var tests = []struct {
-		msg         string
-		phoneNum    string
-		expectedMsg string
-	}{
-		{msg: "Thinking of you!", phoneNum: "+15125551212", expectedMsg: "> Thinking of you!\n\n&ndash; Gon"},
-		{msg: "", phoneNum: "+15125551213", expectedMsg: "> &nbsp;\n\n&ndash; Killua"},
-		{msg: "Hello", phoneNum: "+15125551214", expectedMsg: "> Hello\n\n&ndash; (unknown sender)"},
-	}
-
-	for _, test := range tests {
-		actual := Format(test.msg, test.phoneNum)
-		if actual != test.expectedMsg {
-			t.Errorf("Format(%s, %s) != %q (%q)", test.msg, test.phoneNum, test.expectedMsg, actual)
-		}
-	}
-}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+var archiveTemplate = template.Must(template.New("archive.html").Funcs(template.FuncMap{
+	"localTime": func(t time.Time) string { return t.Local().Format("Mon Jan 2, 2006 3:04 PM") },
+}).ParseFS(templateFiles, "templates/archive.html"))
+
+const (
+	defaultWebRoute = "/archive"
+	archivePageSize = 50
+)
+
+// storedImagePattern matches the path of an image within the archive's image
+// store, e.g. ab/abcdef….jpg, so nothing else can be served from there
+var storedImagePattern = regexp.MustCompile(`^[0-9a-f]{2}/[0-9a-f]{64}\.[a-z0-9]+$`)
+
+// archivePage is what the archive template shows
+type archivePage struct {
+	Route    string
+	Messages []ArchivedMessage
+	Senders  []string
+	Sender   string
+	Query    string
+	Page     int
+	Newer    string // URLs of the neighbouring pages, if any
+	Older    string
+}
+
+// ArchiveWebHandler serves a read-only web UI for browsing the archive, behind
+// HTTP basic authentication, at the configured route: the messages, newest
+// first, with their pictures & links to where they were posted, & a JSON
+// search of them at search.json.
+func ArchiveWebHandler(archive *Archive, web WebConfig, imageDir string) http.Handler {
+	route := web.route()
+	mux := http.NewServeMux()
+	mux.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, route+"/", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc(route+"/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != route+"/" {
+			http.NotFound(w, r)
+			return
+		}
+		serveArchivePage(w, r, archive, route)
+	})
+	mux.HandleFunc(route+"/search.json", searchHandler(archive))
+	mux.HandleFunc(route+"/images/", func(w http.ResponseWriter, r *http.Request) {
+		stored := strings.TrimPrefix(r.URL.Path, route+"/images/")
+		if imageDir == "" || !storedImagePattern.MatchString(stored) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable") // named for its contents
+		http.ServeFile(w, r, filepath.Join(imageDir, filepath.FromSlash(stored)))
+	})
+	return requirePassword(web, mux)
+}
+
+// requirePassword only lets through requests with the configured username
+// (if any) & password
+func requirePassword(web WebConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		usernameOK := web.Username == "" || subtle.ConstantTimeCompare([]byte(username), []byte(web.Username)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(web.Password)) == 1
+		if !ok || !usernameOK || !passwordOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="txt2mary archive", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pageURL links to another page of the archive, keeping the filters
+func pageURL(route string, sender string, query string, page int) string {
+	values := url.Values{}
+	if sender != "" {
+		values.Set("sender", sender)
+	}
+	if query != "" {
+		values.Set("q", query)
+	}
+	if page > 1 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	if len(values) == 0 {
+		return route + "/"
+	}
+	return route + "/?" + values.Encode()
+}
+
+func serveArchivePage(w http.ResponseWriter, r *http.Request, archive *Archive, route string) {
+	page := archivePage{
+		Route:  route,
+		Sender: r.FormValue("sender"),
+		Query:  strings.TrimSpace(r.FormValue("q")),
+		Page:   1,
+	}
+	if n, err := strconv.Atoi(r.FormValue("page")); err == nil && n > 1 {
+		page.Page = n
+	}
+
+	// one more than fits, to tell whether there's an older page
+	messages, err := archive.Messages(MessageQuery{
+		Sender: page.Sender,
+		Text:   page.Query,
+		Limit:  archivePageSize + 1,
+		Offset: (page.Page - 1) * archivePageSize,
+	})
+	if err == nil {
+		page.Senders, err = archive.Senders()
+	}
+	if err != nil {
+		log.Printf("error reading the archive: %s", err)
+		http.Error(w, "error reading the archive", http.StatusInternalServerError)
+		return
+	}
+
+	if len(messages) > archivePageSize {
+		messages = messages[:archivePageSize]
+		page.Older = pageURL(route, page.Sender, page.Query, page.Page+1)
+	}
+	if page.Page > 1 {
+		page.Newer = pageURL(route, page.Sender, page.Query, page.Page-1)
+	}
+	page.Messages = messages
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = archiveTemplate.Execute(w, page); err != nil {
+		log.Printf("error rendering the archive: %s", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupWebTest archives messages from Gon & Killua, one with a picture, and
+// returns the web UI for them
+func setupWebTest(t *testing.T) http.Handler {
+	imageDir := t.TempDir()
+	archive := openTestArchive(t, imageDir)
+	received := time.Date(2023, 11, 27, 14, 0, 0, 0, time.UTC)
+	messages := []Message{
+		{MessageSid: "SM1", From: "Gon", Text: "just a couple bros", Received: received,
+			ImageFilenames: writeTestImages(t, 10),
+			Results:        map[string]PublishResult{"microblog": {URL: "https://foo.micro.blog/1"}}},
+		{MessageSid: "SM2", From: "Killua", Text: "100% <b>fishing</b>", Received: received.Add(time.Hour),
+			Results: map[string]PublishResult{"twitter": {Err: errors.New("boom")}}},
+		{MessageSid: "SM3", From: "Gon", Text: "at the lake", Received: received.Add(2 * time.Hour)},
+	}
+	for _, message := range messages {
+		if _, err := archive.Record(&message); err != nil {
+			t.Fatalf("error archiving: %s", err)
+		}
+	}
+	return ArchiveWebHandler(archive, WebConfig{Username: "mary", Password: "secret"}, imageDir)
+}
+
+func getArchivePage(handler http.Handler, target string, password string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if password != "" {
+		r.SetBasicAuth("mary", password)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestArchiveWebRequiresPassword(t *testing.T) {
+	handler := setupWebTest(t)
+	for _, password := range []string{"", "wrong"} {
+		w := getArchivePage(handler, "/archive/", password)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("expected password %q to be refused, got %d", password, w.Code)
+		}
+	}
+}
+
+func TestArchiveWebLists(t *testing.T) {
+	handler := setupWebTest(t)
+
+	w := getArchivePage(handler, "/archive/", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the archive, got %d", w.Code)
+	}
+	body := w.Body.String()
+	lake, fishing, bros := strings.Index(body, "at the lake"), strings.Index(body, "fishing"), strings.Index(body, "just a couple bros")
+	if lake < 0 || fishing < lake || bros < fishing {
+		t.Errorf("expected all 3 messages, newest first, got %s", body)
+	}
+	if !strings.Contains(body, "100% &lt;b&gt;fishing&lt;/b&gt;") {
+		t.Errorf("expected the text escaped")
+	}
+	if !strings.Contains(body, `<a href="https://foo.micro.blog/1">`) || !strings.Contains(body, "twitter: <span class=\"error\">failed (boom)</span>") {
+		t.Errorf("expected the results linked & shown")
+	}
+	if !strings.Contains(body, `<img src="/archive/images/`) {
+		t.Errorf("expected a thumbnail")
+	}
+
+	// filtered by sender, & searched
+	body = getArchivePage(handler, "/archive/?sender=Gon", "secret").Body.String()
+	if strings.Contains(body, "fishing") || !strings.Contains(body, "at the lake") || !strings.Contains(body, "<option selected>Gon</option>") {
+		t.Errorf("expected only Gon's messages, got %s", body)
+	}
+	body = getArchivePage(handler, "/archive/?q=100%25", "secret").Body.String()
+	if !strings.Contains(body, "fishing") || strings.Contains(body, "at the lake") {
+		t.Errorf("expected only the message containing %q, got %s", "100%", body)
+	}
+	body = getArchivePage(handler, "/archive/?q=nothing", "secret").Body.String()
+	if !strings.Contains(body, "No messages match.") {
+		t.Errorf("expected no messages, got %s", body)
+	}
+}
+
+func TestArchiveWebImages(t *testing.T) {
+	handler := setupWebTest(t)
+	body := getArchivePage(handler, "/archive/", "secret").Body.String()
+	start := strings.Index(body, `<img src="`) + len(`<img src="`)
+	src := body[start : start+strings.Index(body[start:], `"`)]
+
+	w := getArchivePage(handler, src, "secret")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("expected the image served from %s, got %d %q", src, w.Code, w.Header().Get("Content-Type"))
+	}
+	if w = getArchivePage(handler, "/archive/images/../archive.db", "secret"); w.Code == http.StatusOK {
+		t.Errorf("expected only stored images served")
+	}
+}
+
+func TestArchiveWebPages(t *testing.T) {
+	archive := openTestArchive(t, "")
+	for i := 0; i < archivePageSize+5; i++ {
+		message := Message{From: "Gon", Text: fmt.Sprintf("message %d", i), Received: time.Unix(int64(i), 0)}
+		_, _ = archive.Record(&message)
+	}
+	handler := ArchiveWebHandler(archive, WebConfig{Password: "secret"}, "")
+
+	body := getArchivePage(handler, "/archive/?sender=Gon", "secret").Body.String()
+	if strings.Count(body, "<article>") != archivePageSize || !strings.Contains(body, `href="/archive/?page=2&amp;sender=Gon">older`) {
+		t.Errorf("expected a full first page linking to the next, got %s", body)
+	}
+	body = getArchivePage(handler, "/archive/?page=2&sender=Gon", "secret").Body.String()
+	if strings.Count(body, "<article>") != 5 || strings.Contains(body, "older &rarr;") || !strings.Contains(body, "&larr; newer") {
+		t.Errorf("expected the last 5 messages on page 2, got %s", body)
+	}
+}